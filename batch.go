@@ -0,0 +1,181 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// EnrollFromDir submits every PEM encoded CSR of dir (*.csr) to cfg.PKI and
+// writes each issued certificate and root next to its request: name.csr
+// gives name.crt and name.ca.crt. The keys stay wherever the CSRs were
+// generated. Results hold the successful enrollments; failures are joined
+// in the returned error, each naming its CSR file.
+//
+// With Config.BatchStateFile set, each enrolled CSR is recorded there as
+// soon as its files are written, and a rerun, e.g. after a crash, skips
+// the CSRs recorded whose certificate is still valid and matches the
+// request. Skipped CSRs are not part of the results.
+func EnrollFromDir(dir string, cfg Config) ([]EnrollResult, error) {
+	csrFiles, err := filepath.Glob(filepath.Join(dir, "*.csr"))
+	if err != nil {
+		return nil, err
+	}
+	var state *batchState
+	if cfg.BatchStateFile != "" {
+		if state, err = loadBatchState(cfg.BatchStateFile); err != nil {
+			return nil, err
+		}
+	}
+	var results []EnrollResult
+	var errs []error
+	for _, csrFile := range csrFiles {
+		if state != nil && state.done[filepath.Base(csrFile)] && alreadyIssued(csrFile) {
+			fmt.Printf("Skipping %s, already enrolled.\n", csrFile)
+			continue
+		}
+		result, err := enrollCSRFile(csrFile, cfg)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", csrFile, err))
+			continue
+		}
+		results = append(results, result)
+		if state != nil {
+			if err := state.record(csrFile); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", csrFile, err))
+			}
+		}
+	}
+	return results, errors.Join(errs...)
+}
+
+// batchState is the progress of EnrollFromDir, kept in a file listing the
+// names of the CSR files enrolled, one per line. Lines are only ever
+// appended, so a crash loses at most the line being written.
+type batchState struct {
+	path string
+	done map[string]bool
+}
+
+// loadBatchState reads the state file at path, missing until the first
+// CSR is enrolled.
+func loadBatchState(path string) (*batchState, error) {
+	state := &batchState{path: path, done: map[string]bool{}}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			state.done[line] = true
+		}
+	}
+	return state, nil
+}
+
+// record appends csrFile to the state file and syncs it.
+func (s *batchState) record(csrFile string) error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, defaultCertMode)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(filepath.Base(csrFile) + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	s.done[filepath.Base(csrFile)] = true
+	return f.Close()
+}
+
+// alreadyIssued reports whether the certificate written for csrFile is
+// present, unexpired and certifies the key and subject of the request.
+func alreadyIssued(csrFile string) bool {
+	csr, err := loadCSR(csrFile)
+	if err != nil {
+		return false
+	}
+	cert, err := loadCertificate(strings.TrimSuffix(csrFile, filepath.Ext(csrFile)) + ".crt")
+	if err != nil {
+		return false
+	}
+	return time.Now().Before(cert.NotAfter) && cert.Subject.CommonName == csr.Subject.CommonName &&
+		checkKeyMatch(cert, csr.PublicKey) == nil
+}
+
+// enrollCSRFile submits the CSR stored in csrFile and writes the issued
+// certificate and root beside it.
+func enrollCSRFile(csrFile string, cfg Config) (result EnrollResult, err error) {
+	defer func() { result, err = cfg.finish(result, err) }()
+	csr, err := loadCSR(csrFile)
+	if err != nil {
+		return EnrollResult{}, err
+	}
+	result, err = exchange(context.Background(), csr.Raw, nil, cfg.PKI, cfg)
+	if err != nil {
+		return EnrollResult{}, err
+	}
+	if err := checkKeyMatch(result.Certificate, csr.PublicKey); err != nil {
+		return EnrollResult{}, err
+	}
+	if err := checkChainOrder(result.ServerChain()); err != nil {
+		return EnrollResult{}, err
+	}
+	base := strings.TrimSuffix(csrFile, filepath.Ext(csrFile))
+	result.CertFile, result.CAFile = base+".crt", base+".ca.crt"
+	if err := writePEMFile(result.CertFile, cfg.certMode(), result.ServerChain()...); err != nil {
+		return EnrollResult{}, err
+	}
+	if err := writePEMFile(result.CAFile, cfg.certMode(), result.CA); err != nil {
+		return EnrollResult{}, err
+	}
+	return result, nil
+}
+
+// loadCSR reads a PEM encoded CSR and checks its signature, returning the
+// parsed request.
+func loadCSR(csrFile string) (*x509.CertificateRequest, error) {
+	data, err := os.ReadFile(csrFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || (block.Type != "CERTIFICATE REQUEST" && block.Type != "NEW CERTIFICATE REQUEST") {
+		return nil, fmt.Errorf("ezb_lib/certmanager: no certificate request found in %s", csrFile)
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, err
+	}
+	return csr, nil
+}
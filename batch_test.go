@@ -0,0 +1,109 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeCSR(t *testing.T, path, commonName string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := createCSR(newCertificateRequest(commonName, 1, nil), key, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEnrollFromDir(t *testing.T) {
+	pki := newFakePKI(t)
+	dir := t.TempDir()
+	writeCSR(t, filepath.Join(dir, "web.csr"), "web")
+	writeCSR(t, filepath.Join(dir, "db.csr"), "db")
+
+	results, err := EnrollFromDir(dir, Config{PKI: pki.addr()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("%d results, want 2", len(results))
+	}
+	for _, name := range []string{"web.crt", "web.ca.crt", "db.crt", "db.ca.crt"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestEnrollFromDirKeyMismatch(t *testing.T) {
+	pki := newFakePKI(t)
+	pki.wrongKey = true
+	dir := t.TempDir()
+	writeCSR(t, filepath.Join(dir, "web.csr"), "web")
+
+	results, err := EnrollFromDir(dir, Config{PKI: pki.addr()})
+	if !errors.Is(err, ErrKeyMismatch) || len(results) != 0 {
+		t.Fatalf("EnrollFromDir = %d results, %v; want ErrKeyMismatch", len(results), err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "web.crt")); !os.IsNotExist(err) {
+		t.Errorf("certificate for another key was written: %v", err)
+	}
+}
+
+func TestEnrollFromDirResume(t *testing.T) {
+	pki := newFakePKI(t)
+	dir := t.TempDir()
+	writeCSR(t, filepath.Join(dir, "web.csr"), "web")
+	cfg := Config{PKI: pki.addr(), BatchStateFile: filepath.Join(t.TempDir(), "state")}
+	if results, err := EnrollFromDir(dir, cfg); err != nil || len(results) != 1 {
+		t.Fatalf("first run = %d results, %v", len(results), err)
+	}
+	before := readFiles(t, filepath.Join(dir, "web.crt"))
+
+	writeCSR(t, filepath.Join(dir, "db.csr"), "db")
+	results, err := EnrollFromDir(dir, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Certificate.Subject.CommonName != "db" {
+		t.Fatalf("rerun enrolled %d certificates, want db alone", len(results))
+	}
+	if after := readFiles(t, filepath.Join(dir, "web.crt")); !bytes.Equal(before[0], after[0]) {
+		t.Error("web.crt enrolled again")
+	}
+
+	// A recorded CSR whose certificate is gone is enrolled again.
+	if err := os.Remove(filepath.Join(dir, "web.crt")); err != nil {
+		t.Fatal(err)
+	}
+	if results, err := EnrollFromDir(dir, cfg); err != nil || len(results) != 1 {
+		t.Fatalf("run without web.crt = %d results, %v", len(results), err)
+	}
+}
@@ -0,0 +1,80 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"bufio"
+	"crypto/x509"
+	"fmt"
+)
+
+// bootstrapContext prefixes the CSR payload signed by the bootstrap key,
+// so that signature can't be replayed as a proof of possession.
+const bootstrapContext = "ezb_lib/certmanager bootstrap\x00"
+
+// checkBootstrap returns an error when only one of Config.BootstrapKey and
+// Config.BootstrapCert is set, or when they don't match.
+func (cfg Config) checkBootstrap() error {
+	switch {
+	case cfg.BootstrapKey == nil && cfg.BootstrapCert == nil:
+		return nil
+	case cfg.BootstrapKey == nil || cfg.BootstrapCert == nil:
+		return fmt.Errorf("ezb_lib/certmanager: BootstrapKey and BootstrapCert must be set together")
+	}
+	if err := checkKeyMatch(cfg.BootstrapCert, cfg.BootstrapKey.Public()); err != nil {
+		return fmt.Errorf("bootstrap certificate: %w", err)
+	}
+	return nil
+}
+
+// sendBootstrap sends, from ProtocolV8 on, the bootstrap certificate frame
+// and the frame holding the signature of the CSR payload by the bootstrap
+// key, both empty unless Config.BootstrapKey is set.
+func sendBootstrap(writer *bufio.Writer, frames frameCodec, derBytes []byte, cfg Config) error {
+	var cert, signature []byte
+	if cfg.BootstrapKey != nil {
+		var err error
+		signature, err = signContext(cfg.BootstrapKey, bootstrapContext, frames.encodeCSR(derBytes))
+		if err != nil {
+			return fmt.Errorf("failed to sign with the bootstrap key: %w", err)
+		}
+		cert = frames.encodeCertificate(cfg.BootstrapCert.Raw)
+	}
+	if err := frames.writeFrame(writer, cert); err != nil {
+		return err
+	}
+	if err := frames.writeFrame(writer, signature); err != nil {
+		return err
+	}
+	return flushFrames(writer)
+}
+
+// VerifyBootstrapSignature checks, on the PKI side of ProtocolV8, that
+// signature was made over the CSR frame payload csr by the key of the
+// bootstrap certificate, in the scheme of VerifyProofOfPossession with
+// another context string. Authenticating bootstrap itself, e.g. against a
+// factory CA, is left to the PKI. It returns ErrBootstrapSignature when
+// the signature doesn't verify.
+func VerifyBootstrapSignature(bootstrap *x509.Certificate, csr, signature []byte) error {
+	ok, err := verifyContext(bootstrap.PublicKey, bootstrapContext, csr, signature)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBootstrapSignature, err)
+	}
+	if !ok {
+		return ErrBootstrapSignature
+	}
+	return nil
+}
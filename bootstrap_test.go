@@ -0,0 +1,77 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestBootstrapSignature(t *testing.T) {
+	cert, key := newFakeCA(t, "factory", nil, nil)
+	csr := []byte("certificate request")
+	signature, err := signContext(key, bootstrapContext, csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyBootstrapSignature(cert, csr, signature); err != nil {
+		t.Error(err)
+	}
+	if err := VerifyBootstrapSignature(cert, []byte("another request"), signature); !errors.Is(err, ErrBootstrapSignature) {
+		t.Errorf("another request: %v, want ErrBootstrapSignature", err)
+	}
+	proof, err := signContext(key, challengeContext, csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyBootstrapSignature(cert, csr, proof); !errors.Is(err, ErrBootstrapSignature) {
+		t.Errorf("proof of possession replayed: %v, want ErrBootstrapSignature", err)
+	}
+}
+
+func TestBootstrapEnrollment(t *testing.T) {
+	pki := newFakePKI(t)
+	pki.negotiate, pki.version, pki.bootstrap = true, ProtocolV8, true
+	cert, key := newFakeCA(t, "factory", nil, nil)
+	other := mustGenerateKey(t, KeyECDSAP256)
+	for _, tc := range []struct {
+		name string
+		cfg  Config
+		ok   bool
+	}{
+		{"bootstrap", Config{BootstrapKey: key, BootstrapCert: cert}, true},
+		{"PEM bootstrap", Config{BootstrapKey: key, BootstrapCert: cert, PEMPayloads: true}, true},
+		{"no bootstrap", Config{ProtocolVersion: ProtocolV8}, false},
+		{"key alone", Config{BootstrapKey: key}, false},
+		{"mismatch", Config{BootstrapKey: other, BootstrapCert: cert}, false},
+	} {
+		pki.pem = tc.cfg.PEMPayloads
+		_, err := EnrollSigner(newCertificateRequest("node", 1, nil), pki.addr(), tc.cfg)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+	}
+	if _, err := EnrollPipelined(context.Background(), nil, pki.addr(), Config{BootstrapKey: key, BootstrapCert: cert}); !errors.Is(err, ErrProtocolVersion) {
+		t.Errorf("pipelined with a bootstrap key: %v, want ErrProtocolVersion", err)
+	}
+
+	old := newFakePKI(t)
+	old.negotiate, old.version = true, ProtocolV7
+	if _, err := EnrollSigner(newCertificateRequest("node", 1, nil), old.addr(), Config{BootstrapKey: key, BootstrapCert: cert}); !errors.Is(err, ErrProtocolVersion) {
+		t.Errorf("bootstrap with ProtocolV7: %v, want ErrProtocolVersion", err)
+	}
+}
@@ -0,0 +1,68 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// FetchCATime asks ezbpki for its current time, which needs a PKI
+// speaking ProtocolV9, e.g. to detect a skewed local clock. See
+// Config.UseCATime. Cancelling ctx closes the connection, aborting the
+// query with ctxError(ctx).
+func FetchCATime(ctx context.Context, ezbpki string, cfg Config) (now time.Time, err error) {
+	cfg.ProtocolVersion = max(cfg.ProtocolVersion, ProtocolV9)
+	conn, frames, err := dial(ctx, ezbpki, cfg)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			err = ctxError(ctx)
+		}
+	}()
+	if frames.version < ProtocolV9 {
+		return time.Time{}, fmt.Errorf("%w: fetching the time needs version %d, PKI speaks %d", ErrProtocolVersion, ProtocolV9, frames.version)
+	}
+	timeouts := cfg.Timeouts
+	if err := timeouts.begin(conn, PhaseSend, time.Now()); err != nil {
+		return time.Time{}, err
+	}
+	writer := cfg.writer(conn)
+	if err := frames.writeFrame(writer, []byte{opFetchTime}); err != nil {
+		return time.Time{}, timeouts.check(PhaseSend, err)
+	}
+	if err := flushFrames(writer); err != nil {
+		return time.Time{}, timeouts.check(PhaseSend, err)
+	}
+	if err := timeouts.begin(conn, PhaseReceiveCert, time.Now()); err != nil {
+		return time.Time{}, err
+	}
+	data, err := frames.readResponse(cfg.reader(conn), "awaiting CA time")
+	if err != nil {
+		return time.Time{}, timeouts.check(PhaseReceiveCert, err)
+	}
+	if len(data) != 8 {
+		return time.Time{}, fmt.Errorf("ezb_lib/certmanager: malformed CA time of %d bytes", len(data))
+	}
+	return time.Unix(0, int64(binary.LittleEndian.Uint64(data))), nil
+}
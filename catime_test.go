@@ -0,0 +1,62 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestUseCATime(t *testing.T) {
+	pki := newFakePKI(t)
+	result, err := GenerateInDir(newCertificateRequest("node", 1, nil), pki.addr(), t.TempDir(), "node", Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ahead := newFakePKI(t)
+	ahead.negotiate, ahead.version, ahead.skew = true, ProtocolV9, 2*time.Hour
+	now, err := FetchCATime(context.Background(), ahead.addr(), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := now.Sub(time.Now().Add(ahead.skew)); d.Abs() > time.Minute {
+		t.Errorf("CA time off by %v", d)
+	}
+	old := newFakePKI(t)
+	old.negotiate, old.version = true, ProtocolV8
+	if _, err := FetchCATime(context.Background(), old.addr(), Config{}); !errors.Is(err, ErrProtocolVersion) {
+		t.Errorf("time query with ProtocolV8: %v, want ErrProtocolVersion", err)
+	}
+
+	// The certificate expires in an hour, already past on the CA clock.
+	for _, tc := range []struct {
+		name string
+		cfg  Config
+		want bool
+	}{
+		{"local clock", Config{PKI: ahead.addr()}, false},
+		{"CA clock", Config{PKI: ahead.addr(), UseCATime: true}, true},
+		{"fallback", Config{PKI: old.addr(), UseCATime: true}, false},
+	} {
+		tc.cfg.CertFile = result.CertFile
+		renew, err := NeedsRenewal(context.Background(), tc.cfg, 30*time.Minute)
+		if err != nil || renew != tc.want {
+			t.Errorf("%s: renew %v, %v", tc.name, renew, err)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// CertInfo is a flat view of the certificate details callers usually need.
+type CertInfo struct {
+	CommonName   string
+	Organization []string
+	// SANs lists the DNS names, IP addresses, email addresses and URIs.
+	SANs []string
+	// Serial is the serial number in hexadecimal.
+	Serial    string
+	NotBefore time.Time
+	NotAfter  time.Time
+	// Issuer is the issuer distinguished name.
+	Issuer string
+	// SHA256Fingerprint is the hex encoded SHA-256 of the DER certificate.
+	SHA256Fingerprint string
+	// KeyAlgorithm describes the public key, e.g. "ECDSA-P256" or "RSA-2048".
+	KeyAlgorithm string
+}
+
+// NewCertInfo extracts the CertInfo of cert.
+func NewCertInfo(cert *x509.Certificate) CertInfo {
+	info := CertInfo{
+		CommonName:        cert.Subject.CommonName,
+		Organization:      cert.Subject.Organization,
+		Serial:            cert.SerialNumber.Text(16),
+		NotBefore:         cert.NotBefore,
+		NotAfter:          cert.NotAfter,
+		Issuer:            cert.Issuer.String(),
+		SHA256Fingerprint: fingerprint(cert),
+		KeyAlgorithm:      publicKeyAlgorithm(cert.PublicKey),
+	}
+	info.SANs = sanStrings(cert.DNSNames, cert.IPAddresses, cert.EmailAddresses, cert.URIs)
+	return info
+}
+
+// sanStrings flattens SANs to strings: DNS names, IP addresses, email
+// addresses, then URIs.
+func sanStrings(dnsNames []string, ips []net.IP, emails []string, uris []*url.URL) []string {
+	var sans []string
+	sans = append(sans, dnsNames...)
+	for _, ip := range ips {
+		sans = append(sans, ip.String())
+	}
+	sans = append(sans, emails...)
+	for _, uri := range uris {
+		sans = append(sans, uri.String())
+	}
+	return sans
+}
+
+// CSRInfo is the counterpart of CertInfo for a certificate request, e.g.
+// for a signer displaying or validating what is requested before issuing.
+type CSRInfo struct {
+	CommonName   string
+	Organization []string
+	// Subject is the subject distinguished name.
+	Subject string
+	// SANs lists the DNS names, IP addresses, email addresses and URIs.
+	SANs []string
+	// KeyAlgorithm describes the public key, e.g. "ECDSA-P256" or "RSA-2048".
+	KeyAlgorithm string
+}
+
+// NewCSRInfo extracts the CSRInfo of csr.
+func NewCSRInfo(csr *x509.CertificateRequest) CSRInfo {
+	cn, org := CSRSubject(csr)
+	return CSRInfo{
+		CommonName:   cn,
+		Organization: org,
+		Subject:      csr.Subject.String(),
+		SANs:         sanStrings(csr.DNSNames, csr.IPAddresses, csr.EmailAddresses, csr.URIs),
+		KeyAlgorithm: publicKeyAlgorithm(csr.PublicKey),
+	}
+}
+
+// CSRSubject returns the CommonName and Organization requested by csr.
+func CSRSubject(csr *x509.CertificateRequest) (cn string, org []string) {
+	return csr.Subject.CommonName, csr.Subject.Organization
+}
+
+// LoadCertInfo returns the CertInfo of the certificate stored in certFile.
+func LoadCertInfo(certFile string) (CertInfo, error) {
+	cert, err := loadCertificate(certFile)
+	if err != nil {
+		return CertInfo{}, err
+	}
+	return NewCertInfo(cert), nil
+}
+
+// fingerprint returns the hex encoded SHA-256 of the DER certificate.
+func fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// publicKeyAlgorithm names the algorithm and size of pub.
+func publicKeyAlgorithm(pub any) string {
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		return "ECDSA-" + strings.ReplaceAll(k.Curve.Params().Name, "-", "")
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA-%d", k.N.BitLen())
+	case ed25519.PublicKey:
+		return "Ed25519"
+	}
+	return fmt.Sprintf("unknown (%T)", pub)
+}
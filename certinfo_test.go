@@ -0,0 +1,69 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto/x509"
+	"net/url"
+	"slices"
+	"testing"
+)
+
+func TestNewCSRInfo(t *testing.T) {
+	request := newCertificateRequest("node", 1, []string{"node.example.com", "10.0.0.1"})
+	request.EmailAddresses = []string{"ops@example.com"}
+	request.URIs = []*url.URL{{Scheme: "spiffe", Host: "example.com", Path: "/node"}}
+	der, err := createCSR(request, mustGenerateKey(t, KeyRSA2048), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cn, org := CSRSubject(csr); cn != "node" || !slices.Equal(org, []string{"ezBastion"}) {
+		t.Errorf("CSRSubject = %q, %q", cn, org)
+	}
+	info := NewCSRInfo(csr)
+	want := []string{"node.example.com", "10.0.0.1", "ops@example.com", "spiffe://example.com/node"}
+	if info.Subject != "CN=node,O=ezBastion" || !slices.Equal(info.SANs, want) || info.KeyAlgorithm != "RSA-2048" {
+		t.Errorf("NewCSRInfo = %+v, want SANs %q", info, want)
+	}
+}
+
+func TestNewCertInfo(t *testing.T) {
+	pki := newFakePKI(t)
+	dir := t.TempDir()
+	result, err := GenerateInDir(newCertificateRequest("node", 1, []string{"node.example.com", "10.0.0.1"}), pki.addr(), dir, "node", Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := result.Certificate
+	info := NewCertInfo(cert)
+	if info.CommonName != "node" || !slices.Equal(info.Organization, []string{"ezBastion"}) ||
+		!slices.Equal(info.SANs, []string{"node.example.com", "10.0.0.1"}) || info.Serial != cert.SerialNumber.Text(16) ||
+		!info.NotBefore.Equal(cert.NotBefore) || !info.NotAfter.Equal(cert.NotAfter) || info.Issuer != "CN=fake root" ||
+		info.SHA256Fingerprint != fingerprint(cert) || info.KeyAlgorithm != "ECDSA-P256" {
+		t.Errorf("NewCertInfo = %+v", info)
+	}
+	if result.Info.SHA256Fingerprint != info.SHA256Fingerprint {
+		t.Errorf("EnrollResult.Info = %+v, want %+v", result.Info, info)
+	}
+	loaded, err := LoadCertInfo(result.CertFile)
+	if err != nil || loaded.SHA256Fingerprint != info.SHA256Fingerprint {
+		t.Errorf("LoadCertInfo = %+v, %v", loaded, err)
+	}
+}
@@ -17,18 +17,60 @@ package certmanager
 
 import (
 	"bufio"
-	"crypto/ecdsa"
-	"crypto/elliptic"
+	"bytes"
+	"context"
+	"crypto"
 	"crypto/rand"
 	"crypto/x509"
 	"crypto/x509/pkix"
-	"encoding/binary"
-	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"net/url"
 	"os"
+	"slices"
+	"time"
 )
 
+// TransferStats reports the size of each frame exchanged with the PKI and
+// how long the exchange took.
+type TransferStats struct {
+	CSRBytes      int
+	CertBytes     int
+	RootCertBytes int
+	// SigningLatency is the time from the CSR being sent to the first byte
+	// of the answer, mostly spent by the CA signing.
+	SigningLatency time.Duration
+	// RoundTrip is the time from the start of the CSR transmission to the
+	// last certificate received.
+	RoundTrip time.Duration
+}
+
+// warnNearLimit prints a warning for every frame above 90% of limit, before
+// growing certificates start to be refused.
+func (s TransferStats) warnNearLimit(limit int) {
+	frames := []struct {
+		name string
+		size int
+	}{
+		{"CSR", s.CSRBytes},
+		{"certificate", s.CertBytes},
+		{"root certificate", s.RootCertBytes},
+	}
+	for _, f := range frames {
+		if f.size > limit*9/10 {
+			fmt.Printf("Warning: %s frame is %d bytes, close to the %d bytes frame limit.\n", f.name, f.size, limit)
+		}
+	}
+}
+
+// newCertificateRequest builds the CSR template for commonName and
+// addresses. The template is deterministic: SANs are sorted and deduplicated
+// so the same inputs, in any order, always encode to the same request info,
+// followed by the extensions and attributes in the order they were given.
+// Only the key and the ECDSA signature, which uses a random nonce, differ
+// from one CSR to the next.
 func newCertificateRequest(commonName string, duration int, addresses []string) *x509.CertificateRequest {
 	certificate := x509.CertificateRequest{
 		Subject: pkix.Name{
@@ -45,136 +87,792 @@ func newCertificateRequest(commonName string, duration int, addresses []string)
 			certificate.DNSNames = append(certificate.DNSNames, addresses[i])
 		}
 	}
+	slices.Sort(certificate.DNSNames)
+	certificate.DNSNames = slices.Compact(certificate.DNSNames)
+	slices.SortFunc(certificate.IPAddresses, func(a, b net.IP) int { return bytes.Compare(a, b) })
+	certificate.IPAddresses = slices.CompactFunc(certificate.IPAddresses, net.IP.Equal)
 
 	return &certificate
 }
 
-func generate(certificate *x509.CertificateRequest, ezbpki, certFilename, keyFilename, caFileName string) {
-	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-	if err != nil {
-		fmt.Println("Failed to generate private key:", err)
-		os.Exit(1)
+// NewHostCertificateRequest builds a CSR template like newCertificateRequest,
+// defaulting an empty commonName to the host name, which is then also
+// added to the DNS SANs. It fails if the host name can't be determined.
+func NewHostCertificateRequest(commonName string, duration int, addresses []string) (*x509.CertificateRequest, error) {
+	if commonName == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("ezb_lib/certmanager: no CommonName given and no host name: %w", err)
+		}
+		if hostname == "" {
+			return nil, fmt.Errorf("ezb_lib/certmanager: no CommonName given and the host name is empty")
+		}
+		commonName = hostname
+		addresses = append([]string{hostname}, addresses...)
 	}
+	return newCertificateRequest(commonName, duration, addresses), nil
+}
 
-	derBytes, err := x509.CreateCertificateRequest(rand.Reader, certificate, priv)
+// enroll generates a key, has the PKI sign a CSR for it and checks the
+// issued certificate against the returned root. It returns the key with the
+// parsed certificates in an EnrollResult. Each step is a phase function
+// below, so they can be exercised on their own.
+func enroll(ctx context.Context, certificate *x509.CertificateRequest, ezbpki string, cfg Config) (_ crypto.Signer, _ EnrollResult, err error) {
+	ctx, span := cfg.startSpan(ctx, "enroll")
+	span.SetAttribute(AttrSubject, certificate.Subject.CommonName)
+	span.SetAttribute(AttrEndpoint, ezbpki)
+	defer func() { endSpan(span, err) }()
+	priv, err := cfg.signer()
+	if err != nil {
+		return nil, EnrollResult{}, err
+	}
+	derBytes, err := createCSR(certificate, priv, cfg)
 	if err != nil {
-		return
+		return nil, EnrollResult{}, err
 	}
 	fmt.Println("Created Certificate Signing Request for client.")
-	conn, err := net.Dial("tcp", ezbpki)
+	result, err := exchange(ctx, derBytes, priv, ezbpki, cfg)
 	if err != nil {
-		return
+		return nil, EnrollResult{}, err
+	}
+	if err := checkKeyMatch(result.Certificate, priv.Public()); err != nil {
+		return nil, EnrollResult{}, err
+	}
+	if cfg.Key == nil && cfg.KeyStore != nil {
+		result.KeyLabel = cfg.KeyLabel
+	}
+	return priv, result, nil
+}
+
+// signer returns cfg.Key, or a fresh key of cfg.TargetKeyType when unset,
+// generated in cfg.KeyStore when set.
+func (cfg Config) signer() (crypto.Signer, error) {
+	if cfg.Key != nil {
+		return cfg.Key, nil
+	}
+	if cfg.KeyStore != nil {
+		return cfg.generateInStore()
+	}
+	priv, err := generateKey(cfg.TargetKeyType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate private key: %w", err)
+	}
+	return priv, nil
+}
+
+// externalKey reports whether the key comes from outside the package,
+// Config.Key or Config.KeyStore, so a key output may be omitted.
+func (cfg Config) externalKey() bool {
+	return cfg.Key != nil || cfg.KeyStore != nil
+}
+
+// exchange submits the DER encoded CSR to the PKI and returns the issued
+// certificate once validated against the returned root. priv, the key of
+// the CSR, answers the ProtocolV5 challenge; it is nil when only the CSR
+// is at hand. Cancelling ctx closes the connection, aborting the exchange
+// with ctxError(ctx).
+func exchange(ctx context.Context, derBytes []byte, priv crypto.Signer, ezbpki string, cfg Config) (result EnrollResult, err error) {
+	phases := &phaseSpans{ctx: ctx, cfg: cfg}
+	defer func() { phases.end(err) }()
+	requestID := cfg.RequestID
+	defer func() {
+		if err != nil && requestID != "" {
+			err = fmt.Errorf("request %s: %w", requestID, err)
+		}
+	}()
+	phases.begin(PhaseDial)
+	if cfg.Profile != "" {
+		cfg.ProtocolVersion = max(cfg.ProtocolVersion, ProtocolV4)
+	}
+	if cfg.RequestID != "" {
+		cfg.ProtocolVersion = max(cfg.ProtocolVersion, ProtocolV7)
+	}
+	if err := cfg.checkBootstrap(); err != nil {
+		return EnrollResult{}, err
+	}
+	if cfg.BootstrapKey != nil {
+		cfg.ProtocolVersion = max(cfg.ProtocolVersion, ProtocolV8)
+	}
+	conn, frames, err := dial(ctx, ezbpki, cfg)
+	if err != nil {
+		return EnrollResult{}, err
 	}
 	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			err = ctxError(ctx)
+		}
+	}()
+	if cfg.Profile != "" && frames.version < ProtocolV4 {
+		return EnrollResult{}, fmt.Errorf("%w: certificate profiles need version %d, PKI speaks %d", ErrProtocolVersion, ProtocolV4, frames.version)
+	}
+	if cfg.RequestID != "" && frames.version < ProtocolV7 {
+		return EnrollResult{}, fmt.Errorf("%w: request IDs need version %d, PKI speaks %d", ErrProtocolVersion, ProtocolV7, frames.version)
+	}
+	if cfg.BootstrapKey != nil && frames.version < ProtocolV8 {
+		return EnrollResult{}, fmt.Errorf("%w: bootstrap authentication needs version %d, PKI speaks %d", ErrProtocolVersion, ProtocolV8, frames.version)
+	}
+	if priv == nil && frames.version >= ProtocolV5 {
+		return EnrollResult{}, fmt.Errorf("%w: version %d needs the private key for proof of possession", ErrProtocolVersion, frames.version)
+	}
 	fmt.Println("Successfully connected to Root Certificate Authority.")
-	writer := bufio.NewWriter(conn)
-	// Send two-byte header containing the number of ASN1 bytes transmitted.
-	header := make([]byte, 2)
-	binary.LittleEndian.PutUint16(header, uint16(len(derBytes)))
-	_, err = writer.Write(header)
+	timeouts := cfg.Timeouts
+	phases.begin(PhaseSend)
+	sendStart := time.Now()
+	if err := timeouts.begin(conn, PhaseSend, sendStart); err != nil {
+		return EnrollResult{}, err
+	}
+	writer, reader := cfg.writer(conn), cfg.reader(conn)
+	if err := sendCSR(writer, frames, derBytes, cfg.Profile, cfg.RequestID); err != nil {
+		return EnrollResult{}, timeouts.check(PhaseSend, err)
+	}
+	if frames.version >= ProtocolV8 {
+		if err := sendBootstrap(writer, frames, derBytes, cfg); err != nil {
+			return EnrollResult{}, timeouts.check(PhaseSend, err)
+		}
+	}
+	if frames.version >= ProtocolV5 {
+		if err := answerChallenge(reader, writer, frames, priv); err != nil {
+			return EnrollResult{}, timeouts.check(PhaseSend, err)
+		}
+	}
+	sent := time.Now()
+	fmt.Printf("Transmitted Certificate Signing Request to RootCA (%d bytes).\n", len(derBytes))
+	// The RootCA will now send our signed certificate back for us to read.
+	var newCert, rootCert *x509.Certificate
+	var intermediates []*x509.Certificate
+	phases.begin(PhaseReceiveCert)
+	if err := timeouts.begin(conn, PhaseReceiveCert, time.Now()); err != nil {
+		return EnrollResult{}, err
+	}
+	// Wait for the first byte alone to tell signing from transfer time; a
+	// failure here is reported by the frame read below.
+	var signingLatency time.Duration
+	if _, err := reader.Peek(1); err == nil {
+		signingLatency = time.Since(sent)
+	}
+	if frames.version >= ProtocolV7 {
+		id, err := frames.readResponse(reader, "awaiting request ID")
+		if err != nil {
+			return EnrollResult{}, timeouts.check(PhaseReceiveCert, err)
+		}
+		requestID = string(id)
+	}
+	if frames.version >= ProtocolV1 {
+		newCert, intermediates, rootCert, err = recvBundle(reader, frames)
+		if err != nil {
+			return EnrollResult{}, timeouts.check(PhaseReceiveCert, err)
+		}
+		fmt.Printf("Received certificate bundle from RootCA (%d certificates).\n", len(intermediates)+2)
+	} else {
+		newCert, err = recvCert(reader, frames)
+		if err != nil {
+			return EnrollResult{}, timeouts.check(PhaseReceiveCert, err)
+		}
+		fmt.Printf("Received new Certificate from RootCA (%d bytes).\n", len(newCert.Raw))
+		// Finally, the RootCA will send its own certificate back so that we can validate the new certificate.
+		phases.begin(PhaseReceiveRoot)
+		rootCert, err = receiveRoot(conn, reader, frames, cfg)
+		if err != nil {
+			return EnrollResult{}, err
+		}
+	}
+	stats := TransferStats{
+		CSRBytes:       len(derBytes),
+		CertBytes:      len(newCert.Raw),
+		SigningLatency: signingLatency,
+		RoundTrip:      time.Since(sendStart),
+	}
+	if !cfg.SkipRootFrame || frames.version >= ProtocolV1 {
+		stats.RootCertBytes = len(rootCert.Raw)
+	}
+	phases.begin(PhaseVerify)
+	result, err = acceptIssued(derBytes, newCert, intermediates, rootCert, stats, frames, cfg)
 	if err != nil {
-		return
+		return EnrollResult{}, err
+	}
+	result.RequestID = requestID
+	return result, nil
+}
+
+// acceptIssued reports the transfer stats of an answer from the PKI to the
+// DER CSR csrDER, then orders and validates the issued certificate against
+// the root and intermediates, returning them as an EnrollResult.
+func acceptIssued(csrDER []byte, newCert *x509.Certificate, intermediates []*x509.Certificate, rootCert *x509.Certificate, stats TransferStats, frames frameCodec, cfg Config) (EnrollResult, error) {
+	for _, cert := range intermediates {
+		stats.CertBytes += len(cert.Raw)
+	}
+	stats.warnNearLimit(frames.max)
+	if cfg.OnTransfer != nil {
+		cfg.OnTransfer(stats)
 	}
-	// Now send the certificate request data
-	_, err = writer.Write(derBytes)
+
+	rootCert, err := cfg.trustedRoot(rootCert)
 	if err != nil {
-		return
+		return EnrollResult{}, err
 	}
-	err = writer.Flush()
+	intermediates, err = orderChain(newCert, intermediates, rootCert)
 	if err != nil {
-		return
+		return EnrollResult{}, err
 	}
-	fmt.Println("Transmitted Certificate Signing Request to RootCA.")
-	// The RootCA will now send our signed certificate back for us to read.
-	reader := bufio.NewReader(conn)
-	// Read header containing the size of the ASN1 data.
-	certHeader := make([]byte, 2)
-	_, err = reader.Read(certHeader)
+	err = validateCertificate(cfg, newCert, rootCert, intermediates)
+	if err != nil {
+		return EnrollResult{}, err
+	}
+	if cfg.MinSCTs > 0 {
+		issuer := rootCert
+		if len(intermediates) > 0 {
+			issuer = intermediates[0]
+		}
+		if err := checkSCTs(cfg, newCert, issuer); err != nil {
+			return EnrollResult{}, err
+		}
+	}
+	if cfg.RequireRequestedSANs {
+		if err := checkRequestedSANs(csrDER, newCert); err != nil {
+			return EnrollResult{}, err
+		}
+	}
+	warnShortenedValidity(newCert, cfg.RequestedValidity)
+	result := EnrollResult{Certificate: newCert, Info: NewCertInfo(newCert), Chain: intermediates, CA: rootCert, NotAfter: newCert.NotAfter, Stats: stats}
+	result.RenewalHint, _ = renewalHint(newCert, cfg.RenewalHintOID)
+	return result, nil
+}
+
+// createCSR signs the DER request for certificate with priv, adding the
+// extensions and attributes requested in cfg.
+func createCSR(certificate *x509.CertificateRequest, priv crypto.Signer, cfg Config) ([]byte, error) {
+	if err := checkKeySupported(priv.Public()); err != nil {
+		return nil, err
+	}
+	if cfg.KeyPolicy != nil {
+		if err := cfg.KeyPolicy.check(priv.Public()); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkWildcards(certificate.DNSNames, cfg.DenyWildcards); err != nil {
+		return nil, err
+	}
+	if !isP256(priv.Public()) && certificate.SignatureAlgorithm == x509.ECDSAWithSHA256 {
+		// The template default assumes P-256; let x509 pick the algorithm
+		// matching a caller supplied key.
+		request := *certificate
+		request.SignatureAlgorithm = x509.UnknownSignatureAlgorithm
+		certificate = &request
+	}
+	if cfg.SignatureAlgorithm != x509.UnknownSignatureAlgorithm {
+		if err := checkSignatureAlgorithm(priv.Public(), cfg.SignatureAlgorithm); err != nil {
+			return nil, err
+		}
+		request := *certificate
+		request.SignatureAlgorithm = cfg.SignatureAlgorithm
+		certificate = &request
+	}
+	if err := cfg.Subject.check(); err != nil {
+		return nil, err
+	}
+	if !cfg.Subject.empty() {
+		request := *certificate
+		cfg.Subject.apply(&request.Subject)
+		certificate = &request
+	}
+	if len(cfg.ExtraExtensions) > 0 {
+		request := *certificate
+		request.ExtraExtensions = append(append([]pkix.Extension(nil), certificate.ExtraExtensions...), cfg.ExtraExtensions...)
+		if err := checkDuplicateExtensions(request.ExtraExtensions); err != nil {
+			return nil, err
+		}
+		certificate = &request
+	}
+	var derBytes []byte
+	var err error
+	if hybrid, ok := priv.(*HybridKey); ok {
+		if cfg.ChallengePassword != "" {
+			// The attribute would land outside the alternative signature.
+			return nil, errors.New("ezb_lib/certmanager: ChallengePassword is not supported with a HybridKey")
+		}
+		derBytes, err = createHybridCSR(certificate, hybrid)
+	} else {
+		derBytes, err = x509.CreateCertificateRequest(rand.Reader, certificate, priv)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cfg.ChallengePassword != "" {
+		if derBytes, err = withChallengePassword(derBytes, priv, cfg.ChallengePassword); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkCSR(derBytes); err != nil {
+		return nil, err
+	}
+	return derBytes, nil
+}
+
+// checkCSR parses derBytes back and checks its signature, so a wrong
+// signer or corrupted encoding is caught before the round-trip to the CA.
+func checkCSR(derBytes []byte) error {
+	csr, err := x509.ParseCertificateRequest(derBytes)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBadCSR, err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return fmt.Errorf("%w: %v", ErrBadCSR, err)
+	}
+	return nil
+}
+
+// dial connects to the PKI, through cfg.Proxy when set and over TLS when
+// cfg.TLS is, negotiates the protocol version and runs the pre-shared key
+// handshake when one is configured, returning the frame codec to use on
+// the connection.
+func dial(ctx context.Context, ezbpki string, cfg Config) (net.Conn, frameCodec, error) {
+	frames := cfg.frames()
+	start := time.Now()
+	target := ezbpki
+	var proxy *url.URL
+	if cfg.Proxy != "" {
+		var err error
+		if proxy, err = parseProxy(cfg.Proxy); err != nil {
+			return nil, frames, err
+		}
+		target = proxy.Host
+	}
+	conn, err := cfg.dialContext(ctx, target)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, frames, ctxError(ctx)
+		}
+		return nil, frames, cfg.Timeouts.check(PhaseDial, err)
+	}
+	// Cancelling ctx interrupts the handshakes as well.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	session, err := handshake(conn, &frames, proxy, ezbpki, cfg, start)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, frames, ctxError(ctx)
+		}
+		return nil, frames, cfg.Timeouts.check(PhaseDial, err)
+	}
+	return session, frames, nil
+}
+
+// dialContext opens a TCP connection to addr with cfg.DialFunc, or a
+// net.Dialer when unset, within the dial phase timeout.
+func (cfg Config) dialContext(ctx context.Context, addr string) (net.Conn, error) {
+	if cfg.DialFunc == nil {
+		dialer := net.Dialer{Timeout: cfg.Timeouts.Dial}
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+	if cfg.Timeouts.Dial > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Timeouts.Dial)
+		defer cancel()
+	}
+	return cfg.DialFunc(ctx, "tcp", addr)
+}
+
+// handshake prepares a fresh connection within the dial phase deadline:
+// proxy tunnel to ezbpki, keepalive, TLS, protocol version and pre-shared
+// key. It returns the connection to speak the protocol on, conn itself
+// unless wrapped by TLS.
+func handshake(conn net.Conn, frames *frameCodec, proxy *url.URL, ezbpki string, cfg Config, start time.Time) (net.Conn, error) {
+	if err := cfg.Timeouts.begin(conn, PhaseDial, start); err != nil {
+		return nil, err
+	}
+	if err := setKeepAlive(conn, cfg.KeepAlive); err != nil {
+		return nil, err
+	}
+	if proxy != nil {
+		if err := connectProxy(conn, proxy, ezbpki); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	if cfg.TLS != nil {
+		if conn, err = startTLS(conn, ezbpki, cfg); err != nil {
+			return nil, err
+		}
+	}
+	frames.version, err = negotiateVersion(conn, cfg.ProtocolVersion)
 	if err != nil {
-		return
+		return nil, err
+	}
+	if len(cfg.PreSharedKey) > 0 {
+		if frames.psk, err = pskHandshake(conn, cfg.PreSharedKey); err != nil {
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// setKeepAlive enables TCP keepalive probes every period on conn, so
+// middleboxes don't drop it while the CA signs. A zero period keeps the
+// dialer defaults.
+func setKeepAlive(conn net.Conn, period time.Duration) error {
+	tcp, ok := conn.(*net.TCPConn)
+	if period <= 0 || !ok {
+		return nil
+	}
+	if err := tcp.SetKeepAlive(true); err != nil {
+		return err
+	}
+	return tcp.SetKeepAlivePeriod(period)
+}
+
+// sendCSR transmits the DER encoded request in a single frame, preceded by
+// the enrollment operation from ProtocolV2 on, by the profile frame when
+// profile is set, which needs ProtocolV4, and by the requestID frame from
+// ProtocolV7 on.
+func sendCSR(writer *bufio.Writer, frames frameCodec, derBytes []byte, profile, requestID string) error {
+	switch {
+	case profile != "":
+		if err := frames.writeFrame(writer, []byte{opEnrollProfile}); err != nil {
+			return err
+		}
+		if err := frames.writeFrame(writer, []byte(profile)); err != nil {
+			return err
+		}
+	case frames.version >= ProtocolV2:
+		if err := frames.writeFrame(writer, []byte{opEnroll}); err != nil {
+			return err
+		}
 	}
-	certSize := binary.LittleEndian.Uint16(certHeader)
-	// Now read the certificate data.
-	certBytes := make([]byte, certSize)
-	_, err = reader.Read(certBytes)
+	if frames.version >= ProtocolV7 {
+		if err := frames.writeFrame(writer, []byte(requestID)); err != nil {
+			return err
+		}
+	}
+	// Send the header containing the number of ASN1 bytes transmitted,
+	// then the certificate request data.
+	if err := frames.writeFrame(writer, frames.encodeCSR(derBytes)); err != nil {
+		return err
+	}
+	return flushFrames(writer)
+}
+
+// recvCert reads and parses the certificate issued by the PKI.
+func recvCert(r io.Reader, frames frameCodec) (*x509.Certificate, error) {
+	certBytes, err := frames.readResponse(r, "awaiting certificate")
 	if err != nil {
-		return
+		return nil, err
 	}
-	fmt.Println("Received new Certificate from RootCA.")
-	newCert, err := x509.ParseCertificate(certBytes)
+	return frames.parseCertificate(certBytes)
+}
+
+// recvRoot reads and parses the root certificate sent after the issued one.
+func recvRoot(r io.Reader, frames frameCodec) (*x509.Certificate, error) {
+	rootCertBytes, err := frames.readFrame(r, "awaiting root certificate")
 	if err != nil {
-		return
+		return nil, err
 	}
+	return frames.parseCertificate(rootCertBytes)
+}
 
-	// Finally, the RootCA will send its own certificate back so that we can validate the new certificate.
-	rootCertHeader := make([]byte, 2)
-	_, err = reader.Read(rootCertHeader)
+// receiveRoot reads the root certificate frame of the legacy protocol, or
+// loads cfg.RootCAFile instead when the CA doesn't send one.
+func receiveRoot(conn net.Conn, r io.Reader, frames frameCodec, cfg Config) (*x509.Certificate, error) {
+	if cfg.SkipRootFrame {
+		if cfg.RootCAFile == "" {
+			return nil, fmt.Errorf("ezb_lib/certmanager: SkipRootFrame requires a RootCAFile")
+		}
+		rootCert, err := loadCertificate(cfg.RootCAFile)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("Loaded Root Certificate from %s.\n", cfg.RootCAFile)
+		return rootCert, nil
+	}
+	if err := cfg.Timeouts.begin(conn, PhaseReceiveRoot, time.Now()); err != nil {
+		return nil, err
+	}
+	rootCert, err := recvRoot(r, frames)
 	if err != nil {
-		return
+		return nil, cfg.Timeouts.check(PhaseReceiveRoot, err)
 	}
-	rootCertSize := binary.LittleEndian.Uint16(rootCertHeader)
-	// Now read the certificate data.
-	rootCertBytes := make([]byte, rootCertSize)
-	_, err = reader.Read(rootCertBytes)
+	fmt.Printf("Received Root Certificate from RootCA (%d bytes).\n", len(rootCert.Raw))
+	return rootCert, nil
+}
+
+// recvBundle reads the single frame PEM bundle of ProtocolV1. The first
+// certificate is the issued one, the last CA certificate the root and any
+// other certificate an intermediate.
+func recvBundle(r io.Reader, frames frameCodec) (*x509.Certificate, []*x509.Certificate, *x509.Certificate, error) {
+	bundle, err := frames.readResponse(r, "awaiting certificate bundle")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	certs, err := parseBundle(bundle)
 	if err != nil {
-		return
+		return nil, nil, nil, err
+	}
+	rootIndex := -1
+	for i := len(certs) - 1; i > 0; i-- {
+		if certs[i].IsCA {
+			rootIndex = i
+			break
+		}
+	}
+	if rootIndex < 0 {
+		return nil, nil, nil, fmt.Errorf("%w: %d certificates, no CA", ErrIncompleteBundle, len(certs))
+	}
+	var intermediates []*x509.Certificate
+	for i, cert := range certs[1:] {
+		if i+1 != rootIndex {
+			intermediates = append(intermediates, cert)
+		}
+	}
+	return certs[0], intermediates, certs[rootIndex], nil
+}
+
+// generate enrolls certificate and writes the key, certificate and CA
+// files, all or none of them, see FileStore.
+func generate(certificate *x509.CertificateRequest, ezbpki, certFilename, keyFilename, caFileName string, cfg Config) (EnrollResult, error) {
+	return FileStore{CertFile: certFilename, KeyFile: keyFilename, CAFile: caFileName}.generate(certificate, ezbpki, cfg)
+}
+
+// stageArtifacts persists the artifacts of result to temporary files next
+// to the key, certificate and CA files, along with Config.ChainFile and
+// the metadata when enabled. It returns the temporary files and their
+// finals, for swapFiles; the caller removes the temporary files whatever
+// the outcome.
+func stageArtifacts(priv crypto.Signer, result EnrollResult, certFilename, keyFilename, caFileName string, cfg Config) (temps, finals []string, err error) {
+	finals = []string{keyFilename, certFilename, caFileName}
+	for _, final := range finals {
+		if final == "" {
+			// A key held by an HSM has no file.
+			temps = append(temps, "")
+			continue
+		}
+		name, err := tempPath(final)
+		if err != nil {
+			return temps, nil, err
+		}
+		temps = append(temps, name)
 	}
-	fmt.Println("Received Root Certificate from RootCA.")
-	rootCert, err := x509.ParseCertificate(rootCertBytes)
+	if err := persist(priv, result, temps[1], temps[0], temps[2], cfg); err != nil {
+		return temps, nil, err
+	}
+	if cfg.ChainFile != "" {
+		name, err := tempPath(cfg.ChainFile)
+		if err != nil {
+			return temps, nil, err
+		}
+		temps, finals = append(temps, name), append(finals, cfg.ChainFile)
+		if err := writePEMFile(name, cfg.certMode(), cfg.OutputFormat.chain(result)...); err != nil {
+			return temps, nil, err
+		}
+	}
+	metaTemp, err := stageMetadata(certFilename, result, cfg)
 	if err != nil {
-		return
+		return temps, nil, err
+	}
+	if metaTemp != "" {
+		temps = append(temps, metaTemp)
+		finals = append(finals, MetadataPath(certFilename))
 	}
+	return temps, finals, nil
+}
 
-	err = validateCertificate(newCert, rootCert)
+// GenerateInDir enrolls certificate and writes base.crt, base.key and
+// base.ca.crt in dir, which is created with 0700 permissions if needed. It
+// behaves as generate otherwise, see ArtifactPaths.
+func GenerateInDir(certificate *x509.CertificateRequest, ezbpki, dir, base string, cfg Config) (EnrollResult, error) {
+	certFilename, keyFilename, caFileName, err := ArtifactPaths(dir, base)
 	if err != nil {
-		return
+		return EnrollResult{}, err
+	}
+	return generate(certificate, ezbpki, certFilename, keyFilename, caFileName, cfg)
+}
+
+// persist writes the key, certificate and root certificate files. An empty
+// keyFilename skips the key, for caller supplied signers that can't be
+// exported.
+func persist(priv crypto.Signer, result EnrollResult, certFilename, keyFilename, caFileName string, cfg Config) error {
+	var keyOut *os.File
+	if keyFilename != "" {
+		var err error
+		keyOut, err = createFile(keyFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, cfg.keyMode())
+		if err != nil {
+			return fmt.Errorf("failed to open key %s for writing: %w", keyFilename, err)
+		}
+		defer keyOut.Close()
 	}
-	// all good save the files
-	keyOut, err := os.OpenFile(keyFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	certOut, err := createFile(certFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, cfg.certMode())
 	if err != nil {
-		fmt.Println("Failed to open key "+keyFilename+" for writing:", err)
-		os.Exit(1)
+		return fmt.Errorf("failed to open %s for writing: %w", certFilename, err)
 	}
-	b, err := x509.MarshalECPrivateKey(priv)
+	defer certOut.Close()
+	caOut, err := createFile(caFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, cfg.certMode())
 	if err != nil {
-		fmt.Println("Failed to marshal priv:", err)
-		os.Exit(1)
+		return fmt.Errorf("failed to open %s for writing: %w", caFileName, err)
+	}
+	defer caOut.Close()
+	var keyW io.Writer
+	if keyOut != nil {
+		keyW = keyOut
+	}
+	if err := writeArtifacts(certOut, keyW, caOut, priv, result, cfg.OutputFormat); err != nil {
+		return err
+	}
+	for _, f := range []*os.File{keyOut, certOut, caOut} {
+		if f == nil {
+			continue
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
 	}
-	pem.Encode(keyOut, &pem.Block{Type: "EC PRIVATE KEY", Bytes: b})
-	keyOut.Close()
+	return nil
+}
 
-	certOut, err := os.Create(certFilename)
+// GenerateToWriters enrolls like generate but streams the PEM encoded
+// certificate, private key and root certificate to certW, keyW and caW
+// instead of files, e.g. to feed a secret store. keyW may be nil, as
+// keyFilename may be empty for generate, when Config.Key can't be exported.
+// Having no chain file, it can't use FormatApache.
+func GenerateToWriters(certificate *x509.CertificateRequest, ezbpki string, certW, keyW, caW io.Writer, cfg Config) (result EnrollResult, err error) {
+	defer func() { result, err = cfg.finish(result, err) }()
+	if keyW == nil && !cfg.externalKey() {
+		return result, ErrNoKeyOutput
+	}
+	if err := cfg.OutputFormat.check(""); err != nil {
+		return result, err
+	}
+	var priv crypto.Signer
+	priv, result, err = enroll(context.Background(), certificate, ezbpki, cfg)
 	if err != nil {
-		fmt.Println("Failed to open "+certFilename+" for writing:", err)
-		os.Exit(1)
+		return result, err
+	}
+	if cfg.Key == nil {
+		defer WipeKey(priv)
 	}
-	pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: certBytes})
-	certOut.Close()
+	return result, writeArtifacts(certW, keyW, caW, priv, result, cfg.OutputFormat)
+}
 
-	caOut, err := os.Create(caFileName)
+// EnrollSigner enrolls like generate but never persists anything: the
+// private key is returned in EnrollResult.Key, to be used straight away
+// e.g. in a tls.Certificate. It suits ephemeral workloads where the key
+// should only ever live in memory; see WipeKey.
+func EnrollSigner(certificate *x509.CertificateRequest, ezbpki string, cfg Config) (result EnrollResult, err error) {
+	defer func() { result, err = cfg.finish(result, err) }()
+	var priv crypto.Signer
+	priv, result, err = enroll(context.Background(), certificate, ezbpki, cfg)
 	if err != nil {
-		fmt.Println("Failed to open "+caFileName+" for writing:", err)
-		os.Exit(1)
+		return result, err
 	}
-	pem.Encode(caOut, &pem.Block{Type: "CERTIFICATE", Bytes: rootCertBytes})
-	caOut.Close()
+	result.Key = priv
+	return result, nil
+}
 
+// writeArtifacts PEM encodes the key, certificate and root certificate. The
+// intermediates follow the certificate, so the chain can be presented to
+// peers and verified against the root alone, once checkChainOrder accepted
+// their order, unless format keeps the leaf alone. The key is skipped when
+// keyW is nil, and replaced by its KeyReference when held by a KeyStore.
+func writeArtifacts(certW, keyW, caW io.Writer, priv crypto.Signer, result EnrollResult, format OutputFormat) error {
+	if err := checkChainOrder(result.ServerChain()); err != nil {
+		return err
+	}
+	if keyW != nil && result.KeyLabel != "" {
+		if _, err := io.WriteString(keyW, KeyReference(result.KeyLabel)+"\n"); err != nil {
+			return err
+		}
+	} else if keyW != nil {
+		if err := encodePrivateKey(keyW, priv); err != nil {
+			return err
+		}
+	}
+	if err := writeCertificates(certW, format.certificates(result)...); err != nil {
+		return err
+	}
+	return writeCertificates(caW, result.CA)
 }
 
-func validateCertificate(newCert *x509.Certificate, rootCert *x509.Certificate) error {
-	roots := x509.NewCertPool()
-	roots.AddCert(rootCert)
+// buildVerifyOptions returns the options every verification of the package
+// uses: root, if any, as the trust anchor, the intermediates, and the key
+// usages and time of cfg, client authentication and now by default.
+func buildVerifyOptions(cfg Config, root *x509.Certificate, intermediates []*x509.Certificate) x509.VerifyOptions {
 	verifyOptions := x509.VerifyOptions{
-		Roots:     roots,
-		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		Roots:         x509.NewCertPool(),
+		Intermediates: x509.NewCertPool(),
+		CurrentTime:   cfg.VerifyAt,
+		KeyUsages:     cfg.ExtKeyUsages,
+	}
+	if len(verifyOptions.KeyUsages) == 0 {
+		verifyOptions.KeyUsages = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+	if root != nil {
+		verifyOptions.Roots.AddCert(root)
 	}
+	for _, cert := range intermediates {
+		verifyOptions.Intermediates.AddCert(cert)
+	}
+	return verifyOptions
+}
 
-	_, err := newCert.Verify(verifyOptions)
+// validateCertificate verifies newCert against rootCert through
+// intermediates, and once more after waiting when it starts within
+// Config.NotYetValidGrace. When that second verification fails too, its
+// error is joined with the first one.
+func validateCertificate(cfg Config, newCert *x509.Certificate, rootCert *x509.Certificate, intermediates []*x509.Certificate) error {
+	_, err := newCert.Verify(buildVerifyOptions(cfg, rootCert, intermediates))
+	if wait, ok := notYetValidWait(cfg, err, append([]*x509.Certificate{newCert}, intermediates...)); ok {
+		fmt.Printf("Certificate not yet valid, retrying verification in %s.\n", wait.Round(time.Millisecond))
+		time.Sleep(wait)
+		first := err
+		if _, err = newCert.Verify(buildVerifyOptions(cfg, rootCert, intermediates)); err != nil {
+			// The last error comes first, for nameConstraintError.
+			err = errors.Join(err, fmt.Errorf("before waiting %s: %w", wait.Round(time.Millisecond), first))
+		}
+	}
 	if err != nil {
 		fmt.Println("Failed to verify chain of trust.")
-		return err
+		return nameConstraintError(err)
 	}
 	fmt.Println("Successfully verified chain of trust.")
 
 	return nil
 }
+
+// notYetValidWait returns how long to wait before verifying certs again
+// when err comes from one of them starting in the future, within
+// cfg.NotYetValidGrace of now: the clock of the CA is ahead of ours.
+func notYetValidWait(cfg Config, err error, certs []*x509.Certificate) (time.Duration, bool) {
+	var invalid x509.CertificateInvalidError
+	if cfg.NotYetValidGrace <= 0 || !cfg.VerifyAt.IsZero() || !errors.As(err, &invalid) || invalid.Reason != x509.Expired {
+		return 0, false
+	}
+	var wait time.Duration
+	for _, cert := range certs {
+		wait = max(wait, time.Until(cert.NotBefore))
+	}
+	return wait, wait > 0 && wait <= cfg.NotYetValidGrace
+}
+
+// VerifyAgainstPool checks that cert chains to one of roots and is valid for
+// usages. An empty usages defaults to server authentication, as in x509.
+func VerifyAgainstPool(cert *x509.Certificate, roots *x509.CertPool, usages []x509.ExtKeyUsage) error {
+	if len(usages) == 0 {
+		usages = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	}
+	verifyOptions := buildVerifyOptions(Config{ExtKeyUsages: usages}, nil, nil)
+	verifyOptions.Roots = roots
+	_, err := cert.Verify(verifyOptions)
+	return nameConstraintError(err)
+}
+
+// nameConstraintError turns a verification failure caused by the name
+// constraints of a CA into ErrNameConstraintViolation, keeping the x509
+// detail naming the offending SAN. Other errors are returned unchanged.
+func nameConstraintError(err error) error {
+	var invalid x509.CertificateInvalidError
+	if errors.As(err, &invalid) && invalid.Reason == x509.CANotAuthorizedForThisName {
+		return fmt.Errorf("%w: %s", ErrNameConstraintViolation, invalid.Detail)
+	}
+	return err
+}
@@ -0,0 +1,466 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGeneratePersistsIntermediates(t *testing.T) {
+	pki := newFakePKI(t)
+	pki.withIntermediate()
+	pki.negotiate, pki.version = true, ProtocolV1
+	dir := t.TempDir()
+	certFile, keyFile, caFile := filepath.Join(dir, "node.crt"), filepath.Join(dir, "node.key"), filepath.Join(dir, "ca.crt")
+	chainFile := filepath.Join(dir, "node.chain.crt")
+	cfg := Config{ProtocolVersion: ProtocolV1, ChainFile: chainFile}
+	if _, err := generate(newCertificateRequest("node", 1, nil), pki.addr(), certFile, keyFile, caFile, cfg); err != nil {
+		t.Fatal(err)
+	}
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chainPEM, err := os.ReadFile(chainFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(chainPEM) != string(certPEM) {
+		t.Error("chain file differs from the certificate file")
+	}
+
+	leaf, intermediates, err := loadChain(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(intermediates) != 1 || !intermediates[0].Equal(pki.inter) {
+		t.Fatalf("certificate file holds %d intermediates, want the PKI one", len(intermediates))
+	}
+	root, err := loadCertificate(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validateCertificate(Config{}, leaf, root, intermediates); err != nil {
+		t.Errorf("persisted chain doesn't verify: %v", err)
+	}
+
+	tlsCert, err := LoadTLSCertificate(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tlsCert.Certificate) != 3 {
+		t.Errorf("tls.Certificate chain has %d certificates, want leaf, intermediate and root", len(tlsCert.Certificate))
+	}
+}
+
+func TestGenerateWithoutKeyFile(t *testing.T) {
+	pki := newFakePKI(t)
+	dir := t.TempDir()
+	certFile, caFile := filepath.Join(dir, "node.crt"), filepath.Join(dir, "ca.crt")
+	request := newCertificateRequest("node", 1, nil)
+	if _, err := generate(request, pki.addr(), certFile, "", caFile, Config{}); !errors.Is(err, ErrNoKeyOutput) {
+		t.Fatalf("generate without key file = %v, want ErrNoKeyOutput", err)
+	}
+	if _, err := os.Stat(certFile); !os.IsNotExist(err) {
+		t.Errorf("certificate written for a discarded key: %v", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := generate(request, pki.addr(), certFile, "", caFile, Config{Key: key}); err != nil {
+		t.Fatalf("generate with a caller supplied key: %v", err)
+	}
+}
+
+func TestGenerateInDir(t *testing.T) {
+	pki := newFakePKI(t)
+	dir := filepath.Join(t.TempDir(), "pki", "node")
+	if _, err := GenerateInDir(newCertificateRequest("node", 1, nil), pki.addr(), dir, "node", Config{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"node.crt", "node.key", "node.ca.crt"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestRefuseOverwrite(t *testing.T) {
+	pki := newFakePKI(t)
+	dir := t.TempDir()
+	cfg := Config{RefuseOverwrite: true}
+	if _, err := GenerateInDir(newCertificateRequest("node", 1, nil), pki.addr(), dir, "node", cfg); err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "node.key")
+	key, err := os.ReadFile(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GenerateInDir(newCertificateRequest("node", 1, nil), pki.addr(), dir, "node", cfg); !errors.Is(err, ErrKeyExists) {
+		t.Errorf("second enrollment: %v, want ErrKeyExists", err)
+	}
+	if data, _ := os.ReadFile(keyFile); string(data) != string(key) {
+		t.Error("key replaced by the second enrollment")
+	}
+
+	// A key appearing while enrolling is not replaced either.
+	cfg.DialFunc = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		os.WriteFile(filepath.Join(dir, "other.key"), []byte("racing key"), 0600)
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+	if _, err := GenerateInDir(newCertificateRequest("other", 1, nil), pki.addr(), dir, "other", cfg); !errors.Is(err, ErrKeyExists) {
+		t.Errorf("racing enrollment: %v, want ErrKeyExists", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "other.key")); string(data) != "racing key" {
+		t.Errorf("racing key replaced by %q", data)
+	}
+}
+
+func TestEnrollResult(t *testing.T) {
+	pki := newFakePKI(t)
+	dir := t.TempDir()
+	certFile, keyFile, caFile := filepath.Join(dir, "node.crt"), filepath.Join(dir, "node.key"), filepath.Join(dir, "ca.crt")
+	result, err := generate(newCertificateRequest("node", 1, nil), pki.addr(), certFile, keyFile, caFile, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Certificate == nil || result.CA == nil || result.CertFile != certFile || result.KeyFile != keyFile || result.Key != nil {
+		t.Errorf("generate result = %+v", result)
+	}
+
+	result, err = EnrollSigner(newCertificateRequest("node", 1, nil), pki.addr(), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Key == nil || result.CertFile != "" {
+		t.Fatalf("EnrollSigner result = %+v", result)
+	}
+	if err := checkKeyMatch(result.Certificate, result.Key.Public()); err != nil {
+		t.Error(err)
+	}
+
+	result, err = generate(newCertificateRequest("node", 1, nil), pki.addr(), certFile, "", caFile, Config{})
+	if err == nil || result.Certificate != nil {
+		t.Errorf("failed generate = %+v, %v, want the zero result", result, err)
+	}
+}
+
+func TestGenerateAllOrNothing(t *testing.T) {
+	pki := newFakePKI(t)
+	dir := t.TempDir()
+	certFile, keyFile, caFile := filepath.Join(dir, "node.crt"), filepath.Join(dir, "node.key"), filepath.Join(dir, "ca.crt")
+	os.WriteFile(keyFile, []byte("old key"), 0600)
+	os.WriteFile(certFile, []byte("old cert"), 0644)
+	// A non-empty directory can't be replaced by the CA file.
+	os.MkdirAll(filepath.Join(caFile, "busy"), 0700)
+
+	cfg := Config{WriteMetadata: true}
+	if _, err := generate(newCertificateRequest("node", 1, nil), pki.addr(), certFile, keyFile, caFile, cfg); err == nil {
+		t.Fatal("generate succeeded over a directory")
+	}
+	for name, want := range map[string]string{keyFile: "old key", certFile: "old cert"} {
+		if data, _ := os.ReadFile(name); string(data) != want {
+			t.Errorf("%s is %q after a failed generate, want %q", filepath.Base(name), data, want)
+		}
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 3 {
+		t.Errorf("%d entries in %s, want only the 3 previous files", len(entries), dir)
+	}
+}
+
+func TestProfile(t *testing.T) {
+	pki := newFakePKI(t)
+	pki.negotiate, pki.version = true, ProtocolV4
+	cfg := Config{Profile: "web-server"}
+	if _, err := EnrollSigner(newCertificateRequest("node", 1, nil), pki.addr(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	if profile := <-pki.profiles; profile != cfg.Profile {
+		t.Errorf("PKI received profile %q, want %q", profile, cfg.Profile)
+	}
+
+	pki.version = ProtocolV3
+	if _, err := EnrollSigner(newCertificateRequest("node", 1, nil), pki.addr(), cfg); !errors.Is(err, ErrProtocolVersion) {
+		t.Errorf("profile with a ProtocolV3 PKI: %v, want ErrProtocolVersion", err)
+	}
+}
+
+func TestDialFunc(t *testing.T) {
+	pki := newFakePKI(t)
+	var dialed string
+	cfg := Config{DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = addr
+		client, server := net.Pipe()
+		go pki.handle(server)
+		return client, nil
+	}}
+	if _, err := EnrollSigner(newCertificateRequest("node", 1, nil), "pki.invalid:8443", cfg); err != nil {
+		t.Fatal(err)
+	}
+	if dialed != "pki.invalid:8443" {
+		t.Errorf("DialFunc called for %q", dialed)
+	}
+
+	cfg.Timeouts.Dial = 10 * time.Millisecond
+	cfg.DialFunc = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	var timeout *PhaseTimeoutError
+	if _, err := EnrollSigner(newCertificateRequest("node", 1, nil), "pki.invalid:8443", cfg); !errors.As(err, &timeout) || timeout.Phase != PhaseDial {
+		t.Errorf("stalled DialFunc: %v, want a dial PhaseTimeoutError", err)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	pki := newFakePKI(t)
+	pki.negotiate, pki.version = true, ProtocolV7
+	result, err := EnrollSigner(newCertificateRequest("node", 1, nil), pki.addr(), Config{RequestID: "req-42"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.RequestID != "req-42" {
+		t.Errorf("RequestID = %q, want the echoed req-42", result.RequestID)
+	}
+	result, err = EnrollSigner(newCertificateRequest("node", 1, nil), pki.addr(), Config{ProtocolVersion: ProtocolV7})
+	if err != nil || result.RequestID != "fake-request" {
+		t.Errorf("without a client ID: %q, %v, want the ID of the CA", result.RequestID, err)
+	}
+
+	// The fake PKI drops email addresses.
+	request := newCertificateRequest("node", 1, nil)
+	request.EmailAddresses = []string{"ops@example.com"}
+	_, err = EnrollSigner(request, pki.addr(), Config{RequestID: "req-43", RequireRequestedSANs: true})
+	if !errors.Is(err, ErrSANMissing) || !strings.HasPrefix(err.Error(), "request req-43: ") {
+		t.Errorf("failed enrollment: %v, want the request ID", err)
+	}
+
+	pki.version = ProtocolV6
+	if _, err := EnrollSigner(newCertificateRequest("node", 1, nil), pki.addr(), Config{RequestID: "req-44"}); !errors.Is(err, ErrProtocolVersion) {
+		t.Errorf("ProtocolV6 PKI: %v, want ErrProtocolVersion", err)
+	}
+}
+
+func TestNotYetValidGrace(t *testing.T) {
+	pki := newFakePKI(t)
+	// The certificate starts up to a second ahead of the local clock.
+	pki.skew = time.Minute + time.Second
+	var invalid x509.CertificateInvalidError
+	if _, err := EnrollSigner(newCertificateRequest("node", 1, nil), pki.addr(), Config{}); !errors.As(err, &invalid) || invalid.Reason != x509.Expired {
+		t.Errorf("without grace: %v, want a not yet valid error", err)
+	}
+	if _, err := EnrollSigner(newCertificateRequest("node", 1, nil), pki.addr(), Config{NotYetValidGrace: 3 * time.Second}); err != nil {
+		t.Errorf("within grace: %v", err)
+	}
+	// Both verifications are reported when the second one fails too.
+	_, err := EnrollSigner(newCertificateRequest("node", 1, nil), pki.addr(), Config{NotYetValidGrace: 3 * time.Second, ExtKeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning}})
+	if !errors.As(err, &invalid) || invalid.Reason != x509.IncompatibleUsage || !strings.Contains(err.Error(), "before waiting") {
+		t.Errorf("within grace, wrong usage: %v, want both verification errors", err)
+	}
+	pki.skew = time.Hour
+	if _, err := EnrollSigner(newCertificateRequest("node", 1, nil), pki.addr(), Config{NotYetValidGrace: 3 * time.Second}); !errors.As(err, &invalid) {
+		t.Errorf("beyond grace: %v, want a not yet valid error", err)
+	}
+}
+
+func TestNameConstraintViolation(t *testing.T) {
+	pki := newFakePKI(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:                big.NewInt(1),
+		Subject:                     pkix.Name{CommonName: "constrained root"},
+		NotBefore:                   time.Now().Add(-time.Hour),
+		NotAfter:                    time.Now().Add(24 * time.Hour),
+		IsCA:                        true,
+		BasicConstraintsValid:       true,
+		KeyUsage:                    x509.KeyUsageCertSign,
+		PermittedDNSDomainsCritical: true,
+		PermittedDNSDomains:         []string{"example.com"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pki.root, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	pki.key = key
+
+	if _, err := EnrollSigner(newCertificateRequest("node", 1, []string{"node.example.com"}), pki.addr(), Config{}); err != nil {
+		t.Fatalf("permitted name: %v", err)
+	}
+	_, err = EnrollSigner(newCertificateRequest("node", 1, []string{"node.example.org"}), pki.addr(), Config{})
+	if !errors.Is(err, ErrNameConstraintViolation) || !strings.Contains(err.Error(), "node.example.org") {
+		t.Errorf("excluded name: %v, want ErrNameConstraintViolation naming it", err)
+	}
+}
+
+func TestOnTransfer(t *testing.T) {
+	pki := newFakePKI(t)
+	var reported []TransferStats
+	cfg := Config{OnTransfer: func(stats TransferStats) { reported = append(reported, stats) }}
+	result, err := EnrollSigner(newCertificateRequest("node", 1, nil), pki.addr(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reported) != 1 || reported[0] != result.Stats {
+		t.Fatalf("OnTransfer received %+v, want %+v once", reported, result.Stats)
+	}
+	stats := reported[0]
+	if stats.CSRBytes == 0 || stats.CertBytes != len(result.Certificate.Raw) || stats.RootCertBytes != len(pki.root.Raw) {
+		t.Errorf("stats %+v for a %d bytes certificate and a %d bytes root", stats, len(result.Certificate.Raw), len(pki.root.Raw))
+	}
+	if stats.RoundTrip <= 0 || stats.RoundTrip < stats.SigningLatency {
+		t.Errorf("round trip %v, signing latency %v", stats.RoundTrip, stats.SigningLatency)
+	}
+}
+
+func TestVerifyAgainstPool(t *testing.T) {
+	root, rootKey := newFakeCA(t, "fake root", nil, nil)
+	other, _ := newFakeCA(t, "other root", nil, nil)
+	leaf := newFakeLeaf(t, "node", root, rootKey)
+	roots, others := x509.NewCertPool(), x509.NewCertPool()
+	roots.AddCert(root)
+	others.AddCert(other)
+	if err := VerifyAgainstPool(leaf, roots, nil); err != nil {
+		t.Errorf("default usage: %v", err)
+	}
+	if err := VerifyAgainstPool(leaf, roots, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}); err != nil {
+		t.Errorf("client authentication: %v", err)
+	}
+	if err := VerifyAgainstPool(leaf, roots, []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning}); err == nil {
+		t.Error("verified for an usage the certificate lacks")
+	}
+	if err := VerifyAgainstPool(leaf, others, nil); err == nil {
+		t.Error("verified against a pool without its root")
+	}
+}
+
+func TestSkipRootFrame(t *testing.T) {
+	pki := newFakePKI(t)
+	dir := t.TempDir()
+	rootFile := filepath.Join(dir, "root.crt")
+	if err := writePEMFile(rootFile, 0644, pki.root); err != nil {
+		t.Fatal(err)
+	}
+	// The legacy CA answers the CSR with the certificate alone.
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			der, err := pki.recv(server)
+			if err != nil {
+				return
+			}
+			csr, err := x509.ParseCertificateRequest(der)
+			if err != nil {
+				return
+			}
+			pki.send(server, pki.sign(csr))
+		}()
+		return client, nil
+	}
+	cfg := Config{SkipRootFrame: true, RootCAFile: rootFile, DialFunc: dial}
+	result, err := GenerateInDir(newCertificateRequest("node", 1, nil), pki.addr(), dir, "node", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.CA.Equal(pki.root) || result.Stats.RootCertBytes != 0 {
+		t.Errorf("enrolled under %v with %d root bytes received", result.CA.Subject, result.Stats.RootCertBytes)
+	}
+	if ca, err := loadCertificate(result.CAFile); err != nil || !ca.Equal(pki.root) {
+		t.Errorf("CA file from RootCAFile: %v", err)
+	}
+
+	cfg.RootCAFile = ""
+	if _, err := EnrollSigner(newCertificateRequest("node", 1, nil), pki.addr(), cfg); err == nil {
+		t.Error("SkipRootFrame accepted without a RootCAFile")
+	}
+}
+
+func TestNewHostCertificateRequest(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		t.Skipf("no host name: %v", err)
+	}
+	request, err := NewHostCertificateRequest("", 1, []string{"10.0.0.1", "node.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.Subject.CommonName != hostname || !slices.Contains(request.DNSNames, hostname) ||
+		!slices.Contains(request.DNSNames, "node.example.com") || len(request.IPAddresses) != 1 {
+		t.Errorf("host request %v with %q and %v", request.Subject, request.DNSNames, request.IPAddresses)
+	}
+	request, err = NewHostCertificateRequest("node", 1, []string{"node.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.Subject.CommonName != "node" || !slices.Equal(request.DNSNames, []string{"node.example.com"}) {
+		t.Errorf("named request %v with %q", request.Subject, request.DNSNames)
+	}
+}
+
+// slowSigner is a PKI connection whose first answer comes after delay, as
+// if the CA took that long to sign.
+type slowSigner struct {
+	net.Conn
+	delay time.Duration
+	once  sync.Once
+}
+
+func (c *slowSigner) Write(p []byte) (int, error) {
+	c.once.Do(func() { time.Sleep(c.delay) })
+	return c.Conn.Write(p)
+}
+
+func TestSigningLatency(t *testing.T) {
+	pki := newFakePKI(t)
+	const delay = 100 * time.Millisecond
+	cfg := Config{DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		client, server := net.Pipe()
+		go pki.handle(&slowSigner{Conn: server, delay: delay})
+		return client, nil
+	}}
+	result, err := EnrollSigner(newCertificateRequest("node", 1, nil), pki.addr(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := result.Stats; stats.SigningLatency < delay || stats.RoundTrip < stats.SigningLatency {
+		t.Errorf("signing latency %v and round trip %v for a CA signing in %v", stats.SigningLatency, stats.RoundTrip, delay)
+	}
+}
@@ -0,0 +1,61 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package certmanagertest provides helpers to test code built on certmanager.
+package certmanagertest
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"slices"
+	"testing"
+)
+
+// AssertCertFile fails t unless path holds a PEM certificate whose
+// CommonName is expectedCN and whose SANs (DNS names, IP addresses, email
+// addresses and URIs, in any order) are exactly expectedSANs.
+func AssertCertFile(t testing.TB, path, expectedCN string, expectedSANs []string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading %s: %v", path, err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		t.Fatalf("%s holds no PEM certificate", path)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("parsing %s: %v", path, err)
+	}
+	if cert.Subject.CommonName != expectedCN {
+		t.Errorf("%s: CommonName is %q, want %q", path, cert.Subject.CommonName, expectedCN)
+	}
+	sans := append([]string(nil), cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	sans = append(sans, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	want := append([]string(nil), expectedSANs...)
+	slices.Sort(sans)
+	slices.Sort(want)
+	if !slices.Equal(sans, want) {
+		t.Errorf("%s: SANs are %q, want %q", path, sans, want)
+	}
+}
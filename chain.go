@@ -0,0 +1,186 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// issues reports whether child names parent as its issuer, by subject and,
+// when both carry one, by key identifier.
+func issues(parent, child *x509.Certificate) bool {
+	if !bytes.Equal(child.RawIssuer, parent.RawSubject) {
+		return false
+	}
+	if len(child.AuthorityKeyId) == 0 || len(parent.SubjectKeyId) == 0 {
+		return true
+	}
+	return bytes.Equal(child.AuthorityKeyId, parent.SubjectKeyId)
+}
+
+// IssuedBy reports whether root issued cert: the issuer name and, when both
+// carry one, the authority key identifier of cert must designate root, and
+// the signature of cert must verify with the public key of root. Unlike a
+// full chain verification it ignores validity periods and usages. It
+// returns false and the reason when the names link up but the signature
+// doesn't verify.
+func IssuedBy(cert, root *x509.Certificate) (bool, error) {
+	if !issues(root, cert) {
+		return false, nil
+	}
+	if err := root.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// checkChainOrder returns ErrChainOrder, naming the indices of the first
+// mismatched pair, unless each certificate of chain was issued by the next
+// one: by name and, when both carry one, by key identifier, the authority
+// key id of the child matching the subject key id of the parent.
+func checkChainOrder(chain []*x509.Certificate) error {
+	for i := 0; i+1 < len(chain); i++ {
+		if !issues(chain[i+1], chain[i]) {
+			return fmt.Errorf("%w: certificate %d (%q, authority key id %x) not issued by certificate %d (%q, subject key id %x)",
+				ErrChainOrder, i, chain[i].Subject, chain[i].AuthorityKeyId, i+1, chain[i+1].Subject, chain[i+1].SubjectKeyId)
+		}
+	}
+	return nil
+}
+
+// orderChain walks from leaf up to root through intermediates and returns
+// the intermediates in issuance order, leaf side first. It fails with
+// ErrBrokenChain naming the first certificate whose issuer is missing, or
+// an intermediate that isn't part of the path.
+func orderChain(leaf *x509.Certificate, intermediates []*x509.Certificate, root *x509.Certificate) ([]*x509.Certificate, error) {
+	remaining := append([]*x509.Certificate(nil), intermediates...)
+	var ordered []*x509.Certificate
+	current := leaf
+	for !issues(root, current) {
+		next := -1
+		for i, candidate := range remaining {
+			if issues(candidate, current) {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			return nil, fmt.Errorf("%w: no certificate issued %q (issuer %q, authority key id %x)",
+				ErrBrokenChain, current.Subject, current.Issuer, current.AuthorityKeyId)
+		}
+		current = remaining[next]
+		ordered = append(ordered, current)
+		remaining = append(remaining[:next], remaining[next+1:]...)
+	}
+	if len(remaining) > 0 {
+		return nil, fmt.Errorf("%w: intermediate %q is not on the path to the root", ErrBrokenChain, remaining[0].Subject)
+	}
+	return ordered, nil
+}
+
+// parseBundle parses every CERTIFICATE block of a PEM bundle, in order.
+func parseBundle(bundle []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, bundle = pem.Decode(bundle)
+		if block == nil {
+			return certs, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+}
+
+// LeafFromBundle picks the end-entity certificate of a PEM bundle whatever
+// the order of its blocks: the only certificate that isn't a CA and
+// didn't issue any other one. The other certificates are returned as the
+// chain, in bundle order.
+func LeafFromBundle(bundle []byte) (*x509.Certificate, []*x509.Certificate, error) {
+	certs, err := parseBundle(bundle)
+	if err != nil {
+		return nil, nil, err
+	}
+	leaf := -1
+	for i, cert := range certs {
+		if cert.IsCA || slices.ContainsFunc(certs, func(other *x509.Certificate) bool {
+			return other != cert && issues(cert, other)
+		}) {
+			continue
+		}
+		if leaf >= 0 {
+			return nil, nil, fmt.Errorf("%w: %q and %q are both leaves", ErrAmbiguousLeaf, certs[leaf].Subject, cert.Subject)
+		}
+		leaf = i
+	}
+	if leaf < 0 {
+		return nil, nil, fmt.Errorf("%w: no leaf among %d certificates", ErrIncompleteBundle, len(certs))
+	}
+	chain := slices.Delete(slices.Clone(certs), leaf, leaf+1)
+	return certs[leaf], chain, nil
+}
+
+// LoadCertPoolDir reads the .pem and .crt files of dir, as in
+// /etc/ssl/certs, into a pool of trust anchors for VerifyAgainstPool. Each
+// file may hold several certificates; files holding none, or that can't be
+// read or parsed, are skipped with a warning. Subdirectories are ignored.
+// It fails when dir can't be listed or no certificate was found.
+func LoadCertPoolDir(dir string) (*x509.CertPool, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	found := 0
+	for _, entry := range entries {
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		if entry.IsDir() || (ext != ".pem" && ext != ".crt") {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Printf("Warning: skipping %s: %v.\n", path, err)
+			continue
+		}
+		certs, err := parseBundle(data)
+		if err != nil || len(certs) == 0 {
+			fmt.Printf("Warning: skipping %s, no certificate found.\n", path)
+			continue
+		}
+		for _, cert := range certs {
+			pool.AddCert(cert)
+		}
+		found += len(certs)
+	}
+	if found == 0 {
+		return nil, fmt.Errorf("ezb_lib/certmanager: no certificate found in %s", dir)
+	}
+	return pool, nil
+}
@@ -0,0 +1,139 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLoadCertPoolDir(t *testing.T) {
+	dir := t.TempDir()
+	root, key := newFakeCA(t, "fake root", nil, nil)
+	inter, _ := newFakeCA(t, "fake intermediate", root, key)
+	other, _ := newFakeCA(t, "other root", nil, nil)
+	if err := writePEMFile(filepath.Join(dir, "bundle.pem"), 0644, root, inter); err != nil {
+		t.Fatal(err)
+	}
+	if err := writePEMFile(filepath.Join(dir, "other.CRT"), 0644, other); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string]string{"README": "not a certificate", "junk.pem": "junk"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub.crt"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	pool, err := LoadCertPoolDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cert := range []*x509.Certificate{root, inter, other} {
+		if _, err := cert.Verify(x509.VerifyOptions{Roots: pool, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}); err != nil {
+			t.Errorf("%s not in the pool: %v", cert.Subject, err)
+		}
+	}
+
+	if _, err := LoadCertPoolDir(filepath.Join(dir, "sub.crt")); err == nil {
+		t.Error("directory without certificates gave a pool")
+	}
+}
+
+func TestCheckChainOrder(t *testing.T) {
+	root, rootKey := newFakeCA(t, "fake root", nil, nil)
+	inter, interKey := newFakeCA(t, "fake intermediate", root, rootKey)
+	sub, _ := newFakeCA(t, "fake sub", inter, interKey)
+	if err := checkChainOrder([]*x509.Certificate{sub, inter, root}); err != nil {
+		t.Errorf("ordered chain: %v", err)
+	}
+	err := checkChainOrder([]*x509.Certificate{sub, root, inter})
+	if !errors.Is(err, ErrChainOrder) || !strings.Contains(err.Error(), "certificate 0") || !strings.Contains(err.Error(), "certificate 1") {
+		t.Errorf("misordered chain: %v, want ErrChainOrder naming 0 and 1", err)
+	}
+}
+
+func TestLeafFromBundle(t *testing.T) {
+	root, rootKey := newFakeCA(t, "fake root", nil, nil)
+	inter, interKey := newFakeCA(t, "fake intermediate", root, rootKey)
+	leaf := newFakeLeaf(t, "node", inter, interKey)
+	for _, order := range [][]*x509.Certificate{
+		{leaf, inter, root},
+		{root, inter, leaf},
+		{inter, leaf, root},
+		{leaf},
+	} {
+		var bundle bytes.Buffer
+		if err := writeCertificates(&bundle, order...); err != nil {
+			t.Fatal(err)
+		}
+		got, chain, err := LeafFromBundle(bundle.Bytes())
+		if err != nil {
+			t.Errorf("%d certificates: %v", len(order), err)
+			continue
+		}
+		if !got.Equal(leaf) || len(chain) != len(order)-1 || slices.ContainsFunc(chain, leaf.Equal) {
+			t.Errorf("picked %q and a chain of %d certificates", got.Subject, len(chain))
+		}
+	}
+
+	var bundle bytes.Buffer
+	if err := writeCertificates(&bundle, inter, leaf, newFakeLeaf(t, "other", inter, interKey), root); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := LeafFromBundle(bundle.Bytes()); !errors.Is(err, ErrAmbiguousLeaf) {
+		t.Errorf("two leaves: %v, want ErrAmbiguousLeaf", err)
+	}
+	bundle.Reset()
+	if err := writeCertificates(&bundle, inter, root); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := LeafFromBundle(bundle.Bytes()); !errors.Is(err, ErrIncompleteBundle) {
+		t.Errorf("no leaf: %v, want ErrIncompleteBundle", err)
+	}
+}
+
+func TestIssuedBy(t *testing.T) {
+	root, rootKey := newFakeCA(t, "fake root", nil, nil)
+	inter, interKey := newFakeCA(t, "fake intermediate", root, rootKey)
+	leaf := newFakeLeaf(t, "node", inter, interKey)
+	impostor, _ := newFakeCA(t, "fake root", nil, nil)
+	for _, test := range []struct {
+		name         string
+		cert, issuer *x509.Certificate
+		want         bool
+	}{
+		{"intermediate by root", inter, root, true},
+		{"leaf by intermediate", leaf, inter, true},
+		{"self-signed root", root, root, true},
+		{"leaf by root", leaf, root, false},
+		{"root by intermediate", root, inter, false},
+		{"same name, other key", inter, impostor, false},
+	} {
+		got, err := IssuedBy(test.cert, test.issuer)
+		if got != test.want || err != nil {
+			t.Errorf("%s: IssuedBy = %v, %v, want %v", test.name, got, err, test.want)
+		}
+	}
+}
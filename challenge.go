@@ -0,0 +1,98 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"fmt"
+)
+
+// challengeContext prefixes the nonce signed in proof of possession, so
+// the PKI can't have the key sign anything but a challenge.
+const challengeContext = "ezb_lib/certmanager proof-of-possession\x00"
+
+// contextMessage returns what is signed for data under context: the
+// SHA-256 digest of the prefixed data, or the prefixed data itself for
+// Ed25519, which hashes internally.
+func contextMessage(pub crypto.PublicKey, context string, data []byte) ([]byte, crypto.Hash) {
+	msg := append([]byte(context), data...)
+	if _, ok := pub.(ed25519.PublicKey); ok {
+		return msg, crypto.Hash(0)
+	}
+	digest := sha256.Sum256(msg)
+	return digest[:], crypto.SHA256
+}
+
+// signContext signs data under context with priv.
+func signContext(priv crypto.Signer, context string, data []byte) ([]byte, error) {
+	msg, hash := contextMessage(priv.Public(), context, data)
+	return priv.Sign(rand.Reader, msg, hash)
+}
+
+// verifyContext reports whether signature was made over data under context
+// by the private key of pub.
+func verifyContext(pub crypto.PublicKey, context string, data, signature []byte) (bool, error) {
+	msg, _ := contextMessage(pub, context, data)
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(k, msg, signature), nil
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, msg, signature) == nil, nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, msg, signature), nil
+	}
+	return false, fmt.Errorf("unsupported %s key", publicKeyAlgorithm(pub))
+}
+
+// VerifyProofOfPossession checks, on the PKI side of ProtocolV5, that
+// signature was made over nonce by the private key of pub, the public key
+// of the CSR. ECDSA keys sign the SHA-256 digest of a fixed context string
+// followed by the nonce, RSA keys the same digest in PKCS #1 v1.5, and
+// Ed25519 keys the context string and nonce directly. It returns
+// ErrProofOfPossession when the signature doesn't verify.
+func VerifyProofOfPossession(pub crypto.PublicKey, nonce, signature []byte) error {
+	ok, err := verifyContext(pub, challengeContext, nonce, signature)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrProofOfPossession, err)
+	}
+	if !ok {
+		return ErrProofOfPossession
+	}
+	return nil
+}
+
+// answerChallenge reads the nonce the PKI sends after the CSR from
+// ProtocolV5 on and returns its signature by priv.
+func answerChallenge(r *bufio.Reader, w *bufio.Writer, frames frameCodec, priv crypto.Signer) error {
+	nonce, err := frames.readResponse(r, "awaiting challenge")
+	if err != nil {
+		return err
+	}
+	signature, err := signContext(priv, challengeContext, nonce)
+	if err != nil {
+		return fmt.Errorf("failed to sign challenge: %w", err)
+	}
+	if err := frames.writeFrame(w, signature); err != nil {
+		return err
+	}
+	return flushFrames(w)
+}
@@ -0,0 +1,63 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestProofOfPossession(t *testing.T) {
+	nonce := []byte("0123456789abcdef")
+	other := mustGenerateKey(t, KeyECDSAP256)
+	for _, keyType := range []KeyType{KeyECDSAP384, KeyRSA2048, KeyEd25519} {
+		priv := mustGenerateKey(t, keyType)
+		signature, err := signContext(priv, challengeContext, nonce)
+		if err != nil {
+			t.Fatalf("%s: %v", keyType, err)
+		}
+		if err := VerifyProofOfPossession(priv.Public(), nonce, signature); err != nil {
+			t.Errorf("%s: %v", keyType, err)
+		}
+		if err := VerifyProofOfPossession(priv.Public(), []byte("another nonce"), signature); !errors.Is(err, ErrProofOfPossession) {
+			t.Errorf("%s with another nonce: %v, want ErrProofOfPossession", keyType, err)
+		}
+		if err := VerifyProofOfPossession(other.Public(), nonce, signature); !errors.Is(err, ErrProofOfPossession) {
+			t.Errorf("%s against another key: %v, want ErrProofOfPossession", keyType, err)
+		}
+	}
+}
+
+func TestChallengeEnrollment(t *testing.T) {
+	pki := newFakePKI(t)
+	pki.negotiate, pki.version = true, ProtocolV5
+	cfg := Config{ProtocolVersion: ProtocolV5, TargetKeyType: KeyEd25519}
+	if _, err := EnrollSigner(newCertificateRequest("node", 1, nil), pki.addr(), cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := createCSR(newCertificateRequest("node", 1, nil), mustGenerateKey(t, KeyECDSAP256), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := exchange(context.Background(), der, nil, pki.addr(), cfg); !errors.Is(err, ErrProtocolVersion) {
+		t.Errorf("challenge without the key: %v, want ErrProtocolVersion", err)
+	}
+	if _, err := EnrollPipelined(context.Background(), nil, pki.addr(), cfg); !errors.Is(err, ErrProtocolVersion) {
+		t.Errorf("pipelined with ProtocolV5: %v, want ErrProtocolVersion", err)
+	}
+}
@@ -0,0 +1,266 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"net"
+	"os"
+	"time"
+)
+
+// Config holds the optional settings of an enrollment.
+// The zero value keeps the historical behavior.
+type Config struct {
+	// RefuseOverwrite makes generate fail with ErrKeyExists instead of
+	// truncating an existing private key file.
+	RefuseOverwrite bool
+	// KeyMode and CertMode are the permissions given to the key file and to
+	// the certificate and CA files, regardless of the umask. They default
+	// to 0600 and 0644.
+	KeyMode  os.FileMode
+	CertMode os.FileMode
+	// Key, when set, is used instead of generating a P-256 key, including
+	// by Renew. It may be RSA, Ed25519 or ECDSA on one of the NIST curves,
+	// the only ones crypto/x509 can encode. Keys held by an HSM or KMS are
+	// used through crypto.Signer alone: leave the key file path empty and
+	// it is never marshaled nor written.
+	Key crypto.Signer
+	// KeyStore, when set and Key isn't, generates the key inside a
+	// hardware token under KeyLabel, e.g. through PKCS#11, and the CSR is
+	// signed by the token. The key file then holds only the KeyReference
+	// of the label, and may be left empty.
+	KeyStore KeyStore
+	KeyLabel string
+	// TargetKeyType selects the algorithm of generated keys, KeyECDSAP256
+	// by default. Setting it for Renew moves an identity to a stronger
+	// algorithm: the new key and certificate are swapped in together.
+	TargetKeyType KeyType
+	// SignatureAlgorithm signs the CSR with another hash than the one
+	// matching the key, e.g. x509.ECDSAWithSHA384 with a P-256 key. It must
+	// suit the key type; the default picks the hash from the key size.
+	SignatureAlgorithm x509.SignatureAlgorithm
+	// KeyPolicy, when set, is enforced on the generated or supplied key
+	// before the CSR is made, failing with ErrWeakKey. An empty KeyPolicy
+	// applies the secure defaults, see KeyPolicy.
+	KeyPolicy *KeyPolicy
+	// Tracer, when set, traces every enrollment in a span carrying the
+	// subject, PKI endpoint and outcome, with a child span per phase of
+	// the exchange. See Tracer to plug OpenTelemetry in.
+	Tracer Tracer
+	// OnTransfer, when set, receives the byte counts and timings of the
+	// exchange once the root certificate has been received.
+	OnTransfer func(TransferStats)
+	// OnSuccess, when set, is called once the artifacts are validated and
+	// written, e.g. to reload the services using them. Its error is
+	// returned by the enrollment.
+	OnSuccess func(result EnrollResult) error
+	// WebhookURL, when set, receives an IssuanceEvent as a JSON POST after
+	// every enrollment, successful or not. Delivery happens in the
+	// background with WebhookAttempts tries (default 3) of WebhookTimeout
+	// each (default 10s).
+	WebhookURL      string
+	WebhookTimeout  time.Duration
+	WebhookAttempts int
+	// ChallengePassword, when set, is embedded in the CSR as a PKCS#9
+	// challengePassword attribute for CAs gating issuance on a shared secret.
+	ChallengePassword string
+	// ExtKeyUsages are the usages the issued certificate is verified for,
+	// client authentication by default, and VerifyAt the time of the
+	// verification, now by default, e.g. to check a certificate not yet
+	// valid. RefreshCA verifies with them as well.
+	ExtKeyUsages []x509.ExtKeyUsage
+	VerifyAt     time.Time
+	// NotYetValidGrace, when positive, absorbs clock skew with the CA: a
+	// certificate failing verification because it starts at most this
+	// long in the future is verified again once it is valid, instead of
+	// failing the enrollment. Keep it short, e.g. a few seconds, as the
+	// enrollment sleeps meanwhile.
+	NotYetValidGrace time.Duration
+	// MinSCTs, when positive, makes enrollment fail with
+	// ErrInsufficientSCTs unless the issued certificate embeds this many
+	// signed certificate timestamps, for deployments mandating certificate
+	// transparency. With CTLogs set, the public keys of the trusted logs,
+	// only the timestamps of those logs with a valid signature count.
+	MinSCTs int
+	CTLogs  []crypto.PublicKey
+	// Subject sets the Organization, OrganizationalUnit, Country, Province
+	// and Locality of the CSR, each with one or more values. Attributes
+	// left empty keep the template ones, Organization defaulting to
+	// ezBastion.
+	Subject Subject
+	// ExtraExtensions are added to the CSR as-is, e.g. SPIFFE identities or
+	// private OIDs. Each OID may appear only once.
+	ExtraExtensions []pkix.Extension
+	// DenyWildcards rejects wildcard DNS names, e.g. "*.example.com", with
+	// ErrWildcardNotAllowed before the CSR is sent, for policies banning
+	// them. Wildcards are allowed by default, as the whole leftmost label
+	// only.
+	DenyWildcards bool
+	// RequireRequestedSANs makes enrollment fail with ErrSANMissing when
+	// the issued certificate lacks a DNS name, IP address, email address or
+	// URI of the request. SANs added by the CA are accepted.
+	RequireRequestedSANs bool
+	// RequestedValidity is the lifetime asked of the CA. The protocol can't
+	// carry it, but a warning is printed when the issued certificate is
+	// valid for less than three quarters of it. Renew defaults it to the
+	// lifetime of the certificate being renewed.
+	RequestedValidity time.Duration
+
+	// WideFrames switches the protocol to four-byte length headers, for
+	// payloads over 64KB. The PKI must be configured the same way.
+	WideFrames bool
+	// MaxFrameSize bounds the size of the frames sent and accepted. It
+	// defaults to 64KB-1 with two-byte headers and 1MB with WideFrames.
+	MaxFrameSize int
+	// PEMPayloads sends the CSR PEM encoded rather than DER, and expects
+	// the certificate and root frames of ProtocolLegacy in PEM too, for CA
+	// front-ends standardized on PEM. The framing is unchanged, and the
+	// bundles of ProtocolV1 on are PEM anyway.
+	PEMPayloads bool
+	// ProtocolVersion is the protocol version requested from the PKI.
+	// ProtocolLegacy, the default, skips the version handshake.
+	ProtocolVersion byte
+	// Profile, when set, names the certificate template the CA should
+	// issue from, e.g. "web-server" or "client". It is sent before the CSR
+	// and needs a PKI speaking ProtocolV4, which is then requested; older
+	// PKIs fail the enrollment with ErrProtocolVersion.
+	Profile string
+	// RequestID, when set, is sent to the CA ahead of the CSR so client and
+	// CA logs can be joined; the ID the CA echoes is returned in
+	// EnrollResult.RequestID and prefixes enrollment errors. It needs a PKI
+	// speaking ProtocolV7, which is then requested; older PKIs fail the
+	// enrollment with ErrProtocolVersion.
+	RequestID string
+	// BootstrapKey and BootstrapCert, when set, are a factory-installed
+	// identity authenticating the first enrollment of a node: the CSR is
+	// sent along with BootstrapCert and its signature by BootstrapKey, so
+	// the CA can check the node before issuing its operational
+	// certificate. They must be set together and match, and need a PKI
+	// speaking ProtocolV8, which is then requested; older PKIs fail the
+	// enrollment with ErrProtocolVersion.
+	BootstrapKey  crypto.Signer
+	BootstrapCert *x509.Certificate
+	// TLS, when set, runs the exchange over TLS with this configuration,
+	// after the proxy tunnel if any. MinVersion defaults to TLS 1.2 and
+	// can't be lower, failing with ErrInsecureTLS, CipherSuites to ECDHE
+	// with AEAD ciphers and ServerName to the host of the PKI address.
+	TLS *tls.Config
+	// PreSharedKey, when set, starts the exchange with a nonce handshake and
+	// seals every frame with AES-GCM keys derived from it. This lightweight
+	// framing is for links that can't run TLS; it is not TLS and gives no
+	// server authentication beyond knowledge of the key.
+	PreSharedKey []byte
+	// ResumableCA makes RefreshCA download the PEM CA bundle in chunks
+	// with ProtocolV6, reconnecting and resuming from the last chunk
+	// received when the link drops, for very large chains over flaky
+	// links.
+	ResumableCA bool
+	// DialFunc, when set, opens the connection to the PKI, or to Proxy,
+	// instead of a net.Dialer, e.g. for custom transports or in-memory
+	// pipes in tests. The dial phase timeout bounds its context.
+	DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+	// KeepAlive, when positive, enables TCP keepalive with this period on
+	// the enrollment connection, for PKIs behind NAT or load balancers with
+	// idle timeouts.
+	KeepAlive time.Duration
+	// ReadBufferSize and WriteBufferSize size the buffers of the
+	// connection to the PKI, 4096 bytes by default. Larger buffers save
+	// syscalls when receiving big chains, e.g. with WideFrames.
+	ReadBufferSize  int
+	WriteBufferSize int
+	// SkipRootFrame is for legacy CAs that send the issued certificate
+	// without their root certificate afterwards. The certificate is then
+	// validated against, and the CA file written from, RootCAFile.
+	SkipRootFrame bool
+	RootCAFile    string
+	// TrustMode decides whether the root sent by the PKI is trusted as-is,
+	// TrustTOFU by default, must match RootPin, a SHA-256 fingerprint in
+	// hex, or RootCAFile with TrustPinned, or is replaced by RootCAFile
+	// with TrustPreconfigured. RefreshCA honors it too.
+	TrustMode TrustMode
+	RootPin   string
+	// Proxy routes the connection to the PKI through a SOCKS5 or HTTP
+	// CONNECT proxy, as "socks5://[user:password@]host:port" or
+	// "http://[user:password@]host:port". The tunnel is set up within the
+	// dial phase timeout.
+	Proxy string
+	// Timeouts bounds each phase of the exchange with the PKI; see
+	// SplitTimeout to derive them from a total budget.
+	Timeouts PhaseTimeouts
+
+	// PKI is the host:port of the ezBastion PKI, used by Renew and WatchAndRenew.
+	PKI string
+	// CertFile, KeyFile and CAFile locate the enrolled artifacts
+	// maintained by Renew and WatchAndRenew.
+	CertFile string
+	KeyFile  string
+	CAFile   string
+	// ChainFile, when set, also receives the chain a TLS server presents,
+	// see EnrollResult.ServerChain, for servers configured with a chain
+	// path of its own. The certificate file already holds the same chain.
+	// It is written and swapped in with the other files.
+	ChainFile string
+	// OutputFormat arranges the certificates among the certificate file
+	// and ChainFile for a web server, e.g. FormatApache for a leaf alone
+	// in the certificate file. FormatPEM, the default, keeps the historical
+	// layout.
+	OutputFormat OutputFormat
+	// WriteMetadata adds a JSON Metadata file next to the certificate, see
+	// MetadataPath. Like the other files, it is written to a temporary file
+	// first and all of them are swapped in together.
+	WriteMetadata bool
+	// RenewBefore, when set, makes every enrollment record in a .renew-at
+	// file next to the certificate the time to renew it, this long before
+	// expiry, so cron jobs and other tools agree with WatchAndRenew, which
+	// then follows the file instead of its threshold.
+	RenewBefore time.Duration
+	// BatchStateFile, when set, lets EnrollFromDir resume an interrupted
+	// batch: it records the CSRs enrolled there and skips them on a rerun.
+	BatchStateFile string
+	// CheckInterval is how often WatchAndRenew inspects CertFile.
+	// Defaults to one hour.
+	CheckInterval time.Duration
+	// RetryBackoff is the first delay before WatchAndRenew retries a failed
+	// renewal, one minute by default. It doubles on each consecutive
+	// failure up to RetryBackoffMax, CheckInterval by default, and is
+	// jittered so that renewals spread out.
+	RetryBackoff    time.Duration
+	RetryBackoffMax time.Duration
+	// VerifyRenewal, when set, is given the temporary paths of a renewed
+	// certificate, key and CA, e.g. to load them in a test tls.Config. Renew
+	// only swaps them into place when it returns nil.
+	VerifyRenewal func(certFile, keyFile, caFile string) error
+	// RenewalHintOID identifies a certificate extension through which the
+	// CA recommends how long before expiry to renew, as an INTEGER number of
+	// seconds. When present it overrides the WatchAndRenew threshold.
+	RenewalHintOID asn1.ObjectIdentifier
+	// RenewAtFraction, when between 0 and 1, makes WatchAndRenew renew
+	// once that fraction of the certificate lifetime has elapsed, e.g. 2/3,
+	// instead of within its threshold, see LifetimeElapsedFraction. The
+	// .renew-at file and the renewal hint of the CA still take precedence.
+	RenewAtFraction float64
+	// UseCATime bases the renewal decisions of WatchAndRenew, NeedsRenewal
+	// and RenewExpiring on the time of the PKI, see FetchCATime, instead of
+	// the local clock, so a skewed node renews neither too early nor too
+	// late. The local clock is used when the PKI doesn't answer the query.
+	UseCATime bool
+}
@@ -0,0 +1,136 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+)
+
+// oidChallengePassword is the PKCS#9 challengePassword attribute (RFC 2985).
+var oidChallengePassword = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 7}
+
+// These structures mirror the ASN.1 layout of a certificate request
+// (RFC 2986) closely enough to add attributes the x509 package can't encode.
+type rawCertificateRequestInfo struct {
+	Version       int
+	Subject       asn1.RawValue
+	PublicKey     asn1.RawValue
+	RawAttributes []asn1.RawValue `asn1:"tag:0"`
+}
+
+type rawCertificateRequest struct {
+	TBSCSR             asn1.RawValue
+	SignatureAlgorithm asn1.RawValue
+	SignatureValue     asn1.BitString
+}
+
+type csrAttribute struct {
+	Type   asn1.ObjectIdentifier
+	Values []asn1.RawValue `asn1:"set"`
+}
+
+// checkDuplicateExtensions returns ErrDuplicateExtension when two extensions
+// share the same OID.
+func checkDuplicateExtensions(extensions []pkix.Extension) error {
+	seen := make(map[string]bool, len(extensions))
+	for _, ext := range extensions {
+		id := ext.Id.String()
+		if seen[id] {
+			return fmt.Errorf("%w: %s", ErrDuplicateExtension, id)
+		}
+		seen[id] = true
+	}
+	return nil
+}
+
+// withChallengePassword returns der with a challengePassword attribute
+// appended to the request info, re-signed with priv.
+func withChallengePassword(der []byte, priv crypto.Signer, password string) ([]byte, error) {
+	value, err := asn1.Marshal(password)
+	if err != nil {
+		return nil, err
+	}
+	attr, err := asn1.Marshal(csrAttribute{
+		Type:   oidChallengePassword,
+		Values: []asn1.RawValue{{FullBytes: value}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return addCSRAttribute(der, priv, asn1.RawValue{FullBytes: attr})
+}
+
+// addCSRAttribute appends attr to the attributes of the DER encoded request
+// and signs the result again, keeping the original signature algorithm.
+func addCSRAttribute(der []byte, priv crypto.Signer, attr asn1.RawValue) ([]byte, error) {
+	parsed, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, err
+	}
+	var csr rawCertificateRequest
+	if _, err := asn1.Unmarshal(der, &csr); err != nil {
+		return nil, err
+	}
+	var info rawCertificateRequestInfo
+	if _, err := asn1.Unmarshal(csr.TBSCSR.FullBytes, &info); err != nil {
+		return nil, err
+	}
+	info.RawAttributes = append(info.RawAttributes, attr)
+	tbs, err := asn1.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := signDigest(priv, parsed.SignatureAlgorithm, tbs)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(rawCertificateRequest{
+		TBSCSR:             asn1.RawValue{FullBytes: tbs},
+		SignatureAlgorithm: csr.SignatureAlgorithm,
+		SignatureValue:     asn1.BitString{Bytes: signature, BitLength: len(signature) * 8},
+	})
+}
+
+// signDigest signs data with priv the way algo expects.
+func signDigest(priv crypto.Signer, algo x509.SignatureAlgorithm, data []byte) ([]byte, error) {
+	var hash crypto.Hash
+	switch algo {
+	case x509.SHA256WithRSA, x509.ECDSAWithSHA256, x509.SHA256WithRSAPSS:
+		hash = crypto.SHA256
+	case x509.SHA384WithRSA, x509.ECDSAWithSHA384, x509.SHA384WithRSAPSS:
+		hash = crypto.SHA384
+	case x509.SHA512WithRSA, x509.ECDSAWithSHA512, x509.SHA512WithRSAPSS:
+		hash = crypto.SHA512
+	case x509.PureEd25519:
+		return priv.Sign(rand.Reader, data, crypto.Hash(0))
+	default:
+		return nil, fmt.Errorf("ezb_lib/certmanager: unsupported signature algorithm %v", algo)
+	}
+	h := hash.New()
+	h.Write(data)
+	digest := h.Sum(nil)
+	switch algo {
+	case x509.SHA256WithRSAPSS, x509.SHA384WithRSAPSS, x509.SHA512WithRSAPSS:
+		return priv.Sign(rand.Reader, digest, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: hash})
+	}
+	return priv.Sign(rand.Reader, digest, hash)
+}
@@ -0,0 +1,90 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestChallengePassword(t *testing.T) {
+	oid := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 2}
+	for _, keyType := range []KeyType{KeyECDSAP256, KeyRSA2048, KeyEd25519} {
+		cfg := Config{ChallengePassword: "s3cret", ExtraExtensions: []pkix.Extension{{Id: oid, Value: []byte{0x05, 0x00}}}}
+		der, err := createCSR(newCertificateRequest("node", 1, []string{"node.example.com"}), mustGenerateKey(t, keyType), cfg)
+		if err != nil {
+			t.Fatalf("%s: %v", keyType, err)
+		}
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			t.Fatalf("%s: %v", keyType, err)
+		}
+		if err := csr.CheckSignature(); err != nil {
+			t.Errorf("%s: %v", keyType, err)
+		}
+		if !slices.Equal(csr.DNSNames, []string{"node.example.com"}) || !slices.ContainsFunc(csr.Extensions, func(ext pkix.Extension) bool { return ext.Id.Equal(oid) }) {
+			t.Errorf("%s: extensions lost: %v %v", keyType, csr.DNSNames, csr.Extensions)
+		}
+		if got := challengePassword(t, csr); got != "s3cret" {
+			t.Errorf("%s: challenge password %q", keyType, got)
+		}
+	}
+}
+
+// challengePassword returns the challengePassword attribute of csr.
+func challengePassword(t *testing.T, csr *x509.CertificateRequest) string {
+	t.Helper()
+	var info rawCertificateRequestInfo
+	if _, err := asn1.Unmarshal(csr.RawTBSCertificateRequest, &info); err != nil {
+		t.Fatal(err)
+	}
+	for _, raw := range info.RawAttributes {
+		var attr csrAttribute
+		if _, err := asn1.Unmarshal(raw.FullBytes, &attr); err != nil {
+			t.Fatal(err)
+		}
+		if !attr.Type.Equal(oidChallengePassword) || len(attr.Values) != 1 {
+			continue
+		}
+		var password string
+		if _, err := asn1.Unmarshal(attr.Values[0].FullBytes, &password); err != nil {
+			t.Fatal(err)
+		}
+		return password
+	}
+	return ""
+}
+
+func TestDuplicateExtension(t *testing.T) {
+	first := pkix.Extension{Id: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 2}, Value: []byte{0x05, 0x00}}
+	second := pkix.Extension{Id: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 3}, Value: []byte{0x05, 0x00}}
+	key := mustGenerateKey(t, KeyECDSAP256)
+	if _, err := createCSR(newCertificateRequest("node", 1, nil), key, Config{ExtraExtensions: []pkix.Extension{first, second}}); err != nil {
+		t.Errorf("distinct extensions: %v", err)
+	}
+	if _, err := createCSR(newCertificateRequest("node", 1, nil), key, Config{ExtraExtensions: []pkix.Extension{first, second, first}}); !errors.Is(err, ErrDuplicateExtension) {
+		t.Errorf("repeated extension: %v, want ErrDuplicateExtension", err)
+	}
+	request := newCertificateRequest("node", 1, nil)
+	request.ExtraExtensions = []pkix.Extension{first}
+	if _, err := createCSR(request, key, Config{ExtraExtensions: []pkix.Extension{first}}); !errors.Is(err, ErrDuplicateExtension) {
+		t.Errorf("extension of the template repeated: %v, want ErrDuplicateExtension", err)
+	}
+}
@@ -0,0 +1,154 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import "errors"
+
+// ErrKeyExists is returned when the key file is already present and
+// Config.RefuseOverwrite is set.
+var ErrKeyExists = errors.New("ezb_lib/certmanager: key file already exists")
+
+// ErrDuplicateExtension is returned when the same extension OID is
+// requested more than once in a CSR.
+var ErrDuplicateExtension = errors.New("ezb_lib/certmanager: duplicate CSR extension")
+
+// ErrConnectionClosed is returned when the PKI closes or resets the
+// connection before the exchange completes. The wrapping error names the
+// stage that was interrupted.
+var ErrConnectionClosed = errors.New("ezb_lib/certmanager: connection closed by the PKI")
+
+// ErrFrameTooLarge is returned when a frame exceeds the configured maximum
+// size, before any buffer is allocated for it.
+var ErrFrameTooLarge = errors.New("ezb_lib/certmanager: frame too large")
+
+// ErrPayloadAuth is returned when a frame sealed with the pre-shared key
+// can't be authenticated, e.g. because both sides use different keys.
+var ErrPayloadAuth = errors.New("ezb_lib/certmanager: frame authentication failed")
+
+// ErrProtocolVersion is returned when the PKI answers the version
+// handshake with a version the client can't use.
+var ErrProtocolVersion = errors.New("ezb_lib/certmanager: unsupported protocol version")
+
+// ErrIncompleteBundle is returned when a PEM bundle sent by the PKI lacks
+// the issued certificate or a CA certificate.
+var ErrIncompleteBundle = errors.New("ezb_lib/certmanager: incomplete certificate bundle")
+
+// ErrUnsupportedCurve is returned for ECDSA keys on curves crypto/x509 can't
+// encode, such as secp256k1 or brainpool.
+var ErrUnsupportedCurve = errors.New("ezb_lib/certmanager: unsupported elliptic curve")
+
+// ErrSendFailed is returned when writing to the PKI fails. The PKI may have
+// received part of a frame, so the exchange is abandoned and the connection
+// closed rather than retried on the same connection.
+var ErrSendFailed = errors.New("ezb_lib/certmanager: sending to the PKI failed")
+
+// ErrBrokenChain is returned when the issued certificate, intermediates
+// and root don't link up; the wrapping error names the gap.
+var ErrBrokenChain = errors.New("ezb_lib/certmanager: broken certificate chain")
+
+// ErrInvalidOID is returned for object identifiers that can't be DER
+// encoded, e.g. with fewer than two arcs or a negative arc.
+var ErrInvalidOID = errors.New("ezb_lib/certmanager: malformed object identifier")
+
+// ErrAmbiguousLeaf is returned when a bundle holds more than one
+// end-entity certificate.
+var ErrAmbiguousLeaf = errors.New("ezb_lib/certmanager: several leaf certificates in bundle")
+
+// ErrNameConstraintViolation is returned when a certificate holds a name
+// outside the subtrees permitted by the name constraints of its root or an
+// intermediate. The wrapping error names the offending SAN.
+var ErrNameConstraintViolation = errors.New("ezb_lib/certmanager: name not permitted by CA name constraints")
+
+// ErrNoKeyOutput is returned when no key file or writer is given for a key
+// generated by the package, which would be lost. Only a caller supplied
+// Config.Key may be left unwritten.
+var ErrNoKeyOutput = errors.New("ezb_lib/certmanager: generated key has no destination")
+
+// ErrKeyMismatch is returned when the issued certificate doesn't carry the
+// public key of the signer the CSR was made with.
+var ErrKeyMismatch = errors.New("ezb_lib/certmanager: certificate does not match the private key")
+
+// ErrNoResponse is returned when the PKI closes the connection cleanly
+// after receiving the CSR, without sending any certificate.
+var ErrNoResponse = errors.New("ezb_lib/certmanager: no response from the PKI")
+
+// ErrSignatureAlgorithm is returned when Config.SignatureAlgorithm can't be
+// used with the key, e.g. an RSA algorithm with an ECDSA key.
+var ErrSignatureAlgorithm = errors.New("ezb_lib/certmanager: signature algorithm unsuitable for the key")
+
+// ErrBadCSR is returned when the CSR built for the PKI doesn't parse back
+// or its signature doesn't verify, before anything is sent.
+var ErrBadCSR = errors.New("ezb_lib/certmanager: malformed certificate request")
+
+// ErrWeakKey is returned when the key to enroll falls short of
+// Config.KeyPolicy, e.g. RSA under 2048 bits or a curve not allowed.
+var ErrWeakKey = errors.New("ezb_lib/certmanager: key too weak for the policy")
+
+// ErrChainOrder is returned instead of writing a chain in which a
+// certificate isn't issued by the next one, which TLS servers reject. The
+// wrapping error names the indices of the mismatched pair.
+var ErrChainOrder = errors.New("ezb_lib/certmanager: certificate chain out of order")
+
+// ErrCertMissing is returned by HealthCheck when a certificate file
+// doesn't exist.
+var ErrCertMissing = errors.New("ezb_lib/certmanager: certificate file missing")
+
+// ErrCertUnparseable is returned by HealthCheck when a certificate file
+// holds no parseable PEM certificate.
+var ErrCertUnparseable = errors.New("ezb_lib/certmanager: certificate file unparseable")
+
+// ErrCertExpired is returned by HealthCheck when the certificate is past
+// its NotAfter.
+var ErrCertExpired = errors.New("ezb_lib/certmanager: certificate expired")
+
+// ErrInvalidSubject is returned when a Config.Subject attribute is empty,
+// too long or, for Country, not a two letter code.
+var ErrInvalidSubject = errors.New("ezb_lib/certmanager: invalid subject attribute")
+
+// ErrInsecureTLS is returned when Config.TLS asks for a minimum version
+// below TLS 1.2.
+var ErrInsecureTLS = errors.New("ezb_lib/certmanager: insecure TLS configuration")
+
+// ErrSANMissing is returned, with Config.RequireRequestedSANs, when the
+// issued certificate lacks a SAN of the request. The wrapping error lists
+// the missing entries.
+var ErrSANMissing = errors.New("ezb_lib/certmanager: requested SAN missing from certificate")
+
+// ErrProofOfPossession is returned by VerifyProofOfPossession when the
+// challenge signature doesn't verify against the CSR public key.
+var ErrProofOfPossession = errors.New("ezb_lib/certmanager: proof of possession failed")
+
+// ErrInsufficientSCTs is returned when the issued certificate embeds fewer
+// signed certificate timestamps than Config.MinSCTs, counting only those
+// verifying against Config.CTLogs when set.
+var ErrInsufficientSCTs = errors.New("ezb_lib/certmanager: not enough signed certificate timestamps")
+
+// ErrWildcardNotAllowed is returned before the CSR is sent when a DNS SAN
+// is a wildcard and Config.DenyWildcards is set, or holds a wildcard
+// elsewhere than as its leftmost label.
+var ErrWildcardNotAllowed = errors.New("ezb_lib/certmanager: wildcard DNS name not allowed")
+
+// ErrUntrustedRoot is returned with TrustPinned when the root sent by the
+// PKI doesn't match the pinned fingerprint or root file.
+var ErrUntrustedRoot = errors.New("ezb_lib/certmanager: root certificate not trusted")
+
+// ErrPostQuantumUnavailable is returned for KeyHybridP256MLDSA65 by builds
+// made with a Go release older than 1.27, which lack crypto/mldsa.
+var ErrPostQuantumUnavailable = errors.New("ezb_lib/certmanager: post-quantum keys need Go 1.27 or later")
+
+// ErrBootstrapSignature is returned by VerifyBootstrapSignature when the
+// signature of the CSR doesn't verify against the bootstrap certificate.
+var ErrBootstrapSignature = errors.New("ezb_lib/certmanager: bootstrap signature failed")
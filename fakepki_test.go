@@ -0,0 +1,495 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakePKI is a PKI signing every CSR with a throwaway root, or with an
+// intermediate once withIntermediate is called. With negotiate set it
+// expects the version handshake and answers version, sending a PEM bundle
+// from ProtocolV1 on, reading the operation frame from ProtocolV2 on,
+// challenging the client from ProtocolV5 on and echoing request IDs from
+// ProtocolV7 on.
+// When stall names a phase, it stops answering at the
+// start of that phase of the client, signals stalled and waits for the
+// client to hang up.
+type fakePKI struct {
+	t         *testing.T
+	ln        net.Listener
+	root      *x509.Certificate
+	key       *ecdsa.PrivateKey
+	inter     *x509.Certificate
+	interKey  *ecdsa.PrivateKey
+	negotiate bool
+	version   byte
+	stall     string
+	// wrongKey makes p certify a key of its own instead of the CSR one.
+	wrongKey bool
+	// skew moves the clock of p forward: the validity of the certificates
+	// it issues and the time it reports.
+	skew    time.Duration
+	stalled chan struct{}
+	// tls, when set, makes p serve over TLS.
+	tls *tls.Config
+	// profiles receives the certificate profile of each enrollment asking
+	// for one.
+	profiles chan string
+	// caDrops holds, for the next CA bundle downloads, the number of
+	// chunks to send before dropping the connection; caOffsets receives
+	// the offset each download starts from.
+	caDrops   chan int
+	caOffsets chan uint64
+	// pem makes p expect PEM CSRs and send PEM certificates.
+	pem bool
+	// bootstrap makes p refuse, from ProtocolV8 on, CSRs without a valid
+	// bootstrap signature.
+	bootstrap bool
+	// wide makes p use four-byte frame headers, see Config.WideFrames.
+	wide bool
+	// psk, when set, makes p run the pre-shared key handshake and seal its
+	// frames, see Config.PreSharedKey.
+	psk []byte
+}
+
+func newFakePKI(t *testing.T) *fakePKI {
+	t.Helper()
+	root, key := newFakeCA(t, "fake root", nil, nil)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakePKI{t: t, ln: ln, root: root, key: key, stalled: make(chan struct{}, 1), profiles: make(chan string, 1),
+		caDrops: make(chan int, 4), caOffsets: make(chan uint64, 8)}
+	t.Cleanup(func() { ln.Close() })
+	go p.serve()
+	return p
+}
+
+// newFakeCA creates a CA certificate signed by parent, self-signed when
+// parent is nil.
+func newFakeCA(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// newFakeLeaf creates an end-entity certificate for name signed by parent.
+func newFakeLeaf(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// withIntermediate makes p issue certificates from an intermediate CA.
+func (p *fakePKI) withIntermediate() {
+	p.inter, p.interKey = newFakeCA(p.t, "fake intermediate", p.root, p.key)
+}
+
+func (p *fakePKI) addr() string {
+	return p.ln.Addr().String()
+}
+
+func (p *fakePKI) serve() {
+	for {
+		conn, err := p.ln.Accept()
+		if err != nil {
+			return
+		}
+		if p.tls != nil {
+			conn = tls.Server(conn, p.tls)
+		}
+		go p.handle(conn)
+	}
+}
+
+// hold stalls conn if the client is entering phase.
+func (p *fakePKI) hold(conn net.Conn, phase string) bool {
+	if p.stall != phase {
+		return false
+	}
+	p.stalled <- struct{}{}
+	io.Copy(io.Discard, conn)
+	return true
+}
+
+func (p *fakePKI) handle(conn net.Conn) {
+	// Once unsealed, the relay closes the outer connection after sending
+	// the last frame.
+	outer := conn
+	defer func() {
+		if conn == outer {
+			outer.Close()
+		}
+	}()
+	r := bufio.NewReader(conn)
+	if p.negotiate {
+		if _, err := r.ReadByte(); err != nil {
+			return
+		}
+		if p.hold(conn, PhaseDial) {
+			return
+		}
+		conn.Write([]byte{p.version})
+	}
+	if p.psk != nil {
+		inner, err := p.unseal(conn, r)
+		if err != nil {
+			return
+		}
+		defer inner.Close()
+		conn, r = inner, bufio.NewReader(inner)
+	}
+	count := 1
+	if p.version >= ProtocolV2 {
+		op, err := p.recv(r)
+		if err != nil || len(op) != 1 {
+			return
+		}
+		switch op[0] {
+		case opEnrollBatch:
+			n, err := p.recv(r)
+			if err != nil || len(n) != 2 {
+				return
+			}
+			count = int(binary.LittleEndian.Uint16(n))
+		case opFetchCABundle:
+			p.sendCABundle(conn, r)
+			return
+		case opFetchTime:
+			p.send(conn, binary.LittleEndian.AppendUint64(nil, uint64(time.Now().Add(p.skew).UnixNano())))
+			return
+		case opEnrollProfile:
+			profile, err := p.recv(r)
+			if err != nil {
+				return
+			}
+			p.profiles <- string(profile)
+		}
+	}
+	var requestID []byte
+	if p.version >= ProtocolV7 {
+		var err error
+		if requestID, err = p.recv(r); err != nil {
+			return
+		}
+		if len(requestID) == 0 {
+			requestID = []byte("fake-request")
+		}
+	}
+	var csrs []*x509.CertificateRequest
+	for range count {
+		der, err := p.recv(r)
+		if err != nil {
+			return
+		}
+		if p.version >= ProtocolV8 && !p.checkBootstrap(r, der) {
+			return
+		}
+		if p.pem {
+			block, _ := pem.Decode(der)
+			if block == nil || block.Type != "CERTIFICATE REQUEST" {
+				return
+			}
+			der = block.Bytes
+		}
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			return
+		}
+		csrs = append(csrs, csr)
+	}
+	if p.version >= ProtocolV5 && !p.challenge(conn, r, csrs[0]) {
+		return
+	}
+	if p.hold(conn, PhaseReceiveCert) {
+		return
+	}
+	if requestID != nil {
+		p.send(conn, requestID)
+	}
+	if p.version >= ProtocolV1 {
+		for _, csr := range csrs {
+			p.send(conn, p.bundle(csr))
+		}
+		return
+	}
+	p.send(conn, p.encode(p.sign(csrs[0])))
+	if p.hold(conn, PhaseReceiveRoot) {
+		return
+	}
+	p.send(conn, p.encode(p.root.Raw))
+}
+
+// encode returns the legacy frame carrying the DER certificate der.
+func (p *fakePKI) encode(der []byte) []byte {
+	if p.pem {
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+	return der
+}
+
+// unseal runs the server side of the pre-shared key handshake on conn and
+// returns a connection carrying the frames of conn opened, and sealing the
+// frames written to it, so the rest of p speaks plain frames.
+func (p *fakePKI) unseal(conn net.Conn, r io.Reader) (net.Conn, error) {
+	session, err := pskServerHandshake(struct {
+		io.Reader
+		io.Writer
+	}{r, conn}, p.psk)
+	if err != nil {
+		return nil, err
+	}
+	inner, plain := net.Pipe()
+	go func() {
+		defer plain.Close()
+		for {
+			sealed, err := p.recv(r)
+			if err != nil {
+				return
+			}
+			payload, err := session.open(sealed)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			p.send(plain, payload)
+		}
+	}()
+	go func() {
+		defer conn.Close()
+		for {
+			payload, err := p.recv(plain)
+			if err != nil {
+				return
+			}
+			p.send(conn, session.seal(payload))
+		}
+	}()
+	return inner, nil
+}
+
+// pskServerHandshake is the PKI side of pskHandshake: it reads the client
+// nonce, answers with its own and derives the keys of each direction.
+func pskServerHandshake(rw io.ReadWriter, psk []byte) (*pskSession, error) {
+	nonces := make([]byte, 2*pskNonceSize)
+	if _, err := io.ReadFull(rw, nonces[:pskNonceSize]); err != nil {
+		return nil, err
+	}
+	rand.Read(nonces[pskNonceSize:])
+	if _, err := rw.Write(nonces[pskNonceSize:]); err != nil {
+		return nil, err
+	}
+	send, err := pskCipher(psk, nonces, "server to client")
+	if err != nil {
+		return nil, err
+	}
+	recv, err := pskCipher(psk, nonces, "client to server")
+	if err != nil {
+		return nil, err
+	}
+	return &pskSession{send: send, recv: recv}, nil
+}
+
+// checkBootstrap reads the bootstrap frames following the CSR payload csr
+// and reports whether they are acceptable: a valid signature, or none when
+// p doesn't require one.
+func (p *fakePKI) checkBootstrap(r io.Reader, csr []byte) bool {
+	der, err := p.recv(r)
+	if err != nil {
+		return false
+	}
+	signature, err := p.recv(r)
+	if err != nil {
+		return false
+	}
+	if len(der) == 0 {
+		return !p.bootstrap
+	}
+	if p.pem {
+		block, _ := pem.Decode(der)
+		if block == nil {
+			return false
+		}
+		der = block.Bytes
+	}
+	cert, err := x509.ParseCertificate(der)
+	return err == nil && VerifyBootstrapSignature(cert, csr, signature) == nil
+}
+
+// challenge sends a nonce and reports whether the answer proves the
+// possession of the key of csr.
+func (p *fakePKI) challenge(conn net.Conn, r io.Reader, csr *x509.CertificateRequest) bool {
+	nonce := make([]byte, 32)
+	rand.Read(nonce)
+	p.send(conn, nonce)
+	signature, err := p.recv(r)
+	return err == nil && VerifyProofOfPossession(csr.PublicKey, nonce, signature) == nil
+}
+
+// sendCABundle answers a CA bundle download in 64 byte chunks, dropping
+// the connection midway when caDrops says so.
+func (p *fakePKI) sendCABundle(conn net.Conn, r io.Reader) {
+	data, err := p.recv(r)
+	if err != nil || len(data) != 8 {
+		return
+	}
+	offset := binary.LittleEndian.Uint64(data)
+	p.caOffsets <- offset
+	drop := -1
+	select {
+	case drop = <-p.caDrops:
+	default:
+	}
+	var bundle []byte
+	if p.inter != nil {
+		bundle = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: p.inter.Raw})
+	}
+	bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: p.root.Raw})...)
+	for sent := 0; offset < uint64(len(bundle)); sent++ {
+		if sent == drop {
+			return
+		}
+		end := min(offset+64, uint64(len(bundle)))
+		chunk := binary.LittleEndian.AppendUint64(nil, offset)
+		chunk = binary.LittleEndian.AppendUint64(chunk, uint64(len(bundle)))
+		p.send(conn, append(chunk, bundle[offset:end]...))
+		offset = end
+	}
+}
+
+// bundle signs csr and returns the ProtocolV1 PEM bundle answering it.
+func (p *fakePKI) bundle(csr *x509.CertificateRequest) []byte {
+	bundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: p.sign(csr)})
+	if p.inter != nil {
+		bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: p.inter.Raw})...)
+	}
+	return append(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: p.root.Raw})...)
+}
+
+func (p *fakePKI) recv(r io.Reader) ([]byte, error) {
+	if p.wide {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, err
+		}
+		payload := make([]byte, binary.LittleEndian.Uint32(header))
+		_, err := io.ReadFull(r, payload)
+		return payload, err
+	}
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	payload := make([]byte, binary.LittleEndian.Uint16(header))
+	_, err := io.ReadFull(r, payload)
+	return payload, err
+}
+
+func (p *fakePKI) send(w io.Writer, payload []byte) {
+	var frame []byte
+	if p.wide {
+		frame = binary.LittleEndian.AppendUint32(nil, uint32(len(payload)))
+	} else {
+		frame = binary.LittleEndian.AppendUint16(nil, uint16(len(payload)))
+	}
+	w.Write(append(frame, payload...))
+}
+
+func (p *fakePKI) sign(csr *x509.CertificateRequest) []byte {
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      csr.Subject,
+		DNSNames:     csr.DNSNames,
+		IPAddresses:  csr.IPAddresses,
+		NotBefore:    time.Now().Add(p.skew - time.Minute),
+		NotAfter:     time.Now().Add(p.skew + time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	parent, key := p.root, p.key
+	if p.inter != nil {
+		parent, key = p.inter, p.interKey
+	}
+	public := csr.PublicKey
+	if p.wrongKey {
+		other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		public = other.Public()
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, public, key)
+	if err != nil {
+		p.t.Error(err)
+	}
+	return der
+}
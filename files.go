@@ -0,0 +1,187 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	defaultKeyMode  os.FileMode = 0600
+	defaultCertMode os.FileMode = 0644
+	defaultDirMode  os.FileMode = 0700
+)
+
+// ArtifactPaths returns the certificate, key and CA paths base.crt, base.key
+// and base.ca.crt in dir, creating dir with 0700 permissions if needed.
+func ArtifactPaths(dir, base string) (certFile, keyFile, caFile string, err error) {
+	if base == "" {
+		return "", "", "", fmt.Errorf("ezb_lib/certmanager: empty base name")
+	}
+	if err := os.MkdirAll(dir, defaultDirMode); err != nil {
+		return "", "", "", err
+	}
+	prefix := filepath.Join(dir, base)
+	return prefix + ".crt", prefix + ".key", prefix + ".ca.crt", nil
+}
+
+func (cfg Config) keyMode() os.FileMode {
+	if cfg.KeyMode == 0 {
+		return defaultKeyMode
+	}
+	return cfg.KeyMode
+}
+
+func (cfg Config) certMode() os.FileMode {
+	if cfg.CertMode == 0 {
+		return defaultCertMode
+	}
+	return cfg.CertMode
+}
+
+// createFile opens path with flags and forces its permissions to mode,
+// whatever the process umask is.
+func createFile(path string, flags int, mode os.FileMode) (*os.File, error) {
+	f, err := os.OpenFile(path, flags, mode)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// writePEMFile writes certs as PEM certificates to path, in order.
+func writePEMFile(path string, mode os.FileMode, certs ...*x509.Certificate) error {
+	f, err := createFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if err := writeCertificates(f, certs...); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeCertificates PEM encodes certs to w, in order.
+func writeCertificates(w io.Writer, certs ...*x509.Certificate) error {
+	for _, cert := range certs {
+		if err := pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tempPath reserves a new temporary file next to path, so it can later be
+// renamed over path atomically.
+func tempPath(path string) (string, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	name := f.Name()
+	if err := f.Close(); err != nil {
+		os.Remove(name)
+		return "", err
+	}
+	return name, nil
+}
+
+// swapFiles renames each of temps over the matching finals, skipping empty
+// finals. Each rename is atomic and the replaced files are kept as hard
+// links until all of them succeeded: if one fails, those already replaced
+// are restored, so the finals never mix old and new content.
+func swapFiles(temps, finals []string) (err error) {
+	type swapped struct{ final, backup string }
+	var done []swapped
+	defer func() {
+		for i := len(done) - 1; i >= 0; i-- {
+			switch {
+			case err == nil:
+				if done[i].backup != "" {
+					os.Remove(done[i].backup)
+				}
+			case done[i].backup == "":
+				os.Remove(done[i].final)
+			default:
+				os.Rename(done[i].backup, done[i].final)
+			}
+		}
+	}()
+	for i, final := range finals {
+		if final == "" {
+			continue
+		}
+		backup, err := tempPath(final)
+		if err != nil {
+			return err
+		}
+		os.Remove(backup)
+		if err := os.Link(final, backup); os.IsNotExist(err) {
+			backup = ""
+		} else if err != nil {
+			return err
+		}
+		if err := os.Rename(temps[i], final); err != nil {
+			if backup != "" {
+				os.Remove(backup)
+			}
+			return err
+		}
+		done = append(done, swapped{final, backup})
+	}
+	return nil
+}
+
+// removeFiles removes names, skipping empty ones, ignoring errors.
+func removeFiles(names []string) {
+	for _, name := range names {
+		if name != "" {
+			os.Remove(name)
+		}
+	}
+}
+
+// writeFileAtomic replaces path with data through a temporary file, so
+// readers see either the old or the new content.
+func writeFileAtomic(path string, data []byte, mode os.FileMode) error {
+	name, err := tempPath(path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(name)
+	f, err := createFile(name, os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(name, path)
+}
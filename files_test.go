@@ -0,0 +1,99 @@
+//go:build unix
+
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestFileModesIgnoreUmask(t *testing.T) {
+	old := syscall.Umask(0077)
+	defer syscall.Umask(old)
+
+	pki := newFakePKI(t)
+	dir := t.TempDir()
+	tests := []struct {
+		name              string
+		cfg               Config
+		keyMode, certMode os.FileMode
+	}{
+		{"defaults", Config{}, 0600, 0644},
+		{"configured", Config{KeyMode: 0640, CertMode: 0664}, 0640, 0664},
+	}
+	for _, test := range tests {
+		certFile := filepath.Join(dir, test.name+".crt")
+		keyFile := filepath.Join(dir, test.name+".key")
+		caFile := filepath.Join(dir, test.name+".ca.crt")
+		request := newCertificateRequest("node", 1, nil)
+		if _, err := generate(request, pki.addr(), certFile, keyFile, caFile, test.cfg); err != nil {
+			t.Fatal(err)
+		}
+		for name, want := range map[string]os.FileMode{keyFile: test.keyMode, certFile: test.certMode, caFile: test.certMode} {
+			info, err := os.Stat(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := info.Mode().Perm(); got != want {
+				t.Errorf("%s: mode %o, want %o", filepath.Base(name), got, want)
+			}
+		}
+	}
+}
+
+func TestSwapFilesRollback(t *testing.T) {
+	dir := t.TempDir()
+	key, cert := filepath.Join(dir, "node.key"), filepath.Join(dir, "node.crt")
+	os.WriteFile(key, []byte("old key"), 0600)
+	// A non-empty directory can't be replaced by a file.
+	os.MkdirAll(filepath.Join(cert, "busy"), 0700)
+	newKey, newCert := filepath.Join(dir, "key.tmp"), filepath.Join(dir, "cert.tmp")
+	os.WriteFile(newKey, []byte("new key"), 0600)
+	os.WriteFile(newCert, []byte("new cert"), 0600)
+
+	if err := swapFiles([]string{newKey, newCert}, []string{key, cert}); err == nil {
+		t.Fatal("swapFiles succeeded over a directory")
+	}
+	if data, _ := os.ReadFile(key); string(data) != "old key" {
+		t.Errorf("key is %q after a failed swap, want the old one", data)
+	}
+	// The key temp was consumed by the rolled back rename.
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 3 {
+		t.Errorf("%d entries left in %s, want the 2 finals and the cert temp", len(entries), dir)
+	}
+}
+
+func TestArtifactPaths(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "pki", "node")
+	certFile, keyFile, caFile, err := ArtifactPaths(dir, "node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if certFile != filepath.Join(dir, "node.crt") || keyFile != filepath.Join(dir, "node.key") || caFile != filepath.Join(dir, "node.ca.crt") {
+		t.Errorf("ArtifactPaths = %s, %s, %s", certFile, keyFile, caFile)
+	}
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() || fi.Mode().Perm() != 0700 {
+		t.Errorf("created directory: %v, %v", fi, err)
+	}
+	if _, _, _, err := ArtifactPaths(dir, ""); err == nil {
+		t.Error("empty base name accepted")
+	}
+}
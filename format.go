@@ -0,0 +1,73 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto/x509"
+	"fmt"
+)
+
+// OutputFormat arranges the leaf, intermediates and root among the
+// certificate file and Config.ChainFile for a given web server, see
+// Config.OutputFormat.
+type OutputFormat string
+
+// Output formats. FormatPEM is the default.
+const (
+	// FormatPEM writes the leaf and intermediates to the certificate file,
+	// and the same chain to the chain file.
+	FormatPEM OutputFormat = "pem"
+	// FormatNginx writes the leaf and intermediates to the certificate
+	// file, for ssl_certificate, and the intermediates and root to the
+	// chain file, for ssl_trusted_certificate and OCSP stapling.
+	FormatNginx OutputFormat = "nginx"
+	// FormatApache writes the leaf alone to the certificate file, for
+	// SSLCertificateFile, and the intermediates and root to the chain
+	// file, for SSLCertificateChainFile. It needs a chain file.
+	FormatApache OutputFormat = "apache"
+)
+
+// check rejects unknown formats, and FormatApache without a chain file,
+// which would lose the intermediates.
+func (f OutputFormat) check(chainFile string) error {
+	switch f {
+	case "", FormatPEM, FormatNginx:
+		return nil
+	case FormatApache:
+		if chainFile == "" {
+			return fmt.Errorf("ezb_lib/certmanager: %s output format needs a chain file", f)
+		}
+		return nil
+	}
+	return fmt.Errorf("ezb_lib/certmanager: unknown output format %q", f)
+}
+
+// certificates returns the chain written to the certificate file.
+func (f OutputFormat) certificates(result EnrollResult) []*x509.Certificate {
+	if f == FormatApache {
+		return []*x509.Certificate{result.Certificate}
+	}
+	return result.ServerChain()
+}
+
+// chain returns the chain written to the chain file.
+func (f OutputFormat) chain(result EnrollResult) []*x509.Certificate {
+	switch f {
+	case FormatNginx, FormatApache:
+		return append(append([]*x509.Certificate(nil), result.Chain...), result.CA)
+	}
+	return result.ServerChain()
+}
@@ -0,0 +1,65 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOutputFormat(t *testing.T) {
+	pki := newFakePKI(t)
+	pki.negotiate, pki.version = true, ProtocolV1
+	pki.withIntermediate()
+	dir := t.TempDir()
+	certFile, keyFile, caFile, chainFile := filepath.Join(dir, "node.crt"), filepath.Join(dir, "node.key"), filepath.Join(dir, "node.ca.crt"), filepath.Join(dir, "chain.crt")
+	tests := []struct {
+		format            OutputFormat
+		certLen, chainLen int
+	}{
+		{"", 2, 2},
+		{FormatPEM, 2, 2},
+		{FormatNginx, 2, 2},
+		{FormatApache, 1, 2},
+	}
+	for _, test := range tests {
+		cfg := Config{ProtocolVersion: ProtocolV1, OutputFormat: test.format, ChainFile: chainFile}
+		result, err := generate(newCertificateRequest("node", 1, nil), pki.addr(), certFile, keyFile, caFile, cfg)
+		if err != nil {
+			t.Fatalf("%q: %v", test.format, err)
+		}
+		certs, err := readCertificates(certFile)
+		if err != nil || len(certs) != test.certLen || !certs[0].Equal(result.Certificate) {
+			t.Errorf("%q: certificate file holds %d certificates, %v, want %d from the leaf", test.format, len(certs), err, test.certLen)
+		}
+		chain, err := readCertificates(chainFile)
+		if err != nil || len(chain) != test.chainLen {
+			t.Fatalf("%q: chain file holds %d certificates, %v, want %d", test.format, len(chain), err, test.chainLen)
+		}
+		wantRoot := test.format == FormatNginx || test.format == FormatApache
+		if chain[len(chain)-1].Equal(result.CA) != wantRoot {
+			t.Errorf("%q: root last in the chain file: %v", test.format, !wantRoot)
+		}
+	}
+
+	if _, err := generate(newCertificateRequest("node", 1, nil), pki.addr(), certFile, keyFile, caFile, Config{OutputFormat: FormatApache}); err == nil {
+		t.Error("FormatApache without a chain file accepted")
+	}
+	if _, err := GenerateToWriters(newCertificateRequest("node", 1, nil), pki.addr(), new(strings.Builder), new(strings.Builder), new(strings.Builder), Config{OutputFormat: "iis"}); err == nil {
+		t.Error("unknown output format accepted")
+	}
+}
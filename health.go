@@ -0,0 +1,126 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// HealthCheck is a readiness probe for the certificate stored in certFile:
+// it must be present, parse, be unexpired and chain to the root in caFile
+// through the intermediates following it in certFile. Each failure has its
+// own error: ErrCertMissing, ErrCertUnparseable, ErrCertExpired or
+// ErrBrokenChain, so orchestrators can gate traffic on a single call.
+func HealthCheck(certFile, caFile string) error {
+	certs, err := readCertificates(certFile)
+	if err != nil {
+		return err
+	}
+	roots, err := readCertificates(caFile)
+	if err != nil {
+		return err
+	}
+	leaf := certs[0]
+	if time.Now().After(leaf.NotAfter) {
+		return fmt.Errorf("%w: %s expired on %s", ErrCertExpired, certFile, leaf.NotAfter.Format(time.RFC3339))
+	}
+	verifyOptions := buildVerifyOptions(Config{ExtKeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}, roots[0], certs[1:])
+	for _, root := range roots[1:] {
+		verifyOptions.Roots.AddCert(root)
+	}
+	if _, err := leaf.Verify(verifyOptions); err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrBrokenChain, certFile, nameConstraintError(err))
+	}
+	return nil
+}
+
+// readCertificates reads the PEM certificates of path, failing with
+// ErrCertMissing or ErrCertUnparseable.
+func readCertificates(path string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrCertMissing, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	certs, err := parseBundle(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrCertUnparseable, path, err)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%w: no certificate found in %s", ErrCertUnparseable, path)
+	}
+	return certs, nil
+}
+
+// AuditResult is the health of one certificate found by AuditDir.
+type AuditResult struct {
+	CertFile string
+	CAFile   string
+	// Subject and NotAfter are left empty when the certificate can't be
+	// read. DaysUntilExpiry is negative once it expired.
+	Subject         string
+	NotAfter        time.Time
+	DaysUntilExpiry int
+	// Warnings are the Lint warnings of the certificate.
+	Warnings []string
+	// Err is the HealthCheck failure, nil for a healthy certificate.
+	Err error
+}
+
+// AuditDir runs HealthCheck over every certificate of dir, for fleet
+// audits. Each base.crt is checked against base.ca.crt, or against the
+// ca.crt shared by the directory when it has no CA file of its own; the
+// CA files themselves are skipped. The results come in file name order,
+// an error being returned only when dir can't be listed.
+func AuditDir(dir string) ([]AuditResult, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	certFiles, err := filepath.Glob(filepath.Join(dir, "*.crt"))
+	if err != nil {
+		return nil, err
+	}
+	sharedCA := filepath.Join(dir, "ca.crt")
+	var results []AuditResult
+	for _, certFile := range certFiles {
+		if certFile == sharedCA || strings.HasSuffix(certFile, ".ca.crt") {
+			continue
+		}
+		result := AuditResult{CertFile: certFile, CAFile: strings.TrimSuffix(certFile, ".crt") + ".ca.crt"}
+		if _, err := os.Stat(result.CAFile); errors.Is(err, fs.ErrNotExist) {
+			result.CAFile = sharedCA
+		}
+		if certs, err := readCertificates(certFile); err == nil {
+			result.Subject = certs[0].Subject.String()
+			result.NotAfter = certs[0].NotAfter
+			result.DaysUntilExpiry = int(math.Floor(time.Until(result.NotAfter).Hours() / 24))
+			result.Warnings = Lint(certs[0])
+		}
+		result.Err = HealthCheck(certFile, result.CAFile)
+		results = append(results, result)
+	}
+	return results, nil
+}
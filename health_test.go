@@ -0,0 +1,127 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHealthCheck(t *testing.T) {
+	pki := newFakePKI(t)
+	dir := t.TempDir()
+	certFile, keyFile, caFile := filepath.Join(dir, "node.crt"), filepath.Join(dir, "node.key"), filepath.Join(dir, "ca.crt")
+	if _, err := generate(newCertificateRequest("node", 1, nil), pki.addr(), certFile, keyFile, caFile, Config{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := HealthCheck(certFile, caFile); err != nil {
+		t.Fatalf("healthy certificate: %v", err)
+	}
+
+	other, otherKey := newFakeCA(t, "other root", nil, nil)
+	otherFile := filepath.Join(dir, "other.crt")
+	if err := writePEMFile(otherFile, 0644, other); err != nil {
+		t.Fatal(err)
+	}
+	expired := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "node"},
+		NotBefore:    time.Now().Add(-2 * time.Hour),
+		NotAfter:     time.Now().Add(-time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, expired, other, other.PublicKey, otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiredFile := filepath.Join(dir, "expired.crt")
+	if err := writePEMFile(expiredFile, 0644, expired); err != nil {
+		t.Fatal(err)
+	}
+	junkFile := filepath.Join(dir, "junk.crt")
+	if err := os.WriteFile(junkFile, []byte("junk"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name             string
+		certFile, caFile string
+		want             error
+	}{
+		{"missing", filepath.Join(dir, "absent.crt"), caFile, ErrCertMissing},
+		{"missing CA", certFile, filepath.Join(dir, "absent.crt"), ErrCertMissing},
+		{"unparseable", junkFile, caFile, ErrCertUnparseable},
+		{"expired", expiredFile, otherFile, ErrCertExpired},
+		{"other CA", certFile, otherFile, ErrBrokenChain},
+	}
+	for _, test := range tests {
+		if err := HealthCheck(test.certFile, test.caFile); !errors.Is(err, test.want) {
+			t.Errorf("%s: %v, want %v", test.name, err, test.want)
+		}
+	}
+}
+
+func TestAuditDir(t *testing.T) {
+	pki := newFakePKI(t)
+	dir := t.TempDir()
+	for _, base := range []string{"a", "b"} {
+		if _, err := GenerateInDir(newCertificateRequest(base, 1, nil), pki.addr(), dir, base, Config{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// b falls back to the shared CA, which is another root.
+	if err := os.Remove(filepath.Join(dir, "b.ca.crt")); err != nil {
+		t.Fatal(err)
+	}
+	other, _ := newFakeCA(t, "other root", nil, nil)
+	if err := writePEMFile(filepath.Join(dir, "ca.crt"), 0644, other); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "c.crt"), []byte("junk"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := AuditDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("%d results, want 3: %+v", len(results), results)
+	}
+	a, b, c := results[0], results[1], results[2]
+	if a.Err != nil || a.CAFile != filepath.Join(dir, "a.ca.crt") || a.Subject != "CN=a,O=ezBastion" || a.DaysUntilExpiry != 0 {
+		t.Errorf("a = %+v", a)
+	}
+	if !errors.Is(b.Err, ErrBrokenChain) || b.CAFile != filepath.Join(dir, "ca.crt") {
+		t.Errorf("b = %+v, want ErrBrokenChain against the shared CA", b)
+	}
+	if !errors.Is(c.Err, ErrCertUnparseable) || !c.NotAfter.IsZero() {
+		t.Errorf("c = %+v, want ErrCertUnparseable", c)
+	}
+	if _, err := AuditDir(filepath.Join(dir, "absent")); err == nil {
+		t.Error("missing directory audited")
+	}
+}
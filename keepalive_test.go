@@ -0,0 +1,65 @@
+//go:build unix
+
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestKeepAlive(t *testing.T) {
+	pki := newFakePKI(t)
+	for _, period := range []time.Duration{0, 30 * time.Second} {
+		var conn *net.TCPConn
+		enabled := -1
+		cfg := Config{
+			KeepAlive: period,
+			DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				// A dialer without keepalive leaves the socket option to
+				// setKeepAlive.
+				c, err := (&net.Dialer{KeepAlive: -1}).DialContext(ctx, network, addr)
+				if err == nil {
+					conn = c.(*net.TCPConn)
+				}
+				return c, err
+			},
+			// The connection is still open when the stats are reported.
+			OnTransfer: func(TransferStats) {
+				raw, err := conn.SyscallConn()
+				if err != nil {
+					t.Fatal(err)
+				}
+				raw.Control(func(fd uintptr) {
+					enabled, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+		}
+		if _, err := EnrollSigner(newCertificateRequest("node", 1, nil), pki.addr(), cfg); err != nil {
+			t.Fatalf("keepalive %v: %v", period, err)
+		}
+		if enabled < 0 || (enabled != 0) != (period > 0) {
+			t.Errorf("keepalive %v: SO_KEEPALIVE is %d", period, enabled)
+		}
+	}
+}
@@ -0,0 +1,372 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"slices"
+)
+
+// KeyType names the algorithm of a generated key. The values match the
+// strings returned by KeyAlgorithm.
+type KeyType string
+
+// Supported key types. KeyECDSAP256 is the default.
+const (
+	KeyECDSAP256 KeyType = "ECDSA-P256"
+	KeyECDSAP384 KeyType = "ECDSA-P384"
+	KeyECDSAP521 KeyType = "ECDSA-P521"
+	KeyRSA2048   KeyType = "RSA-2048"
+	KeyRSA3072   KeyType = "RSA-3072"
+	KeyRSA4096   KeyType = "RSA-4096"
+	KeyEd25519   KeyType = "Ed25519"
+)
+
+// generateKey creates a new key of type t, P-256 when t is empty.
+func generateKey(t KeyType) (crypto.Signer, error) {
+	switch t {
+	case "", KeyECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case KeyECDSAP521:
+		return ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	case KeyRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case KeyRSA3072:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case KeyRSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case KeyEd25519:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	case KeyHybridP256MLDSA65:
+		return generateHybridKey()
+	}
+	return nil, fmt.Errorf("ezb_lib/certmanager: unknown key type %q", t)
+}
+
+// checkKeySupported rejects public keys crypto/x509 can't put in a CSR.
+// ECDSA is limited to the NIST curves P-224, P-256, P-384 and P-521:
+// secp256k1 and the brainpool curves can be supplied through Config.Key but
+// x509 has no encoding for them, so they fail here with ErrUnsupportedCurve
+// rather than later with an opaque marshaling error. RSA and Ed25519 keys
+// are accepted as well.
+func checkKeySupported(pub crypto.PublicKey) error {
+	k, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil
+	}
+	switch k.Curve {
+	case elliptic.P224(), elliptic.P256(), elliptic.P384(), elliptic.P521():
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrUnsupportedCurve, k.Curve.Params().Name)
+}
+
+// checkSignatureAlgorithm returns ErrSignatureAlgorithm unless algo can
+// be produced by a key of type pub.
+func checkSignatureAlgorithm(pub crypto.PublicKey, algo x509.SignatureAlgorithm) error {
+	var supported []x509.SignatureAlgorithm
+	switch pub.(type) {
+	case *ecdsa.PublicKey:
+		supported = []x509.SignatureAlgorithm{x509.ECDSAWithSHA256, x509.ECDSAWithSHA384, x509.ECDSAWithSHA512}
+	case *rsa.PublicKey:
+		supported = []x509.SignatureAlgorithm{
+			x509.SHA256WithRSA, x509.SHA384WithRSA, x509.SHA512WithRSA,
+			x509.SHA256WithRSAPSS, x509.SHA384WithRSAPSS, x509.SHA512WithRSAPSS,
+		}
+	case ed25519.PublicKey:
+		supported = []x509.SignatureAlgorithm{x509.PureEd25519}
+	}
+	if !slices.Contains(supported, algo) {
+		return fmt.Errorf("%w: %v with a %s key", ErrSignatureAlgorithm, algo, publicKeyAlgorithm(pub))
+	}
+	return nil
+}
+
+// KeyPolicy sets the minimum strength of the keys enrolled, see
+// Config.KeyPolicy. Ed25519 keys always comply.
+type KeyPolicy struct {
+	// MinRSABits is the smallest RSA modulus accepted, 2048 by default.
+	MinRSABits int
+	// Curves lists the ECDSA curves accepted, P-256, P-384 and P-521 by
+	// default.
+	Curves []elliptic.Curve
+}
+
+// check returns ErrWeakKey unless pub meets p.
+func (p KeyPolicy) check(pub crypto.PublicKey) error {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		minBits := p.MinRSABits
+		if minBits <= 0 {
+			minBits = 2048
+		}
+		if k.N.BitLen() >= minBits {
+			return nil
+		}
+		return fmt.Errorf("%w: %s, at least %d bits required", ErrWeakKey, publicKeyAlgorithm(pub), minBits)
+	case *ecdsa.PublicKey:
+		curves := p.Curves
+		if len(curves) == 0 {
+			curves = []elliptic.Curve{elliptic.P256(), elliptic.P384(), elliptic.P521()}
+		}
+		if slices.Contains(curves, k.Curve) {
+			return nil
+		}
+		return fmt.Errorf("%w: curve %s not allowed", ErrWeakKey, k.Curve.Params().Name)
+	case ed25519.PublicKey:
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrWeakKey, publicKeyAlgorithm(pub))
+}
+
+func isP256(pub crypto.PublicKey) bool {
+	k, ok := pub.(*ecdsa.PublicKey)
+	return ok && k.Curve == elliptic.P256()
+}
+
+// checkKeyMatch returns ErrKeyMismatch unless cert holds public, e.g. the
+// public key of an HSM or KMS signer or of a CSR. When the key types
+// differ, pointing at a CA or profile misconfiguration, the error names
+// both.
+func checkKeyMatch(cert *x509.Certificate, public crypto.PublicKey) error {
+	pub, ok := cert.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if ok && pub.Equal(public) {
+		return nil
+	}
+	if want, got := publicKeyAlgorithm(public), publicKeyAlgorithm(cert.PublicKey); want != got {
+		return fmt.Errorf("%w: key is %s but the certificate public key is %s", ErrKeyMismatch, want, got)
+	}
+	return ErrKeyMismatch
+}
+
+// WipeKey zeroes the private material of priv, which must not be used
+// afterwards: the ECDSA and RSA secret integers and precomputed values, or
+// the Ed25519 seed. It is best effort hardening only. The Go runtime may
+// have copied the key while moving or growing memory, crypto packages keep
+// internal copies of their own, and other signer types, e.g. HSM handles,
+// are left alone, as is the ML-DSA half of a HybridKey. The package wipes
+// the keys it generated once they are written; callers of EnrollSigner
+// wipe EnrollResult.Key when done with it.
+func WipeKey(priv crypto.Signer) {
+	switch k := priv.(type) {
+	case *ecdsa.PrivateKey:
+		wipeInt(k.D)
+	case *rsa.PrivateKey:
+		wipeInt(k.D)
+		for _, prime := range k.Primes {
+			wipeInt(prime)
+		}
+		wipeInt(k.Precomputed.Dp)
+		wipeInt(k.Precomputed.Dq)
+		wipeInt(k.Precomputed.Qinv)
+	case ed25519.PrivateKey:
+		clear(k)
+	case *HybridKey:
+		WipeKey(k.Classical)
+	}
+}
+
+// wipeInt zeroes the words backing n.
+func wipeInt(n *big.Int) {
+	if n == nil {
+		return
+	}
+	clear(n.Bits())
+	n.SetInt64(0)
+}
+
+// marshalPrivateKey PEM encodes priv: ECDSA keys keep the historical SEC1
+// "EC PRIVATE KEY" form, other keys use PKCS#8.
+func marshalPrivateKey(priv crypto.Signer) (*pem.Block, error) {
+	if k, ok := priv.(*ecdsa.PrivateKey); ok {
+		b, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, err
+		}
+		return &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}, nil
+	}
+	b, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	return &pem.Block{Type: "PRIVATE KEY", Bytes: b}, nil
+}
+
+// encodePrivateKey writes priv to w in PEM, the ML-DSA half of a HybridKey
+// in a second block after the classical one.
+func encodePrivateKey(w io.Writer, priv crypto.Signer) error {
+	keys := []crypto.Signer{priv}
+	if k, ok := priv.(*HybridKey); ok {
+		keys = []crypto.Signer{k.Classical, k.PostQuantum}
+	}
+	for _, key := range keys {
+		block, err := marshalPrivateKey(key)
+		if err != nil {
+			return fmt.Errorf("failed to marshal priv: %w", err)
+		}
+		err = pem.Encode(w, block)
+		clear(block.Bytes)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PublicKeyPEM returns the public half of priv as a PEM "PUBLIC KEY" block
+// (PKIX, SubjectPublicKeyInfo).
+func PublicKeyPEM(priv crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(priv.Public())
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// ExportPublicKey writes the public half of priv to path in PEM, e.g. to
+// register or pin it in an external system without exposing the key.
+func ExportPublicKey(priv crypto.Signer, path string) error {
+	data, err := PublicKeyPEM(priv)
+	if err != nil {
+		return err
+	}
+	f, err := createFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, defaultCertMode)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// GenerateKey creates a new key of type t, P-256 when t is empty, to be
+// enrolled later through Config.Key.
+func GenerateKey(t KeyType) (crypto.Signer, error) {
+	return generateKey(t)
+}
+
+// GenerateKeyPair creates a new key of type t and writes it to path in PEM
+// with 0600 permissions, without enrolling it: LoadPrivateKey reads it back
+// for Config.Key. An existing path is never overwritten, ErrKeyExists is
+// returned instead.
+func GenerateKeyPair(t KeyType, path string) error {
+	priv, err := generateKey(t)
+	if err != nil {
+		return err
+	}
+	defer WipeKey(priv)
+	f, err := createFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, defaultKeyMode)
+	if os.IsExist(err) {
+		return ErrKeyExists
+	}
+	if err != nil {
+		return err
+	}
+	if err := encodePrivateKey(f, priv); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
+// LoadPrivateKey reads the first PEM private key of path, in SEC1, PKCS#1
+// or PKCS#8 form, e.g. one written by GenerateKeyPair, to be enrolled
+// through Config.Key.
+func LoadPrivateKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parsePrivateKeyPEM(data)
+}
+
+// parsePrivateKeyPEM decodes the first PEM private key found in data.
+func parsePrivateKeyPEM(data []byte) (crypto.Signer, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("ezb_lib/certmanager: no private key found")
+		}
+		switch block.Type {
+		case "EC PRIVATE KEY":
+			key, err := x509.ParseECPrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			return withPostQuantumKey(key, data), nil
+		case "RSA PRIVATE KEY":
+			return x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			signer, ok := key.(crypto.Signer)
+			if !ok {
+				return nil, fmt.Errorf("ezb_lib/certmanager: unsupported private key type %T", key)
+			}
+			return signer, nil
+		}
+	}
+}
+
+// KeyAlgorithm returns the algorithm of the PEM private key stored in
+// keyFile, e.g. "ECDSA-P256", "RSA-2048" or "Ed25519".
+func KeyAlgorithm(keyFile string) (string, error) {
+	priv, err := LoadPrivateKey(keyFile)
+	if err != nil {
+		return "", err
+	}
+	if k, ok := priv.(*HybridKey); ok {
+		return k.algorithm(), nil
+	}
+	return publicKeyAlgorithm(priv.Public()), nil
+}
+
+// KeyMatchesCert reports whether the PEM private key in keyFile is the one
+// certified by the first certificate of certFile, e.g. as a pre-flight
+// check before starting a TLS server. A clean mismatch gives false and a
+// nil error; errors are kept for files that can't be read or parsed.
+func KeyMatchesCert(keyFile, certFile string) (bool, error) {
+	priv, err := LoadPrivateKey(keyFile)
+	if err != nil {
+		return false, err
+	}
+	defer WipeKey(priv)
+	cert, err := loadCertificate(certFile)
+	if err != nil {
+		return false, err
+	}
+	return checkKeyMatch(cert, priv.Public()) == nil, nil
+}
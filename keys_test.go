@@ -0,0 +1,268 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWipeKey(t *testing.T) {
+	for _, keyType := range []KeyType{KeyECDSAP256, KeyRSA2048, KeyEd25519} {
+		priv, err := generateKey(keyType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		WipeKey(priv)
+		switch k := priv.(type) {
+		case *ecdsa.PrivateKey:
+			if k.D.Sign() != 0 {
+				t.Errorf("%s: D survived", keyType)
+			}
+		case *rsa.PrivateKey:
+			if k.D.Sign() != 0 || k.Primes[0].Sign() != 0 || k.Precomputed.Dp.Sign() != 0 {
+				t.Errorf("%s: private values survived", keyType)
+			}
+		case ed25519.PrivateKey:
+			for _, b := range k {
+				if b != 0 {
+					t.Errorf("%s: key bytes survived", keyType)
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestCreateCSRSignatureAlgorithm(t *testing.T) {
+	priv, err := generateKey(KeyECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := newCertificateRequest("node", 1, nil)
+	der, err := createCSR(request, priv, Config{SignatureAlgorithm: x509.ECDSAWithSHA384, ChallengePassword: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if csr.SignatureAlgorithm != x509.ECDSAWithSHA384 {
+		t.Errorf("CSR signed with %v, want ECDSAWithSHA384", csr.SignatureAlgorithm)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		t.Error(err)
+	}
+	if _, err := createCSR(request, priv, Config{SignatureAlgorithm: x509.SHA256WithRSA}); !errors.Is(err, ErrSignatureAlgorithm) {
+		t.Errorf("RSA algorithm with an ECDSA key: %v, want ErrSignatureAlgorithm", err)
+	}
+}
+
+func TestCheckCSR(t *testing.T) {
+	priv, err := generateKey(KeyECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := createCSR(newCertificateRequest("node", 1, nil), priv, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkCSR(der); err != nil {
+		t.Fatal(err)
+	}
+	// The signature closes the DER encoding.
+	der[len(der)-1] ^= 0xff
+	if err := checkCSR(der); !errors.Is(err, ErrBadCSR) {
+		t.Errorf("corrupted CSR: %v, want ErrBadCSR", err)
+	}
+	if err := checkCSR(der[:len(der)/2]); !errors.Is(err, ErrBadCSR) {
+		t.Errorf("truncated CSR: %v, want ErrBadCSR", err)
+	}
+}
+
+func TestKeyPolicy(t *testing.T) {
+	p224, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsa1024, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		key    crypto.Signer
+		policy KeyPolicy
+		weak   bool
+	}{
+		{"P-256", mustGenerateKey(t, KeyECDSAP256), KeyPolicy{}, false},
+		{"P-224", p224, KeyPolicy{}, true},
+		{"RSA-2048", mustGenerateKey(t, KeyRSA2048), KeyPolicy{}, false},
+		{"RSA-1024", rsa1024, KeyPolicy{}, true},
+		{"RSA-2048 below minimum", mustGenerateKey(t, KeyRSA2048), KeyPolicy{MinRSABits: 3072}, true},
+		{"P-256 outside allowlist", mustGenerateKey(t, KeyECDSAP256), KeyPolicy{Curves: []elliptic.Curve{elliptic.P384()}}, true},
+		{"Ed25519", mustGenerateKey(t, KeyEd25519), KeyPolicy{MinRSABits: 4096}, false},
+	}
+	for _, test := range tests {
+		_, err := createCSR(newCertificateRequest("node", 1, nil), test.key, Config{KeyPolicy: &test.policy})
+		if weak := errors.Is(err, ErrWeakKey); weak != test.weak || (!weak && err != nil) {
+			t.Errorf("%s: %v, want weak %v", test.name, err, test.weak)
+		}
+	}
+}
+
+func mustGenerateKey(t *testing.T, keyType KeyType) crypto.Signer {
+	t.Helper()
+	priv, err := generateKey(keyType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv
+}
+
+func TestKeyMatchesCert(t *testing.T) {
+	pki := newFakePKI(t)
+	dir := t.TempDir()
+	for _, base := range []string{"a", "b"} {
+		if _, err := GenerateInDir(newCertificateRequest(base, 1, nil), pki.addr(), dir, base, Config{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	if ok, err := KeyMatchesCert(a+".key", a+".crt"); !ok || err != nil {
+		t.Errorf("matching pair: %v, %v", ok, err)
+	}
+	if ok, err := KeyMatchesCert(a+".key", b+".crt"); ok || err != nil {
+		t.Errorf("mismatched pair: %v, %v, want false and no error", ok, err)
+	}
+	if _, err := KeyMatchesCert(a+".crt", a+".crt"); err == nil {
+		t.Error("certificate parsed as a key")
+	}
+}
+
+func TestCheckKeyMatchTypes(t *testing.T) {
+	root, rootKey := newFakeCA(t, "fake root", nil, nil)
+	rsaKey := mustGenerateKey(t, KeyRSA2048)
+	err := checkKeyMatch(root, rsaKey.Public())
+	if !errors.Is(err, ErrKeyMismatch) || err.Error() != ErrKeyMismatch.Error()+": key is RSA-2048 but the certificate public key is ECDSA-P256" {
+		t.Errorf("RSA key against an ECDSA certificate: %v", err)
+	}
+	if err := checkKeyMatch(root, mustGenerateKey(t, KeyECDSAP256).Public()); err != ErrKeyMismatch {
+		t.Errorf("other ECDSA key: %v, want the bare ErrKeyMismatch", err)
+	}
+	if err := checkKeyMatch(root, rootKey.Public()); err != nil {
+		t.Errorf("matching key: %v", err)
+	}
+}
+
+func TestGenerateKeyPair(t *testing.T) {
+	pki := newFakePKI(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "pre.key")
+	if err := GenerateKeyPair(KeyEd25519, path); err != nil {
+		t.Fatal(err)
+	}
+	if err := GenerateKeyPair(KeyEd25519, path); !errors.Is(err, ErrKeyExists) {
+		t.Errorf("second GenerateKeyPair: %v, want ErrKeyExists", err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("key file: %v, %v", fi, err)
+	}
+	priv, err := LoadPrivateKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := GenerateInDir(newCertificateRequest("pre", 1, nil), pki.addr(), dir, "pre", Config{Key: priv})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkKeyMatch(result.Certificate, priv.Public()); err != nil {
+		t.Error(err)
+	}
+	if _, err := GenerateKey("DSA-1024"); err == nil {
+		t.Error("unknown key type accepted")
+	}
+}
+
+func TestExportPublicKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node.pub")
+	for _, keyType := range []KeyType{KeyECDSAP256, KeyRSA2048, KeyEd25519} {
+		priv := mustGenerateKey(t, keyType)
+		if err := ExportPublicKey(priv, path); err != nil {
+			t.Fatalf("%s: %v", keyType, err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, rest := pem.Decode(data)
+		if block == nil || block.Type != "PUBLIC KEY" || len(rest) != 0 {
+			t.Fatalf("%s: exported %q", keyType, data)
+		}
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			t.Fatalf("%s: %v", keyType, err)
+		}
+		if !pub.(interface{ Equal(crypto.PublicKey) bool }).Equal(priv.Public()) {
+			t.Errorf("%s: exported another public key", keyType)
+		}
+		if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0644 {
+			t.Errorf("%s: exported file %v, %v", keyType, fi, err)
+		}
+		if inline, err := PublicKeyPEM(priv); err != nil || string(inline) != string(data) {
+			t.Errorf("%s: PublicKeyPEM differs from the exported file: %v", keyType, err)
+		}
+	}
+}
+
+// publicKeySigner is a signer advertising pub, which createCSR must refuse
+// before ever signing.
+type publicKeySigner struct {
+	crypto.Signer
+	pub crypto.PublicKey
+}
+
+func (s publicKeySigner) Public() crypto.PublicKey { return s.pub }
+
+func TestUnsupportedCurve(t *testing.T) {
+	secp256k1 := &elliptic.CurveParams{Name: "secp256k1", BitSize: 256}
+	pub := &ecdsa.PublicKey{Curve: secp256k1, X: big.NewInt(1), Y: big.NewInt(2)}
+	_, err := createCSR(newCertificateRequest("node", 1, nil), publicKeySigner{pub: pub}, Config{})
+	if !errors.Is(err, ErrUnsupportedCurve) || !strings.Contains(err.Error(), "secp256k1") {
+		t.Errorf("secp256k1 key: %v, want ErrUnsupportedCurve naming the curve", err)
+	}
+	for _, curve := range []elliptic.Curve{elliptic.P224(), elliptic.P256(), elliptic.P384(), elliptic.P521()} {
+		if err := checkKeySupported(&ecdsa.PublicKey{Curve: curve}); err != nil {
+			t.Errorf("%s: %v", curve.Params().Name, err)
+		}
+	}
+	if err := checkKeySupported(mustGenerateKey(t, KeyEd25519).Public()); err != nil {
+		t.Errorf("Ed25519: %v", err)
+	}
+}
@@ -0,0 +1,50 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto"
+	"fmt"
+	"net/url"
+)
+
+// KeyStore generates keys inside a hardware token, so they never leave
+// it, e.g. a PKCS#11 module wrapped by the caller: the package takes no
+// dependency on a PKCS#11 binding. See Config.KeyStore.
+type KeyStore interface {
+	// GenerateKey creates a key of type t in the token under label and
+	// returns the signer backed by it, which signs the CSR.
+	GenerateKey(t KeyType, label string) (crypto.Signer, error)
+}
+
+// generateInStore creates the key of cfg.KeyLabel in cfg.KeyStore.
+func (cfg Config) generateInStore() (crypto.Signer, error) {
+	if cfg.KeyLabel == "" {
+		return nil, fmt.Errorf("ezb_lib/certmanager: a KeyStore needs a KeyLabel")
+	}
+	priv, err := cfg.KeyStore.GenerateKey(cfg.TargetKeyType, cfg.KeyLabel)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key %q in the key store: %w", cfg.KeyLabel, err)
+	}
+	return priv, nil
+}
+
+// KeyReference returns the RFC 7512 PKCS#11 URI naming the token object
+// label, e.g. "pkcs11:object=web%20server", which the key file holds in
+// place of a PEM key when Config.KeyStore is set.
+func KeyReference(label string) string {
+	return "pkcs11:object=" + url.PathEscape(label)
+}
@@ -0,0 +1,83 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// tokenSigner hides the key it wraps, as a PKCS#11 signer does.
+type tokenSigner struct{ key crypto.Signer }
+
+func (s tokenSigner) Public() crypto.PublicKey { return s.key.Public() }
+
+func (s tokenSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return s.key.Sign(rand, digest, opts)
+}
+
+// fakeToken is a KeyStore keeping its keys by label.
+type fakeToken map[string]crypto.Signer
+
+func (tok fakeToken) GenerateKey(t KeyType, label string) (crypto.Signer, error) {
+	key, err := generateKey(t)
+	if err != nil {
+		return nil, err
+	}
+	tok[label] = key
+	return tokenSigner{key}, nil
+}
+
+func TestKeyStore(t *testing.T) {
+	pki := newFakePKI(t)
+	dir := t.TempDir()
+	token := fakeToken{}
+	cfg := Config{KeyStore: token, KeyLabel: "web server", WriteMetadata: true}
+	result, err := GenerateInDir(newCertificateRequest("node", 1, nil), pki.addr(), dir, "node", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, ok := token["web server"]
+	if !ok || checkKeyMatch(result.Certificate, key.Public()) != nil {
+		t.Fatalf("certificate doesn't hold the token key %q", "web server")
+	}
+	if result.KeyLabel != "web server" {
+		t.Errorf("KeyLabel = %q", result.KeyLabel)
+	}
+	if data, err := os.ReadFile(result.KeyFile); err != nil || string(data) != "pkcs11:object=web%20server\n" {
+		t.Errorf("key file = %q, %v, want the key reference", data, err)
+	}
+	data, err := os.ReadFile(MetadataPath(result.CertFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var meta Metadata
+	if err := json.Unmarshal(data, &meta); err != nil || meta.KeyReference != KeyReference("web server") {
+		t.Errorf("metadata key reference = %q, %v", meta.KeyReference, err)
+	}
+
+	if _, err := generate(newCertificateRequest("node", 1, nil), pki.addr(), filepath.Join(dir, "other.crt"), "", filepath.Join(dir, "other.ca.crt"), cfg); err != nil {
+		t.Errorf("without a key file: %v", err)
+	}
+	cfg.KeyLabel = ""
+	if _, err := EnrollSigner(newCertificateRequest("node", 1, nil), pki.addr(), cfg); err == nil {
+		t.Error("KeyStore without a label accepted")
+	}
+}
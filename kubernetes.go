@@ -0,0 +1,62 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net"
+)
+
+// defaultClusterDomain is the cluster domain of a stock Kubernetes install.
+const defaultClusterDomain = "cluster.local"
+
+// KubernetesAddresses returns the SANs a Kubernetes service is reached by:
+// service, service.namespace, service.namespace.svc and the fully
+// qualified service.namespace.svc.clusterDomain, followed by podIP when
+// set. clusterDomain defaults to cluster.local.
+func KubernetesAddresses(service, namespace, clusterDomain, podIP string) ([]string, error) {
+	if service == "" || namespace == "" {
+		return nil, fmt.Errorf("ezb_lib/certmanager: service and namespace are required")
+	}
+	if clusterDomain == "" {
+		clusterDomain = defaultClusterDomain
+	}
+	addresses := []string{
+		service,
+		service + "." + namespace,
+		service + "." + namespace + ".svc",
+		service + "." + namespace + ".svc." + clusterDomain,
+	}
+	if podIP != "" {
+		if net.ParseIP(podIP) == nil {
+			return nil, fmt.Errorf("ezb_lib/certmanager: invalid pod IP %q", podIP)
+		}
+		addresses = append(addresses, podIP)
+	}
+	return addresses, nil
+}
+
+// NewKubernetesCertificateRequest builds the CSR template of a Kubernetes
+// service identity, using the fully qualified service name as CommonName
+// and KubernetesAddresses as SANs.
+func NewKubernetesCertificateRequest(service, namespace, clusterDomain, podIP string, duration int) (*x509.CertificateRequest, error) {
+	addresses, err := KubernetesAddresses(service, namespace, clusterDomain, podIP)
+	if err != nil {
+		return nil, err
+	}
+	return newCertificateRequest(addresses[3], duration, addresses), nil
+}
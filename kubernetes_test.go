@@ -0,0 +1,57 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"net"
+	"slices"
+	"testing"
+)
+
+func TestKubernetesAddresses(t *testing.T) {
+	for _, test := range []struct {
+		name                              string
+		service, namespace, domain, podIP string
+		want                              []string
+		fails                             bool
+	}{
+		{"defaults", "api", "prod", "", "", []string{"api", "api.prod", "api.prod.svc", "api.prod.svc.cluster.local"}, false},
+		{"domain and pod IP", "api", "prod", "k8s.example", "10.1.2.3", []string{"api", "api.prod", "api.prod.svc", "api.prod.svc.k8s.example", "10.1.2.3"}, false},
+		{"no service", "", "prod", "", "", nil, true},
+		{"no namespace", "api", "", "", "", nil, true},
+		{"bad pod IP", "api", "prod", "", "10.1.2", nil, true},
+	} {
+		got, err := KubernetesAddresses(test.service, test.namespace, test.domain, test.podIP)
+		if (err != nil) != test.fails || !slices.Equal(got, test.want) {
+			t.Errorf("%s: KubernetesAddresses = %q, %v, want %q", test.name, got, err, test.want)
+		}
+	}
+}
+
+func TestNewKubernetesCertificateRequest(t *testing.T) {
+	request, err := NewKubernetesCertificateRequest("api", "prod", "", "10.1.2.3", 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.Subject.CommonName != "api.prod.svc.cluster.local" ||
+		!slices.Equal(request.DNSNames, []string{"api", "api.prod", "api.prod.svc", "api.prod.svc.cluster.local"}) ||
+		len(request.IPAddresses) != 1 || !request.IPAddresses[0].Equal(net.ParseIP("10.1.2.3")) {
+		t.Errorf("request for %v with %q and %v", request.Subject, request.DNSNames, request.IPAddresses)
+	}
+	if _, err := NewKubernetesCertificateRequest("api", "", "", "", 30); err == nil {
+		t.Error("request without a namespace built")
+	}
+}
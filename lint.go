@@ -0,0 +1,54 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto/x509"
+	"fmt"
+	"time"
+)
+
+// maxLeafValidity is the longest validity Lint accepts for a leaf
+// certificate, the 398 days browsers enforce for TLS servers.
+const maxLeafValidity = 398 * 24 * time.Hour
+
+// Lint returns human readable warnings about the deprecated or discouraged
+// properties of cert: an MD5 or SHA-1 signature, a key weaker than the
+// defaults of KeyPolicy, a leaf certificate without SANs relying on its
+// CommonName or valid for more than 398 days, and a missing key usage. It
+// returns nil for a clean certificate.
+func Lint(cert *x509.Certificate) []string {
+	var warnings []string
+	switch cert.SignatureAlgorithm {
+	case x509.MD2WithRSA, x509.MD5WithRSA, x509.SHA1WithRSA, x509.DSAWithSHA1, x509.ECDSAWithSHA1:
+		warnings = append(warnings, fmt.Sprintf("signed with the deprecated %v algorithm", cert.SignatureAlgorithm))
+	}
+	if (KeyPolicy{}).check(cert.PublicKey) != nil {
+		warnings = append(warnings, fmt.Sprintf("%s key below the minimum strength", publicKeyAlgorithm(cert.PublicKey)))
+	}
+	if !cert.IsCA {
+		if len(sanStrings(cert.DNSNames, cert.IPAddresses, cert.EmailAddresses, cert.URIs)) == 0 {
+			warnings = append(warnings, "no subject alternative name, relying on the deprecated CommonName")
+		}
+		if validity := cert.NotAfter.Sub(cert.NotBefore); validity > maxLeafValidity {
+			warnings = append(warnings, fmt.Sprintf("validity of %d days, more than %d", int(validity.Hours()/24), int(maxLeafValidity.Hours()/24)))
+		}
+	}
+	if cert.KeyUsage == 0 {
+		warnings = append(warnings, "no key usage")
+	}
+	return warnings
+}
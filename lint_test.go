@@ -0,0 +1,54 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestLint(t *testing.T) {
+	now := time.Now()
+	clean := &x509.Certificate{
+		SignatureAlgorithm: x509.ECDSAWithSHA256,
+		PublicKey:          mustGenerateKey(t, KeyECDSAP256).Public(),
+		DNSNames:           []string{"node.example"},
+		NotBefore:          now,
+		NotAfter:           now.Add(90 * 24 * time.Hour),
+		KeyUsage:           x509.KeyUsageDigitalSignature,
+	}
+	if warnings := Lint(clean); warnings != nil {
+		t.Errorf("clean certificate: %q", warnings)
+	}
+	weak := new(big.Int).Lsh(big.NewInt(1), 1023)
+	dirty := &x509.Certificate{
+		SignatureAlgorithm: x509.SHA1WithRSA,
+		PublicKey:          &rsa.PublicKey{N: weak.Add(weak, big.NewInt(1)), E: 65537},
+		NotBefore:          now,
+		NotAfter:           now.Add(2 * 365 * 24 * time.Hour),
+	}
+	if warnings := Lint(dirty); len(warnings) != 5 {
+		t.Errorf("dirty certificate: %q, want 5 warnings", warnings)
+	}
+	ca := *dirty
+	ca.IsCA = true
+	if warnings := Lint(&ca); len(warnings) != 3 {
+		t.Errorf("CA certificate: %q, want 3 warnings", warnings)
+	}
+}
@@ -0,0 +1,84 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// SignCSRLocally signs the PEM encoded CSR with rootCert and rootKey and
+// returns the DER certificate, valid from now for duration. It is the
+// server side of the exchange, for tests and disconnected PKIs, and lets
+// integrators build a simple signer without the network protocol. The CSR
+// signature must verify, or ErrBadCSR is returned. The subject and SANs
+// are copied from the CSR; its other extensions are ignored, the
+// certificate being valid for client and server authentication.
+func SignCSRLocally(csrPEM []byte, rootCert *x509.Certificate, rootKey crypto.Signer, duration time.Duration) ([]byte, error) {
+	if duration <= 0 {
+		return nil, fmt.Errorf("ezb_lib/certmanager: invalid validity %s", duration)
+	}
+	now := time.Now()
+	// Tolerate some clock skew between the signer and its clients.
+	return SignCSRLocallyBetween(csrPEM, rootCert, rootKey, now.Add(-5*time.Minute), now.Add(duration))
+}
+
+// SignCSRLocallyBetween is SignCSRLocally with the exact validity window
+// notBefore to notAfter, e.g. for reproducible test fixtures or certificates
+// dated ahead for a staged rollout. notBefore must come before notAfter.
+func SignCSRLocallyBetween(csrPEM []byte, rootCert *x509.Certificate, rootKey crypto.Signer, notBefore, notAfter time.Time) ([]byte, error) {
+	if !notBefore.Before(notAfter) {
+		return nil, fmt.Errorf("ezb_lib/certmanager: invalid validity from %s to %s", notBefore.Format(time.RFC3339), notAfter.Format(time.RFC3339))
+	}
+	block, _ := pem.Decode(csrPEM)
+	if block == nil || (block.Type != "CERTIFICATE REQUEST" && block.Type != "NEW CERTIFICATE REQUEST") {
+		return nil, fmt.Errorf("%w: no certificate request found", ErrBadCSR)
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadCSR, err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadCSR, err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	keyUsage := x509.KeyUsageDigitalSignature
+	if _, ok := csr.PublicKey.(*rsa.PublicKey); ok {
+		keyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	template := &x509.Certificate{
+		SerialNumber:   serial,
+		Subject:        csr.Subject,
+		DNSNames:       csr.DNSNames,
+		IPAddresses:    csr.IPAddresses,
+		EmailAddresses: csr.EmailAddresses,
+		URIs:           csr.URIs,
+		NotBefore:      notBefore,
+		NotAfter:       notAfter,
+		KeyUsage:       keyUsage,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	return x509.CreateCertificate(rand.Reader, template, rootCert, csr.PublicKey, rootKey)
+}
@@ -0,0 +1,124 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSignCSRLocally(t *testing.T) {
+	root, rootKey := newFakeCA(t, "fake root", nil, nil)
+	priv, err := generateKey(KeyECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := createCSR(newCertificateRequest("node", 1, []string{"node.example.com"}), priv, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+	certDER, err := SignCSRLocally(csrPEM, root, rootKey, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validateCertificate(Config{}, cert, root, nil); err != nil {
+		t.Error(err)
+	}
+	if err := checkKeyMatch(cert, priv.Public()); err != nil {
+		t.Error(err)
+	}
+	if len(cert.DNSNames) != 1 || cert.DNSNames[0] != "node.example.com" {
+		t.Errorf("DNS SANs = %v", cert.DNSNames)
+	}
+
+	// The signature closes the DER encoding.
+	der[len(der)-1] ^= 0xff
+	csrPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+	if _, err := SignCSRLocally(csrPEM, root, rootKey, time.Hour); !errors.Is(err, ErrBadCSR) {
+		t.Errorf("corrupted CSR: %v, want ErrBadCSR", err)
+	}
+}
+
+func TestBuildVerifyOptions(t *testing.T) {
+	root, rootKey := newFakeCA(t, "fake root", nil, nil)
+	priv, err := generateKey(KeyECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := createCSR(newCertificateRequest("node", 1, nil), priv, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	certDER, err := SignCSRLocally(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), root, rootKey, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		cfg  Config
+		ok   bool
+	}{
+		{"defaults", Config{}, true},
+		{"server auth", Config{ExtKeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}, true},
+		{"code signing", Config{ExtKeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning}}, false},
+		{"after expiry", Config{VerifyAt: time.Now().Add(2 * time.Hour)}, false},
+	}
+	for _, test := range tests {
+		if _, err := cert.Verify(buildVerifyOptions(test.cfg, root, nil)); (err == nil) != test.ok {
+			t.Errorf("%s: %v, want ok %v", test.name, err, test.ok)
+		}
+	}
+}
+
+func TestSignCSRLocallyBetween(t *testing.T) {
+	root, rootKey := newFakeCA(t, "fake root", nil, nil)
+	der, err := createCSR(newCertificateRequest("node", 1, nil), mustGenerateKey(t, KeyECDSAP256), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+	notBefore := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	notAfter := notBefore.AddDate(0, 3, 0)
+	certDER, err := SignCSRLocallyBetween(csrPEM, root, rootKey, notBefore, notAfter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cert.NotBefore.Equal(notBefore) || !cert.NotAfter.Equal(notAfter) {
+		t.Errorf("validity %v to %v, want %v to %v", cert.NotBefore, cert.NotAfter, notBefore, notAfter)
+	}
+	if _, err := SignCSRLocallyBetween(csrPEM, root, rootKey, notAfter, notBefore); err == nil {
+		t.Error("inverted validity accepted")
+	}
+	if _, err := SignCSRLocallyBetween(csrPEM, root, rootKey, notBefore, notBefore); err == nil {
+		t.Error("empty validity accepted")
+	}
+}
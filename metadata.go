@@ -0,0 +1,102 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Metadata is the JSON document written next to the certificate when
+// Config.WriteMetadata is set, for inventory tools that don't parse
+// certificates.
+type Metadata struct {
+	Serial              string    `json:"serial"`
+	Subject             string    `json:"subject"`
+	Issuer              string    `json:"issuer"`
+	SANs                []string  `json:"sans,omitempty"`
+	SHA256Fingerprint   string    `json:"sha256_fingerprint"`
+	CASHA256Fingerprint string    `json:"ca_sha256_fingerprint,omitempty"`
+	NotBefore           time.Time `json:"not_before"`
+	NotAfter            time.Time `json:"not_after"`
+	IssuedAt            time.Time `json:"issued_at"`
+	// RequestedValidity is Config.RequestedValidity in seconds.
+	RequestedValidity int64 `json:"requested_validity,omitempty"`
+	// KeyReference names the key held by Config.KeyStore, see
+	// KeyReference.
+	KeyReference string `json:"key_reference,omitempty"`
+}
+
+// MetadataPath returns the path of the metadata file of certFile: its
+// name with the extension replaced by .meta.json.
+func MetadataPath(certFile string) string {
+	return strings.TrimSuffix(certFile, filepath.Ext(certFile)) + ".meta.json"
+}
+
+// newMetadata describes the enrollment of result.
+func newMetadata(result EnrollResult, cfg Config) Metadata {
+	meta := Metadata{
+		Serial:            result.Info.Serial,
+		Subject:           result.Certificate.Subject.String(),
+		Issuer:            result.Info.Issuer,
+		SANs:              result.Info.SANs,
+		SHA256Fingerprint: result.Info.SHA256Fingerprint,
+		NotBefore:         result.Info.NotBefore,
+		NotAfter:          result.Info.NotAfter,
+		IssuedAt:          time.Now().UTC(),
+		RequestedValidity: int64(cfg.RequestedValidity / time.Second),
+	}
+	if result.CA != nil {
+		meta.CASHA256Fingerprint = fingerprint(result.CA)
+	}
+	if result.KeyLabel != "" {
+		meta.KeyReference = KeyReference(result.KeyLabel)
+	}
+	return meta
+}
+
+// stageMetadata writes the metadata of result to a temporary file next to
+// MetadataPath(certFile) and returns its name, to be renamed once the
+// other artifacts are written. It returns "" when cfg.WriteMetadata is
+// unset.
+func stageMetadata(certFile string, result EnrollResult, cfg Config) (string, error) {
+	if !cfg.WriteMetadata {
+		return "", nil
+	}
+	data, err := json.MarshalIndent(newMetadata(result, cfg), "", "  ")
+	if err != nil {
+		return "", err
+	}
+	name, err := tempPath(MetadataPath(certFile))
+	if err != nil {
+		return "", err
+	}
+	f, err := createFile(name, os.O_WRONLY|os.O_TRUNC, cfg.certMode())
+	if err == nil {
+		_, err = f.Write(append(data, '\n'))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		os.Remove(name)
+		return "", err
+	}
+	return name, nil
+}
@@ -0,0 +1,94 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto/subtle"
+	"crypto/x509"
+	"fmt"
+	"strings"
+)
+
+// MatchesFingerprint reports whether the SHA-256 fingerprint of cert is
+// pin, given in hex with or without colons, in any case.
+// Fingerprints are public, so a plain comparison is used: its timing
+// doesn't leak anything secret.
+func MatchesFingerprint(cert *x509.Certificate, pin string) bool {
+	normalized := strings.ToLower(strings.ReplaceAll(pin, ":", ""))
+	return normalized == fingerprint(cert)
+}
+
+// ValidEnrollmentToken reports whether the token presented by a node
+// matches the expected one. The comparison runs in constant time, so a
+// signer checking tokens doesn't reveal how many leading bytes were right.
+func ValidEnrollmentToken(presented, expected string) bool {
+	if expected == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(presented), []byte(expected)) == 1
+}
+
+// TrustMode decides which root certificate enrollments are verified
+// against and written to the CA file, see Config.TrustMode.
+type TrustMode string
+
+// Trust modes. TrustTOFU is the default.
+const (
+	// TrustTOFU trusts the root sent by the PKI, trust on first use.
+	TrustTOFU TrustMode = "tofu"
+	// TrustPinned accepts the root sent by the PKI only when it matches
+	// Config.RootPin, or the certificate in Config.RootCAFile when no pin
+	// is set.
+	TrustPinned TrustMode = "pinned"
+	// TrustPreconfigured ignores the root sent by the PKI and uses the
+	// one in Config.RootCAFile instead.
+	TrustPreconfigured TrustMode = "preconfigured"
+)
+
+// trustedRoot returns the root to verify against in place of received,
+// the root sent by the PKI, according to cfg.TrustMode.
+func (cfg Config) trustedRoot(received *x509.Certificate) (*x509.Certificate, error) {
+	switch cfg.TrustMode {
+	case "", TrustTOFU:
+		return received, nil
+	case TrustPinned:
+		if cfg.RootPin != "" {
+			if !MatchesFingerprint(received, cfg.RootPin) {
+				return nil, fmt.Errorf("%w: %q has fingerprint %s, not the pinned one", ErrUntrustedRoot, received.Subject, fingerprint(received))
+			}
+			return received, nil
+		}
+		local, err := cfg.localRoot()
+		if err != nil {
+			return nil, err
+		}
+		if !received.Equal(local) {
+			return nil, fmt.Errorf("%w: %q differs from the root of %s", ErrUntrustedRoot, received.Subject, cfg.RootCAFile)
+		}
+		return received, nil
+	case TrustPreconfigured:
+		return cfg.localRoot()
+	}
+	return nil, fmt.Errorf("ezb_lib/certmanager: unknown trust mode %q", cfg.TrustMode)
+}
+
+// localRoot loads the root certificate of cfg.RootCAFile.
+func (cfg Config) localRoot() (*x509.Certificate, error) {
+	if cfg.RootCAFile == "" {
+		return nil, fmt.Errorf("ezb_lib/certmanager: %s trust mode requires a RootCAFile", cfg.TrustMode)
+	}
+	return loadCertificate(cfg.RootCAFile)
+}
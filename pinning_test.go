@@ -0,0 +1,103 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTrustMode(t *testing.T) {
+	pki := newFakePKI(t)
+	dir := t.TempDir()
+	rootFile, otherFile := filepath.Join(dir, "root.crt"), filepath.Join(dir, "other.crt")
+	other, _ := newFakeCA(t, "other root", nil, nil)
+	if err := writePEMFile(rootFile, 0644, pki.root); err != nil {
+		t.Fatal(err)
+	}
+	if err := writePEMFile(otherFile, 0644, other); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		cfg  Config
+		want func(error) bool
+	}{
+		{"TOFU", Config{}, nil},
+		{"pinned fingerprint", Config{TrustMode: TrustPinned, RootPin: strings.ToUpper(fingerprint(pki.root))}, nil},
+		{"other fingerprint", Config{TrustMode: TrustPinned, RootPin: fingerprint(other)}, func(err error) bool { return errors.Is(err, ErrUntrustedRoot) }},
+		{"pinned file", Config{TrustMode: TrustPinned, RootCAFile: rootFile}, nil},
+		{"other file", Config{TrustMode: TrustPinned, RootCAFile: otherFile}, func(err error) bool { return errors.Is(err, ErrUntrustedRoot) }},
+		{"preconfigured", Config{TrustMode: TrustPreconfigured, RootCAFile: rootFile}, nil},
+		{"preconfigured other", Config{TrustMode: TrustPreconfigured, RootCAFile: otherFile}, func(err error) bool { return errors.Is(err, ErrBrokenChain) }},
+		{"preconfigured without file", Config{TrustMode: TrustPreconfigured}, func(err error) bool { return err != nil }},
+	}
+	for _, test := range tests {
+		result, err := EnrollSigner(newCertificateRequest("node", 1, nil), pki.addr(), test.cfg)
+		if test.want == nil && (err != nil || !result.CA.Equal(pki.root)) || test.want != nil && !test.want(err) {
+			t.Errorf("%s: %v", test.name, err)
+		}
+	}
+}
+
+func TestMatchesFingerprint(t *testing.T) {
+	pki := newFakePKI(t)
+	other, _ := newFakeCA(t, "other root", nil, nil)
+	hex := fingerprint(pki.root)
+	var pairs []string
+	for i := 0; i < len(hex); i += 2 {
+		pairs = append(pairs, hex[i:i+2])
+	}
+	colons := strings.Join(pairs, ":")
+	for _, test := range []struct {
+		name, pin string
+		want      bool
+	}{
+		{"lower case", hex, true},
+		{"upper case", strings.ToUpper(hex), true},
+		{"colons", colons, true},
+		{"upper case colons", strings.ToUpper(colons), true},
+		{"other certificate", fingerprint(other), false},
+		{"truncated", hex[:len(hex)-2], false},
+		{"spaces", strings.Join(pairs, " "), false},
+		{"empty", "", false},
+	} {
+		if got := MatchesFingerprint(pki.root, test.pin); got != test.want {
+			t.Errorf("%s: MatchesFingerprint(%q) = %v, want %v", test.name, test.pin, got, test.want)
+		}
+	}
+}
+
+func TestValidEnrollmentToken(t *testing.T) {
+	for _, test := range []struct {
+		name, presented, expected string
+		want                      bool
+	}{
+		{"match", "s3cret-token", "s3cret-token", true},
+		{"mismatch", "s3cret-tokem", "s3cret-token", false},
+		{"prefix", "s3cret", "s3cret-token", false},
+		{"case", "S3CRET-TOKEN", "s3cret-token", false},
+		{"empty presented", "", "s3cret-token", false},
+		{"empty expected", "s3cret-token", "", false},
+		{"both empty", "", "", false},
+	} {
+		if got := ValidEnrollmentToken(test.presented, test.expected); got != test.want {
+			t.Errorf("%s: ValidEnrollmentToken(%q, %q) = %v, want %v", test.name, test.presented, test.expected, got, test.want)
+		}
+	}
+}
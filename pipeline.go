@@ -0,0 +1,163 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"bufio"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// maxBatchSize is the largest number of CSRs the two-byte count of a
+// pipelined enrollment can announce.
+const maxBatchSize = 0xFFFF
+
+// EnrollPipelined enrolls every request on a single connection, sparing
+// multi-identity nodes, e.g. with client and server certificates, one dial
+// and handshake per identity. It needs a PKI speaking ProtocolV3: the
+// client sends the batch operation, a frame holding the number of CSRs as
+// a little endian uint16 and the CSR frames, then the PKI answers each CSR
+// in order with a ProtocolV1 bundle.
+//
+// Like EnrollSigner nothing is persisted: each result holds its key in
+// EnrollResult.Key, Config.Key when set being used for every request. The
+// results come in the order of requests; any failure aborts the batch.
+func EnrollPipelined(ctx context.Context, requests []*x509.CertificateRequest, ezbpki string, cfg Config) (results []EnrollResult, err error) {
+	if cfg.Profile != "" {
+		return nil, fmt.Errorf("ezb_lib/certmanager: certificate profiles can't be used with pipelined enrollment")
+	}
+	if cfg.Key == nil && cfg.KeyStore != nil {
+		return nil, fmt.Errorf("ezb_lib/certmanager: a KeyStore label can't name the keys of pipelined enrollment")
+	}
+	if cfg.BootstrapKey != nil {
+		return nil, fmt.Errorf("%w: pipelined enrollment has no bootstrap authentication, request version %d at most", ErrProtocolVersion, ProtocolV4)
+	}
+	if cfg.ProtocolVersion >= ProtocolV5 {
+		return nil, fmt.Errorf("%w: pipelined enrollment has no proof of possession challenge, request version %d at most", ErrProtocolVersion, ProtocolV4)
+	}
+	if len(requests) > maxBatchSize {
+		return nil, fmt.Errorf("ezb_lib/certmanager: %d requests in a batch, limit is %d", len(requests), maxBatchSize)
+	}
+	keys := make([]crypto.Signer, 0, len(requests))
+	defer func() {
+		if err != nil && cfg.Key == nil {
+			for _, priv := range keys {
+				WipeKey(priv)
+			}
+		}
+	}()
+	defer func() {
+		if err != nil {
+			results = nil
+			cfg.finish(EnrollResult{}, err)
+			return
+		}
+		for i := range results {
+			if results[i], err = cfg.finish(results[i], nil); err != nil {
+				results = nil
+				return
+			}
+		}
+	}()
+	csrs := make([][]byte, len(requests))
+	for i, request := range requests {
+		priv, err := cfg.signer()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, priv)
+		if csrs[i], err = createCSR(request, priv, cfg); err != nil {
+			return nil, err
+		}
+	}
+	if len(csrs) == 0 {
+		return nil, nil
+	}
+
+	cfg.ProtocolVersion = max(cfg.ProtocolVersion, ProtocolV3)
+	conn, frames, err := dial(ctx, ezbpki, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			err = ctxError(ctx)
+		}
+	}()
+	if frames.version < ProtocolV3 {
+		return nil, fmt.Errorf("%w: pipelined enrollment needs version %d, PKI speaks %d", ErrProtocolVersion, ProtocolV3, frames.version)
+	}
+	timeouts := cfg.Timeouts
+	sendStart := time.Now()
+	if err := timeouts.begin(conn, PhaseSend, sendStart); err != nil {
+		return nil, err
+	}
+	if err := sendBatch(cfg.writer(conn), frames, csrs); err != nil {
+		return nil, timeouts.check(PhaseSend, err)
+	}
+	fmt.Printf("Transmitted %d Certificate Signing Requests to RootCA.\n", len(csrs))
+	reader := cfg.reader(conn)
+	for i, derBytes := range csrs {
+		if err := timeouts.begin(conn, PhaseReceiveCert, time.Now()); err != nil {
+			return nil, err
+		}
+		newCert, intermediates, rootCert, err := recvBundle(reader, frames)
+		if err != nil {
+			return nil, timeouts.check(PhaseReceiveCert, fmt.Errorf("request %d: %w", i, err))
+		}
+		stats := TransferStats{
+			CSRBytes:      len(derBytes),
+			CertBytes:     len(newCert.Raw),
+			RootCertBytes: len(rootCert.Raw),
+			RoundTrip:     time.Since(sendStart),
+		}
+		result, err := acceptIssued(derBytes, newCert, intermediates, rootCert, stats, frames, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("request %d: %w", i, err)
+		}
+		if err := checkKeyMatch(result.Certificate, keys[i].Public()); err != nil {
+			return nil, fmt.Errorf("request %d: %w", i, err)
+		}
+		result.Key = keys[i]
+		results = append(results, result)
+	}
+	fmt.Printf("Received %d certificate bundles from RootCA.\n", len(results))
+	return results, nil
+}
+
+// sendBatch transmits the batch operation, the number of CSRs and the DER
+// encoded CSRs, buffered so they leave in as few packets as possible.
+func sendBatch(writer *bufio.Writer, frames frameCodec, csrs [][]byte) error {
+	if err := frames.writeFrame(writer, []byte{opEnrollBatch}); err != nil {
+		return err
+	}
+	if err := frames.writeFrame(writer, binary.LittleEndian.AppendUint16(nil, uint16(len(csrs)))); err != nil {
+		return err
+	}
+	for _, derBytes := range csrs {
+		if err := frames.writeFrame(writer, frames.encodeCSR(derBytes)); err != nil {
+			return err
+		}
+	}
+	return flushFrames(writer)
+}
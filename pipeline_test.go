@@ -0,0 +1,63 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"testing"
+)
+
+func TestEnrollPipelined(t *testing.T) {
+	pki := newFakePKI(t)
+	pki.negotiate, pki.version = true, ProtocolV3
+	pki.withIntermediate()
+	requests := []*x509.CertificateRequest{
+		newCertificateRequest("client", 1, nil),
+		newCertificateRequest("server", 1, []string{"node.example.com"}),
+	}
+	results, err := EnrollPipelined(context.Background(), requests, pki.addr(), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(requests) {
+		t.Fatalf("%d results for %d requests", len(results), len(requests))
+	}
+	for i, result := range results {
+		if cn := result.Certificate.Subject.CommonName; cn != requests[i].Subject.CommonName {
+			t.Errorf("result %d is for %q, want %q", i, cn, requests[i].Subject.CommonName)
+		}
+		if len(result.Chain) != 1 {
+			t.Errorf("result %d has %d intermediates, want 1", i, len(result.Chain))
+		}
+		if err := checkKeyMatch(result.Certificate, result.Key.Public()); err != nil {
+			t.Errorf("result %d: %v", i, err)
+		}
+	}
+	if results[0].Key == results[1].Key {
+		t.Error("requests share a generated key")
+	}
+}
+
+func TestEnrollPipelinedOldPKI(t *testing.T) {
+	pki := newFakePKI(t)
+	pki.negotiate, pki.version = true, ProtocolV1
+	requests := []*x509.CertificateRequest{newCertificateRequest("client", 1, nil)}
+	if _, err := EnrollPipelined(context.Background(), requests, pki.addr(), Config{}); !errors.Is(err, ErrProtocolVersion) {
+		t.Errorf("pipelining with a ProtocolV1 PKI: %v, want ErrProtocolVersion", err)
+	}
+}
@@ -0,0 +1,64 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+)
+
+// oidCertificatePolicies is the certificatePolicies extension (RFC 5280).
+var oidCertificatePolicies = asn1.ObjectIdentifier{2, 5, 29, 32}
+
+type policyInformation struct {
+	Policy asn1.ObjectIdentifier
+}
+
+// PolicyExtension returns a certificatePolicies extension requesting the
+// given policies, e.g. assurance levels, to be added to
+// Config.ExtraExtensions. The CA remains free to ignore it.
+func PolicyExtension(policies ...asn1.ObjectIdentifier) (pkix.Extension, error) {
+	if len(policies) == 0 {
+		return pkix.Extension{}, fmt.Errorf("%w: no policy given", ErrInvalidOID)
+	}
+	infos := make([]policyInformation, 0, len(policies))
+	for _, oid := range policies {
+		if err := checkOID(oid); err != nil {
+			return pkix.Extension{}, err
+		}
+		infos = append(infos, policyInformation{Policy: oid})
+	}
+	value, err := asn1.Marshal(infos)
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+	return pkix.Extension{Id: oidCertificatePolicies, Value: value}, nil
+}
+
+// checkOID returns ErrInvalidOID unless oid follows the X.660 rules DER
+// encoding relies on.
+func checkOID(oid asn1.ObjectIdentifier) error {
+	if len(oid) < 2 || oid[0] > 2 || (oid[0] < 2 && oid[1] >= 40) {
+		return fmt.Errorf("%w: %s", ErrInvalidOID, oid)
+	}
+	for _, arc := range oid {
+		if arc < 0 {
+			return fmt.Errorf("%w: %s", ErrInvalidOID, oid)
+		}
+	}
+	return nil
+}
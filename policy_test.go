@@ -0,0 +1,64 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPolicyExtension(t *testing.T) {
+	policies := []asn1.ObjectIdentifier{{2, 23, 140, 1, 2, 1}, {1, 3, 6, 1, 4, 1, 99999, 3, 1}}
+	ext, err := PolicyExtension(policies...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := mustGenerateKey(t, KeyECDSAP256)
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(1),
+		Subject:         pkix.Name{CommonName: "node"},
+		NotBefore:       time.Now(),
+		NotAfter:        time.Now().Add(time.Hour),
+		ExtraExtensions: []pkix.Extension{ext},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.EqualFunc(cert.PolicyIdentifiers, policies, asn1.ObjectIdentifier.Equal) {
+		t.Errorf("policies %v, want %v", cert.PolicyIdentifiers, policies)
+	}
+
+	for _, oid := range []asn1.ObjectIdentifier{{1}, {3, 1}, {1, 40}, {0, 39, -1}} {
+		if _, err := PolicyExtension(policies[0], oid); !errors.Is(err, ErrInvalidOID) {
+			t.Errorf("%v: %v, want ErrInvalidOID", oid, err)
+		}
+	}
+	if _, err := PolicyExtension(); !errors.Is(err, ErrInvalidOID) {
+		t.Errorf("no policy: %v, want ErrInvalidOID", err)
+	}
+}
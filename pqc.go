@@ -0,0 +1,202 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// KeyHybridP256MLDSA65 is an EXPERIMENTAL key type pairing an ECDSA P-256
+// key with an ML-DSA-65 (FIPS 204) one, see HybridKey. Whether the ML-DSA
+// half ends up in the certificate depends entirely on the CA: one unaware
+// of the alternative key extensions ignores them and certifies the ECDSA
+// key alone. The encoding may change with the post-quantum standards, and
+// generating or loading such keys needs a build with Go 1.27 or later
+// (crypto/mldsa); older builds fail with ErrPostQuantumUnavailable.
+const KeyHybridP256MLDSA65 KeyType = "ECDSA-P256+ML-DSA-65"
+
+// Alternative public key extensions of X.509 (ITU-T X.509 (10/2019) 9.8),
+// carrying a second key and signature along the classical ones.
+var (
+	oidSubjectAltPublicKeyInfo = asn1.ObjectIdentifier{2, 5, 29, 72}
+	oidAltSignatureAlgorithm   = asn1.ObjectIdentifier{2, 5, 29, 73}
+	oidAltSignatureValue       = asn1.ObjectIdentifier{2, 5, 29, 74}
+	oidExtensionRequest        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 14}
+)
+
+// HybridKey is an EXPERIMENTAL signer pairing a classical ECDSA key with a
+// post-quantum ML-DSA one, as generated for KeyHybridP256MLDSA65. It signs
+// as its classical half, so it enrolls wherever an ECDSA key does; the CSR
+// additionally carries the ML-DSA public key and an alternative signature
+// made with it. The key file holds the ML-DSA key in a PKCS#8 block after
+// the ECDSA one, so tools reading the first key only keep working.
+type HybridKey struct {
+	Classical *ecdsa.PrivateKey
+	// PostQuantum is an *mldsa.PrivateKey.
+	PostQuantum crypto.Signer
+}
+
+// Public returns the public key of the classical half.
+func (k *HybridKey) Public() crypto.PublicKey {
+	return k.Classical.Public()
+}
+
+// Sign signs digest with the classical half.
+func (k *HybridKey) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return k.Classical.Sign(rand, digest, opts)
+}
+
+// algorithm names both halves, e.g. "ECDSA-P256+ML-DSA-65".
+func (k *HybridKey) algorithm() string {
+	return publicKeyAlgorithm(k.Classical.Public()) + "+" + postQuantumAlgorithm(k.PostQuantum.Public())
+}
+
+// withPostQuantumKey returns the HybridKey made of classical and the
+// ML-DSA key of the PEM block heading rest, or classical alone when rest
+// holds none.
+func withPostQuantumKey(classical *ecdsa.PrivateKey, rest []byte) crypto.Signer {
+	block, _ := pem.Decode(rest)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return classical
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	postQuantum, ok := key.(crypto.Signer)
+	if err != nil || !ok || !isPostQuantum(postQuantum.Public()) {
+		return classical
+	}
+	return &HybridKey{Classical: classical, PostQuantum: postQuantum}
+}
+
+// createHybridCSR creates the request for template signed by the classical
+// half of key, with the ML-DSA public key and the alternative signature of
+// the request without that signature in the extension request.
+func createHybridCSR(template *x509.CertificateRequest, key *HybridKey) ([]byte, error) {
+	spki, err := x509.MarshalPKIXPublicKey(key.PostQuantum.Public())
+	if err != nil {
+		return nil, err
+	}
+	var info struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(spki, &info); err != nil {
+		return nil, err
+	}
+	algorithm, err := asn1.Marshal(info.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	request := *template
+	request.ExtraExtensions = append(slices.Clip(template.ExtraExtensions),
+		pkix.Extension{Id: oidSubjectAltPublicKeyInfo, Value: spki},
+		pkix.Extension{Id: oidAltSignatureAlgorithm, Value: algorithm})
+	if err := checkDuplicateExtensions(request.ExtraExtensions); err != nil {
+		return nil, err
+	}
+	preTBS, err := x509.CreateCertificateRequest(rand.Reader, &request, key.Classical)
+	if err != nil {
+		return nil, err
+	}
+	pre, err := x509.ParseCertificateRequest(preTBS)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := key.PostQuantum.Sign(rand.Reader, pre.RawTBSCertificateRequest, crypto.Hash(0))
+	if err != nil {
+		return nil, err
+	}
+	value, err := asn1.Marshal(asn1.BitString{Bytes: signature, BitLength: len(signature) * 8})
+	if err != nil {
+		return nil, err
+	}
+	request.ExtraExtensions = append(request.ExtraExtensions, pkix.Extension{Id: oidAltSignatureValue, Value: value})
+	der, err := x509.CreateCertificateRequest(rand.Reader, &request, key.Classical)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAltSignature(der); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadCSR, err)
+	}
+	return der, nil
+}
+
+// checkAltSignature verifies the alternative ML-DSA signature of the DER
+// request der against its subjectAltPublicKeyInfo.
+func checkAltSignature(der []byte) error {
+	var csr rawCertificateRequest
+	if _, err := asn1.Unmarshal(der, &csr); err != nil {
+		return err
+	}
+	var info rawCertificateRequestInfo
+	if _, err := asn1.Unmarshal(csr.TBSCSR.FullBytes, &info); err != nil {
+		return err
+	}
+	var spki []byte
+	var signature asn1.BitString
+	for i, raw := range info.RawAttributes {
+		var attr csrAttribute
+		if _, err := asn1.Unmarshal(raw.FullBytes, &attr); err != nil {
+			return err
+		}
+		if !attr.Type.Equal(oidExtensionRequest) || len(attr.Values) != 1 {
+			continue
+		}
+		var extensions []pkix.Extension
+		if _, err := asn1.Unmarshal(attr.Values[0].FullBytes, &extensions); err != nil {
+			return err
+		}
+		extensions = slices.DeleteFunc(extensions, func(ext pkix.Extension) bool {
+			switch {
+			case ext.Id.Equal(oidSubjectAltPublicKeyInfo):
+				spki = ext.Value
+			case ext.Id.Equal(oidAltSignatureValue):
+				_, err := asn1.Unmarshal(ext.Value, &signature)
+				return err == nil
+			}
+			return false
+		})
+		value, err := asn1.Marshal(extensions)
+		if err != nil {
+			return err
+		}
+		attr.Values[0] = asn1.RawValue{FullBytes: value}
+		if info.RawAttributes[i].FullBytes, err = asn1.Marshal(attr); err != nil {
+			return err
+		}
+	}
+	if spki == nil || signature.Bytes == nil {
+		return errors.New("no alternative public key or signature")
+	}
+	pub, err := x509.ParsePKIXPublicKey(spki)
+	if err != nil {
+		return err
+	}
+	preTBS, err := asn1.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return verifyPostQuantum(pub, preTBS, signature.Bytes)
+}
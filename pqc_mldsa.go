@@ -0,0 +1,63 @@
+//go:build go1.27
+
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/mldsa"
+	"crypto/rand"
+	"fmt"
+)
+
+// generateHybridKey creates a new KeyHybridP256MLDSA65 key.
+func generateHybridKey() (*HybridKey, error) {
+	classical, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	postQuantum, err := mldsa.GenerateKey(mldsa.MLDSA65())
+	if err != nil {
+		return nil, err
+	}
+	return &HybridKey{Classical: classical, PostQuantum: postQuantum}, nil
+}
+
+// isPostQuantum reports whether pub is an ML-DSA key.
+func isPostQuantum(pub crypto.PublicKey) bool {
+	_, ok := pub.(*mldsa.PublicKey)
+	return ok
+}
+
+// postQuantumAlgorithm names the parameter set of the ML-DSA key pub.
+func postQuantumAlgorithm(pub crypto.PublicKey) string {
+	if k, ok := pub.(*mldsa.PublicKey); ok {
+		return k.Parameters().String()
+	}
+	return publicKeyAlgorithm(pub)
+}
+
+// verifyPostQuantum checks the ML-DSA signature of message by pub.
+func verifyPostQuantum(pub crypto.PublicKey, message, signature []byte) error {
+	k, ok := pub.(*mldsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("unsupported alternative %s key", publicKeyAlgorithm(pub))
+	}
+	return mldsa.Verify(k, message, signature, nil)
+}
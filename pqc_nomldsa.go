@@ -0,0 +1,37 @@
+//go:build !go1.27
+
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import "crypto"
+
+// generateHybridKey fails: crypto/mldsa needs Go 1.27.
+func generateHybridKey() (*HybridKey, error) {
+	return nil, ErrPostQuantumUnavailable
+}
+
+func isPostQuantum(crypto.PublicKey) bool {
+	return false
+}
+
+func postQuantumAlgorithm(pub crypto.PublicKey) string {
+	return publicKeyAlgorithm(pub)
+}
+
+func verifyPostQuantum(crypto.PublicKey, []byte, []byte) error {
+	return ErrPostQuantumUnavailable
+}
@@ -0,0 +1,66 @@
+//go:build go1.27
+
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestHybridKey(t *testing.T) {
+	pki := newFakePKI(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "hybrid.key")
+	if err := GenerateKeyPair(KeyHybridP256MLDSA65, path); err != nil {
+		t.Fatal(err)
+	}
+	if algo, err := KeyAlgorithm(path); err != nil || algo != string(KeyHybridP256MLDSA65) {
+		t.Errorf("KeyAlgorithm: %q, %v", algo, err)
+	}
+	priv, err := LoadPrivateKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := priv.(*HybridKey); !ok {
+		t.Fatalf("loaded a %T", priv)
+	}
+	der, err := createCSR(newCertificateRequest("pq", 1, nil), priv, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkAltSignature(der); err != nil {
+		t.Errorf("alternative signature: %v", err)
+	}
+	if _, err := createCSR(newCertificateRequest("pq", 1, nil), priv, Config{ChallengePassword: "secret"}); err == nil {
+		t.Error("challenge password accepted with a hybrid key")
+	}
+	classical, err := createCSR(newCertificateRequest("pq", 1, nil), priv.(*HybridKey).Classical, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkAltSignature(classical); err == nil {
+		t.Error("alternative signature found in a classical CSR")
+	}
+	result, err := GenerateInDir(newCertificateRequest("pq", 1, nil), pki.addr(), dir, "pq", Config{TargetKeyType: KeyHybridP256MLDSA65})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if algo, err := KeyAlgorithm(result.KeyFile); err != nil || algo != string(KeyHybridP256MLDSA65) {
+		t.Errorf("enrolled key: %q, %v", algo, err)
+	}
+}
@@ -0,0 +1,72 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// promLabelEscaper escapes label values for the Prometheus text format.
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// WritePrometheusMetrics writes the validity window of the certificates
+// stored in certFiles to w in the Prometheus text exposition format, as
+// the ezbastion_cert_not_before_seconds and
+// ezbastion_cert_not_after_seconds gauges in seconds since the epoch,
+// labelled with the cn, serial and issuer of each certificate.
+func WritePrometheusMetrics(w io.Writer, certFiles ...string) error {
+	infos := make([]CertInfo, 0, len(certFiles))
+	for _, certFile := range certFiles {
+		cert, err := loadCertificate(certFile)
+		if err != nil {
+			return err
+		}
+		infos = append(infos, NewCertInfo(cert))
+	}
+	var b bytes.Buffer
+	for _, family := range []struct {
+		name, help string
+		value      func(CertInfo) int64
+	}{
+		{"ezbastion_cert_not_before_seconds", "Start of the validity of the certificate, in seconds since the epoch.",
+			func(info CertInfo) int64 { return info.NotBefore.Unix() }},
+		{"ezbastion_cert_not_after_seconds", "Expiry of the certificate, in seconds since the epoch.",
+			func(info CertInfo) int64 { return info.NotAfter.Unix() }},
+	} {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", family.name, family.help, family.name)
+		for _, info := range infos {
+			fmt.Fprintf(&b, "%s{cn=\"%s\",serial=\"%s\",issuer=\"%s\"} %d\n", family.name,
+				promLabelEscaper.Replace(info.CommonName), info.Serial, promLabelEscaper.Replace(info.Issuer), family.value(info))
+		}
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// WritePrometheusTextfile writes the metrics of WritePrometheusMetrics to
+// path, for the textfile collector of node_exporter, e.g.
+// /var/lib/node_exporter/textfile/ezbastion.prom. The file is replaced
+// atomically so the collector never reads it half written.
+func WritePrometheusTextfile(path string, certFiles ...string) error {
+	var b bytes.Buffer
+	if err := WritePrometheusMetrics(&b, certFiles...); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, b.Bytes(), defaultCertMode)
+}
@@ -0,0 +1,64 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWritePrometheusTextfile(t *testing.T) {
+	pki := newFakePKI(t)
+	dir := t.TempDir()
+	var certFiles []string
+	var results []EnrollResult
+	for _, cn := range []string{"node", `say "hi"`} {
+		result, err := GenerateInDir(newCertificateRequest(cn, 1, nil), pki.addr(), dir, fmt.Sprint(len(results)), Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		certFiles = append(certFiles, result.CertFile)
+		results = append(results, result)
+	}
+	path := filepath.Join(dir, "ezbastion.prom")
+	if err := WritePrometheusTextfile(path, certFiles...); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := string(data)
+	if n := strings.Count(text, "# TYPE ezbastion_cert_not_after_seconds gauge\n"); n != 1 {
+		t.Errorf("%d TYPE lines for not_after", n)
+	}
+	for i, cn := range []string{`node`, `say \"hi\"`} {
+		info := results[i].Info
+		want := fmt.Sprintf("ezbastion_cert_not_after_seconds{cn=\"%s\",serial=\"%s\",issuer=\"%s\"} %d\n", cn, info.Serial, info.Issuer, info.NotAfter.Unix())
+		if !strings.Contains(text, want) {
+			t.Errorf("missing %q in\n%s", want, text)
+		}
+	}
+	if err := WritePrometheusTextfile(path, filepath.Join(dir, "missing.crt")); err == nil {
+		t.Error("missing certificate accepted")
+	}
+	if after, err := os.ReadFile(path); err != nil || string(after) != text {
+		t.Errorf("failed write replaced the textfile: %v", err)
+	}
+}
@@ -0,0 +1,310 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"bufio"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+)
+
+const (
+	// maxFrameSize is the largest payload a two-byte length header can describe.
+	maxFrameSize = 0xFFFF
+	// defaultMaxWideFrameSize bounds the frames accepted with four-byte
+	// headers when Config.MaxFrameSize is unset.
+	defaultMaxWideFrameSize = 1 << 20
+	// frameChunkSize bounds each write of a payload to the buffered
+	// writer, so large frames stream through its buffer instead of being
+	// copied whole behind their header.
+	frameChunkSize = 16 << 10
+)
+
+// Protocol versions. ProtocolLegacy sends the CSR straight away; later
+// versions start with a one byte handshake where the client announces the
+// version it wants and the PKI answers with the version it will speak.
+const (
+	// ProtocolLegacy is the original exchange: the PKI answers the CSR with
+	// a certificate frame followed by a root certificate frame.
+	ProtocolLegacy byte = 0
+	// ProtocolV1 has the PKI answer with a single frame holding a PEM
+	// bundle: the leaf first, then intermediates, the root last.
+	ProtocolV1 byte = 1
+	// ProtocolV2 starts each exchange with an operation frame, so requests
+	// other than enrollment, such as fetching the root, can be made.
+	ProtocolV2 byte = 2
+	// ProtocolV3 adds the pipelined enrollment of several CSRs on one
+	// connection, see EnrollPipelined.
+	ProtocolV3 byte = 3
+	// ProtocolV4 adds the enrollment with a certificate profile, sent in a
+	// frame between the operation and the CSR, see Config.Profile.
+	ProtocolV4 byte = 4
+	// ProtocolV5 adds a proof of possession challenge to enrollment: after
+	// the CSR the PKI sends a nonce frame, the client answers with a frame
+	// holding the nonce signed by its private key, see
+	// VerifyProofOfPossession, and only then is the bundle sent. The
+	// challenge runs within the send phase timeout. EnrollFromDir, having
+	// no private key, and EnrollPipelined can't speak it.
+	ProtocolV5 byte = 5
+	// ProtocolV6 adds the resumable CA bundle download, see
+	// Config.ResumableCA: the client sends the fetch operation and a frame
+	// holding the offset to start from, as a little endian uint64, and the
+	// PKI answers with chunk frames, each made of the chunk offset and the
+	// bundle total size, both little endian uint64, followed by the data.
+	ProtocolV6 byte = 6
+	// ProtocolV7 adds request IDs to enrollment: a frame holding the ID of
+	// the client, possibly empty, follows the operation and profile
+	// frames, and the PKI answers the CSR, after the challenge, with a
+	// frame holding the ID it logged the request under, echoing the one of
+	// the client or its own, before the bundle. See Config.RequestID.
+	ProtocolV7 byte = 7
+	// ProtocolV8 adds bootstrap authentication to enrollment: the CSR frame
+	// is followed by a frame holding the bootstrap certificate and one
+	// holding the signature of the CSR payload by its key, see
+	// VerifyBootstrapSignature, both empty when the client has none. See
+	// Config.BootstrapKey.
+	ProtocolV8 byte = 8
+	// ProtocolV9 adds the time query, see FetchCATime: the PKI answers the
+	// fetch time operation with a frame holding its current time in
+	// nanoseconds since the epoch, as a little endian int64.
+	ProtocolV9 byte = 9
+)
+
+// Operations announced in the first frame from ProtocolV2 on.
+const (
+	opEnroll      byte = 1
+	opFetchRoot   byte = 2
+	opEnrollBatch byte = 3
+	// opEnrollProfile is opEnroll with a profile frame before the CSR.
+	opEnrollProfile byte = 4
+	// opFetchCABundle fetches the PEM CA bundle from an offset.
+	opFetchCABundle byte = 5
+	// opFetchTime fetches the current time of the PKI.
+	opFetchTime byte = 6
+)
+
+// frameCodec reads and writes the length prefixed frames of the protocol.
+type frameCodec struct {
+	// version is the protocol version negotiated with the PKI.
+	version byte
+	// wide selects four-byte headers instead of two-byte ones.
+	wide bool
+	// max is the largest payload accepted in either direction.
+	max int
+	// psk, when set, seals every payload once the pre-shared key
+	// handshake is done.
+	psk *pskSession
+	// pem carries CSRs and certificates PEM encoded instead of DER.
+	pem bool
+}
+
+// frames returns the frame codec matching cfg.
+func (cfg Config) frames() frameCodec {
+	c := frameCodec{wide: cfg.WideFrames, max: maxFrameSize, pem: cfg.PEMPayloads}
+	if c.wide {
+		c.max = defaultMaxWideFrameSize
+	}
+	if cfg.MaxFrameSize > 0 && (cfg.MaxFrameSize < c.max || c.wide) {
+		c.max = cfg.MaxFrameSize
+	}
+	return c
+}
+
+// reader buffers r, the connection to the PKI, with cfg.ReadBufferSize.
+func (cfg Config) reader(r io.Reader) *bufio.Reader {
+	if cfg.ReadBufferSize > 0 {
+		return bufio.NewReaderSize(r, cfg.ReadBufferSize)
+	}
+	return bufio.NewReader(r)
+}
+
+// writer buffers w, the connection to the PKI, with cfg.WriteBufferSize.
+func (cfg Config) writer(w io.Writer) *bufio.Writer {
+	if cfg.WriteBufferSize > 0 {
+		return bufio.NewWriterSize(w, cfg.WriteBufferSize)
+	}
+	return bufio.NewWriter(w)
+}
+
+func (c frameCodec) headerSize() int {
+	if c.wide {
+		return 4
+	}
+	return 2
+}
+
+// writeFrame buffers the length header followed by payload as one write,
+// so a frame is never split across buffer boundaries by the caller. The
+// caller flushes w and must treat any error, from here or from the flush,
+// as fatal to the exchange: the PKI may hold a partial frame.
+func (c frameCodec) writeFrame(w *bufio.Writer, payload []byte) error {
+	if len(payload) > c.max {
+		return fmt.Errorf("%w: %d bytes to send, limit is %d", ErrFrameTooLarge, len(payload), c.max)
+	}
+	if c.psk != nil {
+		payload = c.psk.seal(payload)
+		if !c.wide && len(payload) > maxFrameSize {
+			return fmt.Errorf("%w: %d bytes once sealed, limit is %d", ErrFrameTooLarge, len(payload), maxFrameSize)
+		}
+	}
+	header := make([]byte, c.headerSize())
+	if c.wide {
+		binary.LittleEndian.PutUint32(header, uint32(len(payload)))
+	} else {
+		binary.LittleEndian.PutUint16(header, uint16(len(payload)))
+	}
+	if _, err := w.Write(header); err != nil {
+		return sendError(err)
+	}
+	// The writer flushes its buffer to the connection as chunks fill it;
+	// a short flush is reported as an error, never as a truncated frame.
+	for len(payload) > 0 {
+		n, err := w.Write(payload[:min(len(payload), frameChunkSize)])
+		if err != nil {
+			return sendError(err)
+		}
+		payload = payload[n:]
+	}
+	return nil
+}
+
+// flushFrames sends what w buffered, see writeFrame.
+func flushFrames(w *bufio.Writer) error {
+	if err := w.Flush(); err != nil {
+		return sendError(err)
+	}
+	return nil
+}
+
+// encodeCSR returns the payload carrying the DER CSR der.
+func (c frameCodec) encodeCSR(der []byte) []byte {
+	if c.pem {
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+	}
+	return der
+}
+
+// encodeCertificate returns the payload carrying the DER certificate der.
+func (c frameCodec) encodeCertificate(der []byte) []byte {
+	if c.pem {
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+	return der
+}
+
+// parseCertificate parses the certificate carried by payload.
+func (c frameCodec) parseCertificate(payload []byte) (*x509.Certificate, error) {
+	if c.pem {
+		block, _ := pem.Decode(payload)
+		if block == nil || block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("ezb_lib/certmanager: no PEM certificate in the %d bytes received", len(payload))
+		}
+		payload = block.Bytes
+	}
+	return x509.ParseCertificate(payload)
+}
+
+// readFrame reads a little endian length header followed by the payload it
+// announces, refusing lengths above the limit before allocating. stage names
+// the protocol step for error reporting.
+func (c frameCodec) readFrame(r io.Reader, stage string) ([]byte, error) {
+	// Read header containing the size of the ASN1 data.
+	header := make([]byte, c.headerSize())
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, frameError(stage, err)
+	}
+	var size uint64
+	if c.wide {
+		size = uint64(binary.LittleEndian.Uint32(header))
+	} else {
+		size = uint64(binary.LittleEndian.Uint16(header))
+	}
+	limit := c.max
+	if c.psk != nil {
+		limit += c.psk.overhead()
+	}
+	if size > uint64(limit) {
+		return nil, fmt.Errorf("%w while %s: %d bytes announced, limit is %d", ErrFrameTooLarge, stage, size, limit)
+	}
+	// Now read the data. Once the header is in, even a clean close is an
+	// unexpected EOF, unlike a close before any byte, see readResponse.
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, frameError(stage, err)
+	}
+	if c.psk != nil {
+		return c.psk.open(payload)
+	}
+	return payload, nil
+}
+
+// readResponse reads the first frame answering a request. A PKI closing
+// the connection before sending a single byte gives ErrNoResponse, a close
+// later on ErrConnectionClosed, and an empty frame is refused, so an
+// exchange can't end without a certificate.
+func (c frameCodec) readResponse(r io.Reader, stage string) ([]byte, error) {
+	payload, err := c.readFrame(r, stage)
+	if errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%w: %w", ErrNoResponse, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) == 0 {
+		return nil, fmt.Errorf("ezb_lib/certmanager: empty frame while %s", stage)
+	}
+	return payload, nil
+}
+
+// frameError tags err with ErrConnectionClosed when the PKI went away.
+func frameError(stage string, err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) {
+		return fmt.Errorf("%w while %s: %w", ErrConnectionClosed, stage, err)
+	}
+	return fmt.Errorf("ezb_lib/certmanager: read failed while %s: %w", stage, err)
+}
+
+// negotiateVersion announces requested to the PKI and returns the version
+// it answered with, which can't be higher than requested.
+func negotiateVersion(rw io.ReadWriter, requested byte) (byte, error) {
+	if requested == ProtocolLegacy {
+		return ProtocolLegacy, nil
+	}
+	if _, err := rw.Write([]byte{requested}); err != nil {
+		return 0, err
+	}
+	answer := make([]byte, 1)
+	if _, err := io.ReadFull(rw, answer); err != nil {
+		return 0, frameError("awaiting protocol version", err)
+	}
+	if answer[0] > requested {
+		return 0, fmt.Errorf("%w: asked for %d, PKI answered %d", ErrProtocolVersion, requested, answer[0])
+	}
+	return answer[0], nil
+}
+
+// sendError tags a failed write with ErrSendFailed.
+func sendError(err error) error {
+	return fmt.Errorf("%w: %w", ErrSendFailed, err)
+}
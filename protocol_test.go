@@ -0,0 +1,113 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestReadResponseClose(t *testing.T) {
+	frames := Config{}.frames()
+	tests := []struct {
+		name       string
+		data       []byte
+		noResponse bool
+	}{
+		{"nothing", nil, true},
+		{"partial header", []byte{0x10}, false},
+		{"header only", []byte{0x10, 0x00}, false},
+		{"partial payload", []byte{0x10, 0x00, 0x30}, false},
+	}
+	for _, test := range tests {
+		_, err := frames.readResponse(bytes.NewReader(test.data), "awaiting certificate")
+		if !errors.Is(err, ErrConnectionClosed) {
+			t.Errorf("%s: %v, want ErrConnectionClosed", test.name, err)
+		}
+		if errors.Is(err, ErrNoResponse) != test.noResponse {
+			t.Errorf("%s: %v, ErrNoResponse expected: %v", test.name, err, test.noResponse)
+		}
+	}
+}
+
+func TestReadResponseEmptyFrame(t *testing.T) {
+	frames := Config{}.frames()
+	if _, err := frames.readResponse(bytes.NewReader([]byte{0, 0}), "awaiting certificate"); err == nil {
+		t.Error("empty frame accepted")
+	}
+}
+
+func TestBufferSizes(t *testing.T) {
+	if r, w := (Config{}).reader(nil), (Config{}).writer(nil); r.Size() != 4096 || w.Size() != 4096 {
+		t.Errorf("default buffers: %d and %d bytes", r.Size(), w.Size())
+	}
+	cfg := Config{ReadBufferSize: 64 << 10, WriteBufferSize: 32}
+	if r, w := cfg.reader(nil), cfg.writer(nil); r.Size() != 64<<10 || w.Size() != 32 {
+		t.Errorf("configured buffers: %d and %d bytes", r.Size(), w.Size())
+	}
+	pki := newFakePKI(t)
+	if _, err := EnrollSigner(newCertificateRequest("node", 1, nil), pki.addr(), cfg); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPEMPayloads(t *testing.T) {
+	pki := newFakePKI(t)
+	pki.pem = true
+	result, err := EnrollSigner(newCertificateRequest("node", 1, nil), pki.addr(), Config{PEMPayloads: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Certificate.Subject.CommonName != "node" || !result.CA.Equal(pki.root) {
+		t.Errorf("enrolled %v under %v", result.Certificate.Subject, result.CA.Subject)
+	}
+	if _, err := EnrollSigner(newCertificateRequest("node", 1, nil), pki.addr(), Config{}); err == nil {
+		t.Error("DER CSR accepted by a PEM only PKI")
+	}
+}
+
+func TestLargeCSR(t *testing.T) {
+	pki := newFakePKI(t)
+	pki.wide = true
+	// A synchronous pipe and a small buffer split the CSR over many
+	// flushes and reads.
+	cfg := Config{
+		WideFrames:      true,
+		WriteBufferSize: 1024,
+		ExtraExtensions: []pkix.Extension{{Id: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1}, Value: bytes.Repeat([]byte{0x5a}, 300<<10)}},
+		DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go pki.handle(server)
+			return client, nil
+		},
+	}
+	result, err := EnrollSigner(newCertificateRequest("node", 1, nil), pki.addr(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Stats.CSRBytes < 300<<10 {
+		t.Errorf("CSR of %d bytes sent", result.Stats.CSRBytes)
+	}
+	cfg.WideFrames = false
+	if _, err := EnrollSigner(newCertificateRequest("node", 1, nil), pki.addr(), cfg); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("large CSR with two-byte headers: %v, want ErrFrameTooLarge", err)
+	}
+}
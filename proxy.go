@@ -0,0 +1,193 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// parseProxy validates Config.Proxy.
+func parseProxy(raw string) (*url.URL, error) {
+	proxy, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("ezb_lib/certmanager: invalid proxy: %w", err)
+	}
+	switch proxy.Scheme {
+	case "socks5", "socks5h", "http":
+	default:
+		return nil, fmt.Errorf("ezb_lib/certmanager: unsupported proxy scheme %q", proxy.Scheme)
+	}
+	if proxy.Host == "" {
+		return nil, fmt.Errorf("ezb_lib/certmanager: proxy %q has no host", raw)
+	}
+	return proxy, nil
+}
+
+// connectProxy asks the proxy conn is connected to for a tunnel to addr.
+// The PKI never speaks first, so nothing it sends can be consumed here.
+func connectProxy(conn net.Conn, proxy *url.URL, addr string) error {
+	if proxy.Scheme == "http" {
+		return httpConnect(conn, proxy, addr)
+	}
+	return socks5Connect(conn, proxy.User, addr)
+}
+
+// httpConnect opens a tunnel with an HTTP CONNECT request, authenticating
+// with the basic scheme when the proxy URL holds credentials.
+func httpConnect(conn net.Conn, proxy *url.URL, addr string) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		return fmt.Errorf("ezb_lib/certmanager: proxy request failed: %w", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return fmt.Errorf("ezb_lib/certmanager: proxy response unreadable: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("ezb_lib/certmanager: proxy refused the tunnel: %s", resp.Status)
+	}
+	return nil
+}
+
+// SOCKS5 protocol values (RFC 1928, RFC 1929).
+const (
+	socks5Version      = 5
+	socks5NoAuth       = 0
+	socks5UserPassword = 2
+	socks5NoAcceptable = 0xFF
+	socks5CmdConnect   = 1
+	socks5IPv4         = 1
+	socks5DomainName   = 3
+	socks5IPv6         = 4
+)
+
+// socks5Connect opens a tunnel with a SOCKS5 CONNECT, authenticating with
+// username and password when user is set. Host names are resolved by the
+// proxy.
+func socks5Connect(rw io.ReadWriter, user *url.Userinfo, addr string) error {
+	host, portText, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portText, 10, 16)
+	if err != nil {
+		return fmt.Errorf("ezb_lib/certmanager: invalid port in %q", addr)
+	}
+	methods := []byte{socks5NoAuth}
+	if user != nil {
+		methods = append(methods, socks5UserPassword)
+	}
+	if _, err := rw.Write(append([]byte{socks5Version, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	answer := make([]byte, 2)
+	if _, err := io.ReadFull(rw, answer); err != nil {
+		return err
+	}
+	if answer[0] != socks5Version || answer[1] == socks5NoAcceptable {
+		return fmt.Errorf("ezb_lib/certmanager: SOCKS5 proxy accepted no authentication method")
+	}
+	if answer[1] == socks5UserPassword {
+		if err := socks5Authenticate(rw, user); err != nil {
+			return err
+		}
+	}
+
+	request := []byte{socks5Version, socks5CmdConnect, 0}
+	if ip := net.ParseIP(host); ip.To4() != nil {
+		request = append(append(request, socks5IPv4), ip.To4()...)
+	} else if ip != nil {
+		request = append(append(request, socks5IPv6), ip...)
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("ezb_lib/certmanager: host name too long for SOCKS5")
+		}
+		request = append(append(request, socks5DomainName, byte(len(host))), host...)
+	}
+	request = binary.BigEndian.AppendUint16(request, uint16(port))
+	if _, err := rw.Write(request); err != nil {
+		return err
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(rw, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		return fmt.Errorf("ezb_lib/certmanager: SOCKS5 proxy refused the connection (code %d)", reply[1])
+	}
+	// Skip the bound address and port.
+	var skip int
+	switch reply[3] {
+	case socks5IPv4:
+		skip = net.IPv4len + 2
+	case socks5IPv6:
+		skip = net.IPv6len + 2
+	case socks5DomainName:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(rw, size); err != nil {
+			return err
+		}
+		skip = int(size[0]) + 2
+	default:
+		return fmt.Errorf("ezb_lib/certmanager: SOCKS5 reply with unknown address type %d", reply[3])
+	}
+	_, err = io.ReadFull(rw, make([]byte, skip))
+	return err
+}
+
+// socks5Authenticate runs the username and password subnegotiation.
+func socks5Authenticate(rw io.ReadWriter, user *url.Userinfo) error {
+	if user == nil {
+		return fmt.Errorf("ezb_lib/certmanager: SOCKS5 proxy requires credentials")
+	}
+	name := user.Username()
+	password, _ := user.Password()
+	if len(name) > 255 || len(password) > 255 {
+		return fmt.Errorf("ezb_lib/certmanager: SOCKS5 credentials too long")
+	}
+	request := append([]byte{1, byte(len(name))}, name...)
+	request = append(append(request, byte(len(password))), password...)
+	if _, err := rw.Write(request); err != nil {
+		return err
+	}
+	answer := make([]byte, 2)
+	if _, err := io.ReadFull(rw, answer); err != nil {
+		return err
+	}
+	if answer[1] != 0 {
+		return fmt.Errorf("ezb_lib/certmanager: SOCKS5 proxy rejected the credentials")
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+// startProxy serves a one-shot proxy protocol on every accepted connection:
+// handshake returns the address to tunnel to, or "" to hang up.
+func startProxy(t *testing.T, handshake func(net.Conn) string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				addr := handshake(conn)
+				if addr == "" {
+					return
+				}
+				upstream, err := net.Dial("tcp", addr)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				go io.Copy(upstream, conn)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// socks5Handshake accepts the credentials u:p and a CONNECT to an IPv4
+// address.
+func socks5Handshake(conn net.Conn) string {
+	greeting := make([]byte, 2)
+	io.ReadFull(conn, greeting)
+	io.ReadFull(conn, make([]byte, greeting[1]))
+	conn.Write([]byte{socks5Version, socks5UserPassword})
+	field := func() string {
+		size := make([]byte, 1)
+		io.ReadFull(conn, size)
+		value := make([]byte, size[0])
+		io.ReadFull(conn, value)
+		return string(value)
+	}
+	io.ReadFull(conn, make([]byte, 1))
+	if field() != "u" || field() != "p" {
+		conn.Write([]byte{1, 1})
+		return ""
+	}
+	conn.Write([]byte{1, 0})
+	request := make([]byte, 4+net.IPv4len+2)
+	io.ReadFull(conn, request)
+	ip := net.IP(request[4 : 4+net.IPv4len])
+	port := binary.BigEndian.Uint16(request[4+net.IPv4len:])
+	conn.Write([]byte{socks5Version, 0, 0, socks5IPv4, 0, 0, 0, 0, 0, 0})
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+}
+
+func httpConnectHandshake(conn net.Conn) string {
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil || req.Method != http.MethodConnect {
+		return ""
+	}
+	conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	return req.Host
+}
+
+func TestProxy(t *testing.T) {
+	pki := newFakePKI(t)
+	socks := startProxy(t, socks5Handshake)
+	tests := []struct {
+		proxy string
+		ok    bool
+	}{
+		{"socks5://u:p@" + socks, true},
+		{"socks5://u:wrong@" + socks, false},
+		{"http://" + startProxy(t, httpConnectHandshake), true},
+		{"ftp://" + socks, false},
+	}
+	for _, test := range tests {
+		request := newCertificateRequest("node", 1, nil)
+		_, _, err := enroll(context.Background(), request, pki.addr(), Config{Proxy: test.proxy})
+		if (err == nil) != test.ok {
+			t.Errorf("enrolling through %s: %v", test.proxy, err)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// pskPair returns the client and PKI sessions of one handshake made with
+// the keys clientKey and pkiKey.
+func pskPair(t *testing.T, clientKey, pkiKey []byte) (client, pki *pskSession) {
+	t.Helper()
+	nonces := bytes.Repeat([]byte{7}, 2*pskNonceSize)
+	derive := func(psk []byte, send, recv string) *pskSession {
+		s, err := pskCipher(psk, nonces, send)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := pskCipher(psk, nonces, recv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &pskSession{send: s, recv: r}
+	}
+	return derive(clientKey, "client to server", "server to client"), derive(pkiKey, "server to client", "client to server")
+}
+
+func TestPreSharedKeyEnroll(t *testing.T) {
+	pki := newFakePKI(t)
+	pki.psk = []byte("shared secret")
+	result, err := EnrollSigner(newCertificateRequest("node", 1, nil), pki.addr(), Config{PreSharedKey: pki.psk})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Certificate.Subject.CommonName != "node" || !result.CA.Equal(pki.root) {
+		t.Errorf("enrolled %v under %v", result.Certificate.Subject, result.CA.Subject)
+	}
+	if _, err := EnrollSigner(newCertificateRequest("node", 1, nil), pki.addr(), Config{PreSharedKey: []byte("other secret")}); err == nil {
+		t.Error("enrolled with the wrong pre-shared key")
+	}
+}
+
+func TestPreSharedKeyOpen(t *testing.T) {
+	client, pki := pskPair(t, []byte("shared secret"), []byte("shared secret"))
+	first, second := client.seal([]byte("first")), client.seal([]byte("second"))
+	if _, err := pki.open(second); !errors.Is(err, ErrPayloadAuth) {
+		t.Errorf("frame out of order: %v, want ErrPayloadAuth", err)
+	}
+	if payload, err := pki.open(first); err != nil || string(payload) != "first" {
+		t.Fatalf("first frame: %q, %v", payload, err)
+	}
+	if _, err := pki.open(first); !errors.Is(err, ErrPayloadAuth) {
+		t.Errorf("replayed frame: %v, want ErrPayloadAuth", err)
+	}
+	second[0] ^= 1
+	if _, err := pki.open(second); !errors.Is(err, ErrPayloadAuth) {
+		t.Errorf("tampered frame: %v, want ErrPayloadAuth", err)
+	}
+	second[0] ^= 1
+	if payload, err := pki.open(second); err != nil || string(payload) != "second" {
+		t.Errorf("second frame: %q, %v", payload, err)
+	}
+
+	client, pki = pskPair(t, []byte("shared secret"), []byte("other secret"))
+	if _, err := pki.open(client.seal([]byte("first"))); !errors.Is(err, ErrPayloadAuth) {
+		t.Errorf("wrong key: %v, want ErrPayloadAuth", err)
+	}
+}
+
+func TestPreSharedKeyFrameSize(t *testing.T) {
+	client, pki := pskPair(t, []byte("shared secret"), []byte("shared secret"))
+	send := Config{}.frames()
+	send.psk = client
+	recv := Config{}.frames()
+	recv.psk = pki
+
+	// Two-byte headers can't describe a sealed frame over maxFrameSize.
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	if err := send.writeFrame(w, make([]byte, maxFrameSize-client.overhead()+1)); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("frame over the limit once sealed: %v, want ErrFrameTooLarge", err)
+	}
+	// A failed write is fatal to the exchange, start another one.
+	client, pki = pskPair(t, []byte("shared secret"), []byte("shared secret"))
+	send.psk, recv.psk = client, pki
+	if err := send.writeFrame(w, make([]byte, maxFrameSize-client.overhead())); err != nil {
+		t.Fatal(err)
+	}
+	w.Flush()
+	if payload, err := recv.readFrame(&buf, "awaiting frame"); err != nil || len(payload) != maxFrameSize-client.overhead() {
+		t.Errorf("largest sealed frame: %d bytes, %v", len(payload), err)
+	}
+
+	// The limit applies to the payload, not to the sealed frame.
+	send = Config{WideFrames: true, MaxFrameSize: 100}.frames()
+	send.psk = client
+	recv = Config{WideFrames: true, MaxFrameSize: 100}.frames()
+	recv.psk = pki
+	buf.Reset()
+	if err := send.writeFrame(w, make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	w.Flush()
+	if payload, err := recv.readFrame(&buf, "awaiting frame"); err != nil || len(payload) != 100 {
+		t.Errorf("sealed frame at the limit: %d bytes, %v", len(payload), err)
+	}
+	recv.max = 99
+	if err := send.writeFrame(w, make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	w.Flush()
+	if _, err := recv.readFrame(&buf, "awaiting frame"); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("sealed frame over the limit: %v, want ErrFrameTooLarge", err)
+	}
+}
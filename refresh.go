@@ -0,0 +1,184 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// RefreshCA fetches the current root certificate from ezbpki, checks that
+// the certificate in cfg.CertFile still chains to it and then replaces
+// caFile. It avoids a full enrollment when only the trust anchor rotated,
+// and needs a PKI speaking ProtocolV2, or ProtocolV6 with
+// Config.ResumableCA.
+func RefreshCA(ezbpki, caFile string, cfg Config) error {
+	current, intermediates, err := loadChain(cfg.CertFile)
+	if err != nil {
+		return err
+	}
+	var rootCert *x509.Certificate
+	if cfg.ResumableCA {
+		var bundle []*x509.Certificate
+		if bundle, err = fetchCABundle(ezbpki, cfg); err != nil {
+			return err
+		}
+		rootCert = bundle[len(bundle)-1]
+		intermediates = append(intermediates, bundle[:len(bundle)-1]...)
+	} else if rootCert, err = fetchRoot(ezbpki, cfg); err != nil {
+		return err
+	}
+	if rootCert, err = cfg.trustedRoot(rootCert); err != nil {
+		return err
+	}
+	if err := validateCertificate(cfg, current, rootCert, intermediates); err != nil {
+		return err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rootCert.Raw})
+	return writeFileAtomic(caFile, data, cfg.certMode())
+}
+
+// fetchRoot asks the PKI for its root certificate alone.
+func fetchRoot(ezbpki string, cfg Config) (*x509.Certificate, error) {
+	cfg.ProtocolVersion = max(cfg.ProtocolVersion, ProtocolV2)
+	conn, frames, err := dial(context.Background(), ezbpki, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if frames.version < ProtocolV2 {
+		return nil, fmt.Errorf("%w: fetching the root needs version %d, PKI speaks %d", ErrProtocolVersion, ProtocolV2, frames.version)
+	}
+	timeouts := cfg.Timeouts
+	if err := timeouts.begin(conn, PhaseSend, time.Now()); err != nil {
+		return nil, err
+	}
+	writer := cfg.writer(conn)
+	if err := frames.writeFrame(writer, []byte{opFetchRoot}); err != nil {
+		return nil, timeouts.check(PhaseSend, err)
+	}
+	if err := flushFrames(writer); err != nil {
+		return nil, timeouts.check(PhaseSend, err)
+	}
+	if err := timeouts.begin(conn, PhaseReceiveRoot, time.Now()); err != nil {
+		return nil, err
+	}
+	rootCert, err := recvRoot(cfg.reader(conn), frames)
+	if err != nil {
+		return nil, timeouts.check(PhaseReceiveRoot, err)
+	}
+	return rootCert, nil
+}
+
+// maxCAResumes bounds the reconnections of a resumable CA bundle download.
+const maxCAResumes = 3
+
+// maxCABundleSize bounds the CA bundle announced by the PKI.
+const maxCABundleSize = 16 << 20
+
+// fetchCABundle downloads the PEM CA bundle of the PKI, intermediates
+// then root, with ProtocolV6. When the connection drops or times out
+// mid-transfer, it reconnects up to maxCAResumes times and resumes from
+// the last chunk received. On failure the errors of every attempt are
+// joined, each naming the offset it started from.
+func fetchCABundle(ezbpki string, cfg Config) ([]*x509.Certificate, error) {
+	var bundle []byte
+	total := -1
+	var errs []error
+	for resumes := 0; ; resumes++ {
+		offset := len(bundle)
+		err := fetchCARange(ezbpki, cfg, &bundle, &total)
+		if err == nil {
+			break
+		}
+		errs = append(errs, fmt.Errorf("attempt %d from byte %d: %w", resumes+1, offset, err))
+		var timeout *PhaseTimeoutError
+		if resumes == maxCAResumes || !errors.Is(err, ErrConnectionClosed) && !errors.As(err, &timeout) {
+			return nil, errors.Join(errs...)
+		}
+		fmt.Printf("CA bundle transfer interrupted at %d of %d bytes, resuming.\n", len(bundle), total)
+	}
+	certs, err := parseBundle(bundle)
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%w: no certificate in the CA bundle", ErrIncompleteBundle)
+	}
+	return certs, nil
+}
+
+// fetchCARange asks the PKI for the CA bundle from len(*bundle) on and
+// appends the chunks received to *bundle, setting *total from the first
+// one.
+func fetchCARange(ezbpki string, cfg Config, bundle *[]byte, total *int) error {
+	cfg.ProtocolVersion = max(cfg.ProtocolVersion, ProtocolV6)
+	conn, frames, err := dial(context.Background(), ezbpki, cfg)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if frames.version < ProtocolV6 {
+		return fmt.Errorf("%w: resumable CA download needs version %d, PKI speaks %d", ErrProtocolVersion, ProtocolV6, frames.version)
+	}
+	timeouts := cfg.Timeouts
+	if err := timeouts.begin(conn, PhaseSend, time.Now()); err != nil {
+		return err
+	}
+	writer := cfg.writer(conn)
+	if err := frames.writeFrame(writer, []byte{opFetchCABundle}); err != nil {
+		return timeouts.check(PhaseSend, err)
+	}
+	if err := frames.writeFrame(writer, binary.LittleEndian.AppendUint64(nil, uint64(len(*bundle)))); err != nil {
+		return timeouts.check(PhaseSend, err)
+	}
+	if err := flushFrames(writer); err != nil {
+		return timeouts.check(PhaseSend, err)
+	}
+	reader := cfg.reader(conn)
+	for len(*bundle) != *total {
+		if err := timeouts.begin(conn, PhaseReceiveRoot, time.Now()); err != nil {
+			return err
+		}
+		chunk, err := frames.readResponse(reader, "awaiting CA bundle")
+		if err != nil {
+			return timeouts.check(PhaseReceiveRoot, err)
+		}
+		if len(chunk) < 16 {
+			return fmt.Errorf("%w: CA bundle chunk of %d bytes", ErrIncompleteBundle, len(chunk))
+		}
+		offset, size := binary.LittleEndian.Uint64(chunk), binary.LittleEndian.Uint64(chunk[8:])
+		data := chunk[16:]
+		switch {
+		case size > maxCABundleSize:
+			return fmt.Errorf("%w: CA bundle of %d bytes, limit is %d", ErrFrameTooLarge, size, maxCABundleSize)
+		case *total >= 0 && size != uint64(*total):
+			return fmt.Errorf("%w: CA bundle size changed from %d to %d bytes", ErrIncompleteBundle, *total, size)
+		case offset != uint64(len(*bundle)) || offset+uint64(len(data)) > size:
+			return fmt.Errorf("%w: CA bundle chunk at %d, expected %d", ErrIncompleteBundle, offset, len(*bundle))
+		case len(data) == 0 && offset < size:
+			return fmt.Errorf("%w: empty CA bundle chunk at %d", ErrIncompleteBundle, offset)
+		}
+		*total = int(size)
+		*bundle = append(*bundle, data...)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRefreshCAResumable(t *testing.T) {
+	pki := newFakePKI(t)
+	pki.negotiate, pki.version = true, ProtocolV6
+	pki.withIntermediate()
+	dir := t.TempDir()
+	cfg := Config{ProtocolVersion: ProtocolV6, ResumableCA: true}
+	result, err := GenerateInDir(newCertificateRequest("node", 1, nil), pki.addr(), dir, "node", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.CertFile = result.CertFile
+	caFile := filepath.Join(dir, "refreshed.ca.crt")
+
+	pki.caDrops <- 3
+	if err := RefreshCA(pki.addr(), caFile, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if first, resumed := <-pki.caOffsets, <-pki.caOffsets; first != 0 || resumed != 3*64 {
+		t.Errorf("downloads started at %d and %d, want 0 and %d", first, resumed, 3*64)
+	}
+	if certs, err := readCertificates(caFile); err != nil || len(certs) != 1 || !certs[0].Equal(pki.root) {
+		t.Errorf("CA file = %v, %v, want the root", certs, err)
+	}
+
+	for range maxCAResumes + 1 {
+		pki.caDrops <- 0
+	}
+	err = RefreshCA(pki.addr(), caFile, cfg)
+	if !errors.Is(err, ErrConnectionClosed) {
+		t.Errorf("download dropping every time: %v, want ErrConnectionClosed", err)
+	}
+	// Every attempt is reported, not only the last one.
+	for attempt := 1; attempt <= maxCAResumes+1; attempt++ {
+		if !strings.Contains(err.Error(), fmt.Sprintf("attempt %d from byte 0: ", attempt)) {
+			t.Errorf("attempt %d missing from %v", attempt, err)
+		}
+	}
+	for range maxCAResumes + 1 {
+		<-pki.caOffsets
+	}
+
+	pki.version = ProtocolV4
+	if err := RefreshCA(pki.addr(), caFile, cfg); !errors.Is(err, ErrProtocolVersion) {
+		t.Errorf("ProtocolV4 PKI: %v, want ErrProtocolVersion", err)
+	}
+}
@@ -0,0 +1,390 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// defaultCheckInterval is used by WatchAndRenew when Config.CheckInterval is unset.
+const defaultCheckInterval = time.Hour
+
+// defaultRetryBackoff is the first delay before WatchAndRenew retries a
+// failed renewal when Config.RetryBackoff is unset.
+const defaultRetryBackoff = time.Minute
+
+// loadCertificate reads the first PEM certificate of path.
+func loadCertificate(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("ezb_lib/certmanager: no certificate found in %s", path)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// loadChain reads the certificate stored in path followed by the
+// intermediates written after it.
+func loadChain(path string) (*x509.Certificate, []*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	certs, err := parseBundle(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(certs) == 0 {
+		return nil, nil, fmt.Errorf("ezb_lib/certmanager: no certificate found in %s", path)
+	}
+	return certs[0], certs[1:], nil
+}
+
+// TimeUntilExpiry returns how long the certificate stored in certFile
+// remains valid. The result is negative once it has expired.
+func TimeUntilExpiry(certFile string) (time.Duration, error) {
+	cert, err := loadCertificate(certFile)
+	if err != nil {
+		return 0, err
+	}
+	return time.Until(cert.NotAfter), nil
+}
+
+// LifetimeElapsedFraction returns the fraction of the validity window of
+// cert already elapsed, from 0 before NotBefore to 1 from NotAfter on.
+func LifetimeElapsedFraction(cert *x509.Certificate) float64 {
+	return lifetimeElapsedAt(cert, time.Now())
+}
+
+// lifetimeElapsedAt is LifetimeElapsedFraction at now.
+func lifetimeElapsedAt(cert *x509.Certificate, now time.Time) float64 {
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	if lifetime <= 0 {
+		return 1
+	}
+	return min(max(float64(now.Sub(cert.NotBefore))/float64(lifetime), 0), 1)
+}
+
+// NeedsRenewal reports whether cfg.CertFile is due for renewal the way
+// WatchAndRenew decides it, e.g. for a cron job calling Renew: it expires
+// within threshold, or the thresholds of Config.RenewBefore,
+// Config.RenewalHintOID or Config.RenewAtFraction are reached, on the
+// clock of the PKI when Config.UseCATime is set.
+func NeedsRenewal(ctx context.Context, cfg Config, threshold time.Duration) (bool, error) {
+	return needsRenewal(cfg, threshold, cfg.renewalNow(ctx))
+}
+
+// renewalNow returns the time renewal decisions are made at: the time of
+// cfg.PKI when Config.UseCATime is set and it answers, the local one
+// otherwise.
+func (cfg Config) renewalNow(ctx context.Context) time.Time {
+	if cfg.UseCATime {
+		now, err := FetchCATime(ctx, cfg.PKI, cfg)
+		if err == nil {
+			return now
+		}
+		fmt.Printf("Warning: using the local clock, CA time unavailable: %v\n", err)
+	}
+	return time.Now()
+}
+
+// needsRenewal reports whether cfg.CertFile expires within threshold of
+// now, or has lived Config.RenewAtFraction of its lifetime when set. The
+// .renew-at file, when Config.RenewBefore is set, or else a renewal hint
+// found in the certificate take precedence.
+func needsRenewal(cfg Config, threshold time.Duration, now time.Time) (bool, error) {
+	cert, err := loadCertificate(cfg.CertFile)
+	if err != nil {
+		return false, err
+	}
+	if cfg.RenewBefore > 0 {
+		if at, err := ReadRenewAt(cfg.CertFile); err == nil {
+			return !now.Before(at), nil
+		}
+	}
+	if hint, ok := renewalHint(cert, cfg.RenewalHintOID); ok {
+		return cert.NotAfter.Sub(now) <= hint, nil
+	}
+	if cfg.RenewAtFraction > 0 && cfg.RenewAtFraction < 1 {
+		return lifetimeElapsedAt(cert, now) >= cfg.RenewAtFraction, nil
+	}
+	return cert.NotAfter.Sub(now) <= threshold, nil
+}
+
+// renewalHint reads the extension identified by oid, holding an INTEGER
+// number of seconds before NotAfter at which the CA wants renewal to start.
+func renewalHint(cert *x509.Certificate, oid asn1.ObjectIdentifier) (time.Duration, bool) {
+	if len(oid) == 0 {
+		return 0, false
+	}
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oid) {
+			continue
+		}
+		var seconds int64
+		if rest, err := asn1.Unmarshal(ext.Value, &seconds); err != nil || len(rest) > 0 || seconds <= 0 {
+			fmt.Println("Warning: ignoring malformed renewal hint extension.")
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	return 0, false
+}
+
+// Renew enrolls a new key and certificate for the identity found in
+// cfg.CertFile, keeping its CommonName and SANs, see CSRFromCertificate,
+// and replaces the files described by cfg once the new ones pass
+// Config.VerifyRenewal.
+func Renew(cfg Config) (EnrollResult, error) {
+	return RenewContext(context.Background(), cfg)
+}
+
+// RenewContext is Renew, aborted when ctx is done, e.g. on daemon shutdown.
+// Cancellation is honored until the files start being swapped: the
+// connection to the PKI is closed, the temporary files are removed and an
+// error matching context.Canceled or context.DeadlineExceeded is returned,
+// leaving the current files untouched. Once the swap has begun it
+// completes.
+func RenewContext(ctx context.Context, cfg Config) (EnrollResult, error) {
+	current, err := loadCertificate(cfg.CertFile)
+	if err != nil {
+		return EnrollResult{}, err
+	}
+	if cfg.RequestedValidity <= 0 {
+		cfg.RequestedValidity = current.NotAfter.Sub(current.NotBefore)
+	}
+	return swapRenewal(ctx, CSRFromCertificate(current), cfg)
+}
+
+// CSRFromCertificate builds the CSR template reissuing cert, as Renew
+// does: its whole subject and every SAN, DNS names, IP addresses, email
+// addresses and URIs alike, so renewal is lossless for complex identities.
+func CSRFromCertificate(cert *x509.Certificate) *x509.CertificateRequest {
+	var addresses []string
+	addresses = append(addresses, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		addresses = append(addresses, ip.String())
+	}
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	request := newCertificateRequest(cert.Subject.CommonName, int(lifetime.Hours()/24), addresses)
+	request.Subject = cloneSubject(cert.Subject)
+	request.EmailAddresses = slices.Clone(cert.EmailAddresses)
+	for _, uri := range cert.URIs {
+		u := *uri
+		request.URIs = append(request.URIs, &u)
+	}
+	return request
+}
+
+// subjectFields are the attribute types pkix.Name parses into its fields.
+var subjectFields = []asn1.ObjectIdentifier{
+	{2, 5, 4, 3},  // commonName
+	{2, 5, 4, 5},  // serialNumber
+	{2, 5, 4, 6},  // countryName
+	{2, 5, 4, 7},  // localityName
+	{2, 5, 4, 8},  // stateOrProvinceName
+	{2, 5, 4, 9},  // streetAddress
+	{2, 5, 4, 10}, // organizationName
+	{2, 5, 4, 11}, // organizationalUnitName
+	{2, 5, 4, 17}, // postalCode
+}
+
+// cloneSubject returns a deep copy of name fit for a template: the
+// attributes a parsed name only holds in Names, e.g. emailAddress or UID,
+// are carried over to ExtraNames so they get encoded too.
+func cloneSubject(name pkix.Name) pkix.Name {
+	clone := name
+	clone.Country = slices.Clone(name.Country)
+	clone.Organization = slices.Clone(name.Organization)
+	clone.OrganizationalUnit = slices.Clone(name.OrganizationalUnit)
+	clone.Locality = slices.Clone(name.Locality)
+	clone.Province = slices.Clone(name.Province)
+	clone.StreetAddress = slices.Clone(name.StreetAddress)
+	clone.PostalCode = slices.Clone(name.PostalCode)
+	clone.Names = slices.Clone(name.Names)
+	clone.ExtraNames = slices.Clone(name.ExtraNames)
+	if name.ExtraNames == nil {
+		for _, attr := range name.Names {
+			if !slices.ContainsFunc(subjectFields, attr.Type.Equal) {
+				clone.ExtraNames = append(clone.ExtraNames, attr)
+			}
+		}
+	}
+	return clone
+}
+
+// RenewExpiring sweeps dir for the identities laid out by ArtifactPaths,
+// base.crt with base.key and base.ca.crt, and renews those expiring
+// within threshold, see NeedsRenewal, with cfg.PKI and the other settings
+// of cfg. Certificates without a key file beside them are skipped, as are
+// CA certificates, and Config.ChainFile, which would be shared, is
+// ignored, ruling out FormatApache. Results hold the renewed identities;
+// the sweep goes on past failures, which are joined in the returned
+// error, each naming its certificate file.
+func RenewExpiring(dir string, threshold time.Duration, cfg Config) ([]EnrollResult, error) {
+	certFiles, err := filepath.Glob(filepath.Join(dir, "*.crt"))
+	if err != nil {
+		return nil, err
+	}
+	cfg.ChainFile = ""
+	if err := cfg.OutputFormat.check(""); err != nil {
+		return nil, err
+	}
+	now := cfg.renewalNow(context.Background())
+	var results []EnrollResult
+	var errs []error
+	for _, certFile := range certFiles {
+		if strings.HasSuffix(certFile, ".ca.crt") {
+			continue
+		}
+		cfg.CertFile, cfg.KeyFile, cfg.CAFile, err = ArtifactPaths(dir, strings.TrimSuffix(filepath.Base(certFile), ".crt"))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", certFile, err))
+			continue
+		}
+		if _, err := os.Stat(cfg.KeyFile); err != nil {
+			continue
+		}
+		if cert, err := loadCertificate(certFile); err == nil && cert.IsCA {
+			continue
+		}
+		renew, err := needsRenewal(cfg, threshold, now)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", certFile, err))
+			continue
+		}
+		if !renew {
+			continue
+		}
+		result, err := Renew(cfg)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", certFile, err))
+			continue
+		}
+		results = append(results, result)
+	}
+	return results, errors.Join(errs...)
+}
+
+// swapRenewal enrolls request into temporary files next to the current
+// ones, lets cfg.VerifyRenewal inspect them and only then renames them over
+// the key, certificate and CA files, all or none of them, see FileStore. On
+// any failure the current files are left untouched and the temporary ones
+// removed.
+func swapRenewal(ctx context.Context, request *x509.CertificateRequest, cfg Config) (result EnrollResult, err error) {
+	defer func() { result, err = cfg.finish(result, err) }()
+	if cfg.KeyFile == "" && !cfg.externalKey() {
+		return result, ErrNoKeyOutput
+	}
+	if err := cfg.OutputFormat.check(cfg.ChainFile); err != nil {
+		return result, err
+	}
+	var priv crypto.Signer
+	priv, result, err = enroll(ctx, request, cfg.PKI, cfg)
+	if err != nil {
+		return result, err
+	}
+	if cfg.Key == nil {
+		defer WipeKey(priv)
+	}
+	// Renewal replaces the key on purpose, whatever RefuseOverwrite says.
+	cfg.RefuseOverwrite = false
+	return FileStore{CertFile: cfg.CertFile, KeyFile: cfg.KeyFile, CAFile: cfg.CAFile}.save(ctx, priv, result, cfg)
+}
+
+// WatchAndRenew checks cfg.CertFile every cfg.CheckInterval and renews it
+// once it expires within threshold, or has lived Config.RenewAtFraction of
+// its lifetime when set, or within the renewal hint of the CA when
+// Config.RenewalHintOID is set and present in the certificate, see
+// NeedsRenewal. onRenew, when set, receives the outcome of each renewal,
+// or the error preventing the check. It blocks until ctx is done, so it's
+// usually started in its own goroutine.
+//
+// A failed renewal is retried with an exponential backoff with jitter,
+// from Config.RetryBackoff up to Config.RetryBackoffMax, so that many
+// nodes don't hammer a recovering CA in step; a success returns to the
+// normal interval.
+func WatchAndRenew(ctx context.Context, cfg Config, threshold time.Duration, onRenew func(error)) {
+	interval := cfg.CheckInterval
+	if interval <= 0 {
+		interval = defaultCheckInterval
+	}
+	backoff, backoffMax := cfg.RetryBackoff, cfg.RetryBackoffMax
+	if backoff <= 0 {
+		backoff = defaultRetryBackoff
+	}
+	if backoffMax <= 0 {
+		backoffMax = max(interval, backoff)
+	}
+	failures := 0
+	report := func(err error) {
+		if onRenew != nil {
+			onRenew(err)
+		}
+	}
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		next := interval
+		renew, err := NeedsRenewal(ctx, cfg, threshold)
+		if err != nil {
+			report(err)
+		} else if renew {
+			_, err := RenewContext(ctx, cfg)
+			report(err)
+			if err != nil {
+				failures++
+				next = backoffDelay(failures, backoff, backoffMax)
+			} else {
+				failures = 0
+			}
+		}
+		timer.Reset(next)
+	}
+}
+
+// backoffDelay returns the delay before retry number failures: base
+// doubled for each previous failure, capped at limit, then jittered over
+// its upper half so retries spread out without ever coming too soon.
+func backoffDelay(failures int, base, limit time.Duration) time.Duration {
+	delay := base
+	for i := 1; i < failures && delay < limit; i++ {
+		delay *= 2
+	}
+	delay = min(delay, limit)
+	return delay/2 + rand.N(delay/2+1)
+}
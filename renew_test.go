@@ -0,0 +1,322 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"math"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenewContextCancel(t *testing.T) {
+	for _, phase := range []string{PhaseDial, PhaseReceiveCert, PhaseReceiveRoot, "verify"} {
+		t.Run(phase, func(t *testing.T) {
+			pki := newFakePKI(t)
+			pki.negotiate = true
+			dir := t.TempDir()
+			cfg := Config{
+				PKI:      pki.addr(),
+				CertFile: filepath.Join(dir, "node.crt"),
+				KeyFile:  filepath.Join(dir, "node.key"),
+				CAFile:   filepath.Join(dir, "ca.crt"),
+				// Requesting a version lets the PKI stall the dial phase.
+				ProtocolVersion: ProtocolV1,
+			}
+			request := newCertificateRequest("node", 1, []string{"node.example"})
+			if _, err := generate(request, cfg.PKI, cfg.CertFile, cfg.KeyFile, cfg.CAFile, cfg); err != nil {
+				t.Fatal(err)
+			}
+			before := readFiles(t, cfg.CertFile, cfg.KeyFile, cfg.CAFile)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if phase == "verify" {
+				cfg.VerifyRenewal = func(certFile, keyFile, caFile string) error {
+					cancel()
+					return nil
+				}
+			} else {
+				pki.stall = phase
+				go func() {
+					<-pki.stalled
+					cancel()
+				}()
+			}
+			if _, err := RenewContext(ctx, cfg); !errors.Is(err, context.Canceled) {
+				t.Fatalf("RenewContext returned %v, want context.Canceled", err)
+			}
+
+			after := readFiles(t, cfg.CertFile, cfg.KeyFile, cfg.CAFile)
+			for i := range before {
+				if !bytes.Equal(before[i], after[i]) {
+					t.Errorf("file %d changed by a cancelled renewal", i)
+				}
+			}
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, entry := range entries {
+				if strings.HasSuffix(entry.Name(), ".tmp") {
+					t.Errorf("stray temporary file %s", entry.Name())
+				}
+			}
+		})
+	}
+}
+
+func readFiles(t *testing.T, names ...string) [][]byte {
+	t.Helper()
+	var contents [][]byte
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents = append(contents, data)
+	}
+	return contents
+}
+
+func TestWatchAndRenew(t *testing.T) {
+	pki := newFakePKI(t)
+	dir := t.TempDir()
+	cfg := Config{
+		PKI:           pki.addr(),
+		CertFile:      filepath.Join(dir, "node.crt"),
+		KeyFile:       filepath.Join(dir, "node.key"),
+		CAFile:        filepath.Join(dir, "ca.crt"),
+		CheckInterval: 10 * time.Millisecond,
+		RetryBackoff:  10 * time.Millisecond,
+	}
+	if _, err := generate(newCertificateRequest("node", 1, nil), cfg.PKI, cfg.CertFile, cfg.KeyFile, cfg.CAFile, cfg); err != nil {
+		t.Fatal(err)
+	}
+	before := readFiles(t, cfg.CertFile)
+
+	// watch runs WatchAndRenew with threshold until the first outcome,
+	// then checks that it returns once its context is cancelled.
+	watch := func(cfg Config, threshold time.Duration) error {
+		ctx, cancel := context.WithCancel(context.Background())
+		outcomes := make(chan error, 1)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			WatchAndRenew(ctx, cfg, threshold, func(err error) {
+				select {
+				case outcomes <- err:
+				default:
+				}
+			})
+		}()
+		var err error
+		select {
+		case err = <-outcomes:
+		case <-time.After(5 * time.Second):
+			t.Fatal("no renewal reported")
+		}
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("WatchAndRenew still running after cancellation")
+		}
+		return err
+	}
+
+	if err := watch(cfg, 2*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if after := readFiles(t, cfg.CertFile); bytes.Equal(before[0], after[0]) {
+		t.Error("certificate not renewed under the threshold")
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	failing := cfg
+	failing.PKI = ln.Addr().String()
+	if err := watch(failing, 2*time.Hour); err == nil {
+		t.Error("failed renewal reported as a success")
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	base, limit := time.Minute, 10*time.Minute
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{4, 8 * time.Minute},
+		{5, limit},
+		{20, limit},
+	}
+	for _, test := range tests {
+		for range 100 {
+			if delay := backoffDelay(test.failures, base, limit); delay < test.want/2 || delay > test.want {
+				t.Fatalf("failure %d: delay %v outside [%v, %v]", test.failures, delay, test.want/2, test.want)
+			}
+		}
+	}
+}
+
+func TestRenewExpiring(t *testing.T) {
+	pki := newFakePKI(t)
+	dir := t.TempDir()
+	cfg := Config{PKI: pki.addr()}
+	for _, base := range []string{"client", "server"} {
+		if _, err := GenerateInDir(newCertificateRequest(base, 1, nil), pki.addr(), dir, base, cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A certificate whose key lives elsewhere is left alone.
+	if err := os.Rename(filepath.Join(dir, "server.key"), filepath.Join(dir, "server.key.bak")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The fake PKI issues certificates for an hour.
+	results, err := RenewExpiring(dir, time.Minute, cfg)
+	if err != nil || len(results) != 0 {
+		t.Fatalf("renewed %d certificates far from expiry: %v", len(results), err)
+	}
+	before := readFiles(t, filepath.Join(dir, "client.crt"))
+	results, err = RenewExpiring(dir, 2*time.Hour, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].CertFile != filepath.Join(dir, "client.crt") {
+		t.Fatalf("renewed %+v, want client.crt alone", results)
+	}
+	if after := readFiles(t, filepath.Join(dir, "client.crt")); bytes.Equal(before[0], after[0]) {
+		t.Error("client.crt unchanged")
+	}
+}
+
+func TestCSRFromCertificate(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "node"},
+		DNSNames:       []string{"node.example.com"},
+		IPAddresses:    []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("2001:db8::1")},
+		EmailAddresses: []string{"ops@example.com"},
+		URIs:           []*url.URL{{Scheme: "spiffe", Host: "example.com", Path: "/node"}},
+		NotBefore:      time.Now(),
+		NotAfter:       time.Now().Add(24 * time.Hour),
+	}
+	der, err := createCSR(CSRFromCertificate(cert), mustGenerateKey(t, KeyECDSAP256), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if csr.Subject.CommonName != "node" || !slices.Equal(csr.DNSNames, cert.DNSNames) ||
+		!slices.EqualFunc(csr.IPAddresses, cert.IPAddresses, net.IP.Equal) || !slices.Equal(csr.EmailAddresses, cert.EmailAddresses) ||
+		len(csr.URIs) != 1 || csr.URIs[0].String() != cert.URIs[0].String() {
+		t.Errorf("CSR = %v %v %v %v %v, want the SANs of %v %v %v %v %v", csr.Subject, csr.DNSNames, csr.IPAddresses, csr.EmailAddresses, csr.URIs,
+			cert.Subject, cert.DNSNames, cert.IPAddresses, cert.EmailAddresses, cert.URIs)
+	}
+}
+
+func TestCSRFromCertificateSubject(t *testing.T) {
+	key := mustGenerateKey(t, KeyECDSAP256)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			CommonName:         "node",
+			Organization:       []string{"Example", "Example Labs"},
+			OrganizationalUnit: []string{"ops", "pki"},
+			Country:            []string{"FR"},
+			Locality:           []string{"Paris"},
+			ExtraNames:         []pkix.AttributeTypeAndValue{{Type: asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 1}, Value: "node-uid"}},
+		},
+		NotBefore: time.Now(),
+		NotAfter:  time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err = createCSR(CSRFromCertificate(cert), mustGenerateKey(t, KeyECDSAP256), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if csr.Subject.String() != cert.Subject.String() {
+		t.Errorf("CSR subject %q, want %q", csr.Subject, cert.Subject)
+	}
+}
+
+func TestLifetimeElapsedFraction(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		notBefore, notAfter time.Time
+		want                float64
+	}{
+		{now.Add(-time.Hour), now.Add(time.Hour), 0.5},
+		{now.Add(time.Hour), now.Add(2 * time.Hour), 0},
+		{now.Add(-2 * time.Hour), now.Add(-time.Hour), 1},
+		{now, now, 1},
+	} {
+		got := LifetimeElapsedFraction(&x509.Certificate{NotBefore: tc.notBefore, NotAfter: tc.notAfter})
+		if math.Abs(got-tc.want) > 0.01 {
+			t.Errorf("%v to %v: %v, want %v", tc.notBefore, tc.notAfter, got, tc.want)
+		}
+	}
+}
+
+func TestRenewAtFraction(t *testing.T) {
+	pki := newFakePKI(t)
+	result, err := GenerateInDir(newCertificateRequest("node", 1, nil), pki.addr(), t.TempDir(), "node", Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The fake PKI certificates started a minute ago and last an hour more.
+	for _, tc := range []struct {
+		fraction float64
+		want     bool
+	}{{0, true}, {0.01, true}, {2.0 / 3, false}} {
+		renew, err := needsRenewal(Config{CertFile: result.CertFile, RenewAtFraction: tc.fraction}, 2*time.Hour, time.Now())
+		if err != nil || renew != tc.want {
+			t.Errorf("fraction %v: renew %v, %v", tc.fraction, renew, err)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto/x509"
+	"os"
+	"strings"
+	"time"
+)
+
+// renewAtSuffix is appended to the certificate path to name its renewal
+// deadline file.
+const renewAtSuffix = ".renew-at"
+
+// RenewAtPath returns the path of the renewal deadline file of certFile.
+func RenewAtPath(certFile string) string {
+	return certFile + renewAtSuffix
+}
+
+// ReadRenewAt returns the renewal deadline recorded next to certFile when
+// Config.RenewBefore is set.
+func ReadRenewAt(certFile string) (time.Time, error) {
+	data, err := os.ReadFile(RenewAtPath(certFile))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339, strings.TrimSpace(string(data)))
+}
+
+// writeRenewAt records when cert, stored in certFile, should be renewed:
+// cfg.RenewBefore, or the renewal hint of the CA, before its expiry. It does
+// nothing unless cfg.RenewBefore is set.
+func writeRenewAt(certFile string, cert *x509.Certificate, cfg Config) error {
+	if cfg.RenewBefore <= 0 {
+		return nil
+	}
+	before := cfg.RenewBefore
+	if hint, ok := renewalHint(cert, cfg.RenewalHintOID); ok {
+		before = hint
+	}
+	at := cert.NotAfter.Add(-before).UTC().Format(time.RFC3339)
+	return writeFileAtomic(RenewAtPath(certFile), []byte(at+"\n"), cfg.certMode())
+}
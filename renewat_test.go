@@ -0,0 +1,64 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRenewAt(t *testing.T) {
+	pki := newFakePKI(t)
+	dir := t.TempDir()
+	cfg := Config{RenewBefore: 30 * time.Minute}
+	result, err := GenerateInDir(newCertificateRequest("node", 1, nil), pki.addr(), dir, "node", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(RenewAtPath(result.CertFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := result.Certificate.NotAfter.Add(-cfg.RenewBefore).UTC().Format(time.RFC3339) + "\n"; string(data) != want {
+		t.Errorf("renew-at file holds %q, want %q", data, want)
+	}
+	if at, err := ReadRenewAt(result.CertFile); err != nil || !at.Equal(result.Certificate.NotAfter.Add(-cfg.RenewBefore).Truncate(time.Second)) {
+		t.Errorf("ReadRenewAt = %v, %v", at, err)
+	}
+
+	// The recorded deadline prevails over the threshold.
+	cfg.CertFile = result.CertFile
+	if renew, err := NeedsRenewal(context.Background(), cfg, 2*time.Hour); err != nil || renew {
+		t.Errorf("NeedsRenewal before the deadline = %v, %v, want false", renew, err)
+	}
+	past := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339) + "\n"
+	if err := os.WriteFile(RenewAtPath(result.CertFile), []byte(past), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if renew, err := NeedsRenewal(context.Background(), cfg, 0); err != nil || !renew {
+		t.Errorf("NeedsRenewal past the deadline = %v, %v, want true", renew, err)
+	}
+
+	if _, err := GenerateInDir(newCertificateRequest("other", 1, nil), pki.addr(), dir, "other", Config{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(RenewAtPath(filepath.Join(dir, "other.crt"))); !os.IsNotExist(err) {
+		t.Errorf("renew-at file written without RenewBefore: %v", err)
+	}
+}
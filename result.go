@@ -0,0 +1,95 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto"
+	"crypto/x509"
+	"fmt"
+	"time"
+)
+
+// EnrollResult describes a successful enrollment. It is the output of every
+// enrollment path, GenerateInDir, Renew, EnrollFromDir and the in-memory ones
+// alike, so consumers handle a single shape; a failed enrollment returns
+// the zero value.
+type EnrollResult struct {
+	// Certificate is the certificate issued by the PKI.
+	Certificate *x509.Certificate
+	// Info summarizes Certificate.
+	Info CertInfo
+	// Chain holds the intermediates sent by the PKI, if any.
+	Chain []*x509.Certificate
+	// CA is the root certificate returned by the PKI.
+	CA *x509.Certificate
+	// NotAfter is the expiry actually set by the CA, which may come earlier
+	// than Config.RequestedValidity asked for.
+	NotAfter time.Time
+	// Key is the private key, set by EnrollSigner only: the other paths
+	// write it out, to KeyFile when persisted to files.
+	Key crypto.Signer
+	// KeyLabel is the label of the key generated in Config.KeyStore.
+	KeyLabel string
+	// CertFile, KeyFile and CAFile are the paths written, empty when the
+	// artifacts went to writers.
+	CertFile string
+	KeyFile  string
+	CAFile   string
+	// RequestID is the ID the CA logged the request under, from
+	// ProtocolV7 on, see Config.RequestID.
+	RequestID string
+	// Stats holds the size of the exchanged frames.
+	Stats TransferStats
+	// RenewalHint is how long before expiry the CA recommends renewing,
+	// zero when Config.RenewalHintOID is unset or absent from Certificate.
+	RenewalHint time.Duration
+}
+
+// ServerChain returns the chain a TLS server presents: the issued
+// certificate first, then the intermediates up to, but excluding, the root.
+// It is what the certificate file holds.
+func (r EnrollResult) ServerChain() []*x509.Certificate {
+	return append([]*x509.Certificate{r.Certificate}, r.Chain...)
+}
+
+// warnShortenedValidity prints a warning when the CA issued cert for
+// noticeably less than the requested validity, so operators learn that
+// their lifetime isn't honored before renewals start to come early.
+func warnShortenedValidity(cert *x509.Certificate, requested time.Duration) {
+	if requested <= 0 {
+		return
+	}
+	issued := cert.NotAfter.Sub(cert.NotBefore)
+	if issued < requested*3/4 {
+		fmt.Printf("Warning: the CA issued the certificate for %s, %s were requested.\n", issued.Round(time.Second), requested)
+	}
+}
+
+// finish concludes an enrollment path: on success it runs the OnSuccess
+// hook, if any, once the artifacts are stored; then it reports the outcome
+// to the webhook, with whatever result was reached on failure. It returns
+// the final result and error of the enrollment, the zero EnrollResult on
+// failure.
+func (cfg Config) finish(result EnrollResult, err error) (EnrollResult, error) {
+	if err == nil && cfg.OnSuccess != nil {
+		err = cfg.OnSuccess(result)
+	}
+	cfg.notifyWebhook(result, err)
+	if err != nil {
+		return EnrollResult{}, err
+	}
+	return result, nil
+}
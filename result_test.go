@@ -0,0 +1,104 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOnSuccess(t *testing.T) {
+	pki := newFakePKI(t)
+	dir := t.TempDir()
+	var calls int
+	cfg := Config{OnSuccess: func(result EnrollResult) error {
+		calls++
+		// The artifacts are in place by the time the hook runs.
+		for _, name := range []string{result.CertFile, result.KeyFile, result.CAFile} {
+			if _, err := os.Stat(name); err != nil {
+				t.Errorf("OnSuccess before %s was written: %v", name, err)
+			}
+		}
+		return nil
+	}}
+	if _, err := GenerateInDir(newCertificateRequest("node", 1, nil), pki.addr(), dir, "node", cfg); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Errorf("OnSuccess called %d times, want once", calls)
+	}
+
+	// A failed enrollment doesn't call it.
+	if _, err := GenerateInDir(newCertificateRequest("node", 1, nil), pki.addr(), dir, "node", Config{OnSuccess: cfg.OnSuccess, RefuseOverwrite: true}); err == nil {
+		t.Fatal("enrolled over an existing key")
+	}
+	if calls != 1 {
+		t.Errorf("OnSuccess called after a failure")
+	}
+
+	// Its error fails the enrollment.
+	reload := errors.New("reload failed")
+	result, err := EnrollSigner(newCertificateRequest("node", 1, nil), pki.addr(), Config{OnSuccess: func(EnrollResult) error { return reload }})
+	if !errors.Is(err, reload) || result.Certificate != nil {
+		t.Errorf("failing OnSuccess: %+v, %v, want the zero result and its error", result, err)
+	}
+}
+
+// captureStdout returns what f prints, the package reporting progress and
+// warnings there.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	done := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		done <- data
+	}()
+	f()
+	w.Close()
+	return string(<-done)
+}
+
+func TestRequestedValidityWarning(t *testing.T) {
+	pki := newFakePKI(t)
+	for _, test := range []struct {
+		requested time.Duration
+		warns     bool
+	}{
+		{0, false},
+		{time.Hour, false},
+		{24 * time.Hour, true},
+	} {
+		out := captureStdout(t, func() {
+			if _, err := EnrollSigner(newCertificateRequest("node", 1, nil), pki.addr(), Config{RequestedValidity: test.requested}); err != nil {
+				t.Error(err)
+			}
+		})
+		if warned := strings.Contains(out, "Warning: the CA issued the certificate for 1h1m0s, "); warned != test.warns {
+			t.Errorf("%v requested: warning %v, want %v in %q", test.requested, warned, test.warns, out)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// checkRequestedSANs returns ErrSANMissing unless cert holds every DNS
+// name, IP address, email address and URI requested in the DER CSR
+// csrDER. The wrapping error lists the missing entries by type and value,
+// e.g. "DNS:www.example.com, email:ops@example.com". SANs added by the CA
+// are accepted.
+func checkRequestedSANs(csrDER []byte, cert *x509.Certificate) error {
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrBadCSR, err)
+	}
+	var missing []string
+	for _, name := range csr.DNSNames {
+		if !slices.Contains(cert.DNSNames, name) {
+			missing = append(missing, "DNS:"+name)
+		}
+	}
+	for _, ip := range csr.IPAddresses {
+		if !slices.ContainsFunc(cert.IPAddresses, ip.Equal) {
+			missing = append(missing, "IP:"+ip.String())
+		}
+	}
+	for _, email := range csr.EmailAddresses {
+		if !slices.Contains(cert.EmailAddresses, email) {
+			missing = append(missing, "email:"+email)
+		}
+	}
+	for _, uri := range csr.URIs {
+		if !slices.ContainsFunc(cert.URIs, func(u *url.URL) bool { return u.String() == uri.String() }) {
+			missing = append(missing, "URI:"+uri.String())
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: %s", ErrSANMissing, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// checkWildcards returns ErrWildcardNotAllowed for a wildcard DNS name
+// when deny is set, and whatever deny for a wildcard anywhere but as the
+// whole leftmost label, e.g. "a.*.example.com" or "w*.example.com", which
+// TLS clients don't match.
+func checkWildcards(names []string, deny bool) error {
+	for _, name := range names {
+		if !strings.Contains(name, "*") {
+			continue
+		}
+		if deny {
+			return fmt.Errorf("%w: %s", ErrWildcardNotAllowed, name)
+		}
+		if rest, ok := strings.CutPrefix(name, "*."); !ok || rest == "" || strings.Contains(rest, "*") {
+			return fmt.Errorf("%w: %s, only a leftmost \"*\" label is supported", ErrWildcardNotAllowed, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCheckRequestedSANs(t *testing.T) {
+	request := newCertificateRequest("node", 1, []string{"node.example.com", "10.0.0.1"})
+	request.EmailAddresses = []string{"ops@example.com"}
+	request.URIs = []*url.URL{{Scheme: "spiffe", Host: "example.com", Path: "/node"}}
+	der, err := createCSR(request, mustGenerateKey(t, KeyECDSAP256), Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &x509.Certificate{
+		DNSNames:       []string{"node.example.com", "extra.example.com"},
+		IPAddresses:    []net.IP{net.ParseIP("10.0.0.1")},
+		EmailAddresses: request.EmailAddresses,
+		URIs:           request.URIs,
+	}
+	if err := checkRequestedSANs(der, cert); err != nil {
+		t.Errorf("all SANs issued: %v", err)
+	}
+	cert.IPAddresses, cert.EmailAddresses = nil, nil
+	err = checkRequestedSANs(der, cert)
+	if !errors.Is(err, ErrSANMissing) || !strings.HasSuffix(err.Error(), ": IP:10.0.0.1, email:ops@example.com") {
+		t.Errorf("IP and email dropped: %v", err)
+	}
+}
+
+func TestRequireRequestedSANs(t *testing.T) {
+	pki := newFakePKI(t)
+	request := newCertificateRequest("node", 1, []string{"node.example.com"})
+	request.EmailAddresses = []string{"ops@example.com"}
+	// The fake PKI copies the DNS names and IP addresses only.
+	if _, err := GenerateToWriters(request, pki.addr(), new(strings.Builder), new(strings.Builder), new(strings.Builder), Config{}); err != nil {
+		t.Fatalf("SAN check off: %v", err)
+	}
+	_, err := GenerateToWriters(request, pki.addr(), new(strings.Builder), new(strings.Builder), new(strings.Builder), Config{RequireRequestedSANs: true})
+	if !errors.Is(err, ErrSANMissing) || !strings.Contains(err.Error(), "email:ops@example.com") {
+		t.Errorf("SAN check on: %v", err)
+	}
+}
+
+func TestCheckWildcards(t *testing.T) {
+	tests := []struct {
+		name  string
+		deny  bool
+		valid bool
+	}{
+		{"www.example.com", true, true},
+		{"*.example.com", false, true},
+		{"*.example.com", true, false},
+		{"a.*.example.com", false, false},
+		{"w*.example.com", false, false},
+		{"*.*.example.com", false, false},
+		{"*.", false, false},
+	}
+	for _, test := range tests {
+		err := checkWildcards([]string{"node.example.com", test.name}, test.deny)
+		if test.valid && err != nil || !test.valid && !errors.Is(err, ErrWildcardNotAllowed) {
+			t.Errorf("%s, deny %v: %v", test.name, test.deny, err)
+		}
+	}
+
+	pki := newFakePKI(t)
+	request := newCertificateRequest("node", 1, []string{"*.example.com"})
+	if _, err := EnrollSigner(request, pki.addr(), Config{}); err != nil {
+		t.Errorf("wildcard allowed by default: %v", err)
+	}
+	if _, err := EnrollSigner(request, pki.addr(), Config{DenyWildcards: true}); !errors.Is(err, ErrWildcardNotAllowed) {
+		t.Errorf("DenyWildcards: %v, want ErrWildcardNotAllowed", err)
+	}
+}
@@ -0,0 +1,227 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// oidSCTList is the RFC 6962 extension holding the signed certificate
+// timestamps embedded by the CA.
+var oidSCTList = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+
+// sct is a version 1 signed certificate timestamp.
+type sct struct {
+	logID      [sha256.Size]byte
+	timestamp  uint64
+	extensions []byte
+	hashAlg    byte
+	sigAlg     byte
+	signature  []byte
+}
+
+// TLS hash and signature algorithm codes used by CT logs.
+const (
+	tlsHashSHA256 = 4
+	tlsSigRSA     = 1
+	tlsSigECDSA   = 3
+)
+
+var errMalformedSCT = errors.New("malformed signed certificate timestamp list")
+
+// checkSCTs returns ErrInsufficientSCTs unless cert embeds at least
+// cfg.MinSCTs timestamps. With cfg.CTLogs set, only the timestamps of
+// those logs whose signature verifies over cert, as precertificate of
+// issuer, are counted.
+func checkSCTs(cfg Config, cert, issuer *x509.Certificate) error {
+	scts, err := parseSCTs(cert)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInsufficientSCTs, err)
+	}
+	valid := len(scts)
+	if len(cfg.CTLogs) > 0 {
+		valid = 0
+		for _, s := range scts {
+			if verifySCT(s, cert, issuer, cfg.CTLogs) {
+				valid++
+			}
+		}
+	}
+	if valid < cfg.MinSCTs {
+		return fmt.Errorf("%w: %d valid, %d required", ErrInsufficientSCTs, valid, cfg.MinSCTs)
+	}
+	return nil
+}
+
+// parseSCTs decodes the version 1 timestamps embedded in cert, skipping
+// later versions.
+func parseSCTs(cert *x509.Certificate) ([]sct, error) {
+	var list []byte
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidSCTList) {
+			continue
+		}
+		if rest, err := asn1.Unmarshal(ext.Value, &list); err != nil || len(rest) > 0 {
+			return nil, errMalformedSCT
+		}
+	}
+	if list == nil {
+		return nil, nil
+	}
+	list, ok := readVector(&list, 2)
+	if !ok {
+		return nil, errMalformedSCT
+	}
+	var scts []sct
+	for len(list) > 0 {
+		data, ok := readVector(&list, 2)
+		if !ok || len(data) == 0 {
+			return nil, errMalformedSCT
+		}
+		if data[0] != 0 {
+			continue
+		}
+		var s sct
+		data = data[1:]
+		if len(data) < len(s.logID)+8 {
+			return nil, errMalformedSCT
+		}
+		copy(s.logID[:], data)
+		s.timestamp = binary.BigEndian.Uint64(data[len(s.logID):])
+		data = data[len(s.logID)+8:]
+		if s.extensions, ok = readVector(&data, 2); !ok || len(data) < 2 {
+			return nil, errMalformedSCT
+		}
+		s.hashAlg, s.sigAlg, data = data[0], data[1], data[2:]
+		if s.signature, ok = readVector(&data, 2); !ok || len(data) > 0 {
+			return nil, errMalformedSCT
+		}
+		scts = append(scts, s)
+	}
+	return scts, nil
+}
+
+// readVector reads a TLS vector with a big endian length of size bytes
+// from the front of data.
+func readVector(data *[]byte, size int) ([]byte, bool) {
+	if len(*data) < size {
+		return nil, false
+	}
+	var n int
+	for _, b := range (*data)[:size] {
+		n = n<<8 | int(b)
+	}
+	if len(*data)-size < n {
+		return nil, false
+	}
+	v := (*data)[size : size+n]
+	*data = (*data)[size+n:]
+	return v, true
+}
+
+// verifySCT reports whether s was signed, by the log of logs it names,
+// over the precertificate entry of cert.
+func verifySCT(s sct, cert, issuer *x509.Certificate, logs []crypto.PublicKey) bool {
+	if issuer == nil || s.hashAlg != tlsHashSHA256 {
+		return false
+	}
+	for _, pub := range logs {
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil || sha256.Sum256(der) != s.logID {
+			continue
+		}
+		signed, err := sctSignedData(s, cert, issuer)
+		if err != nil {
+			return false
+		}
+		digest := sha256.Sum256(signed)
+		switch k := pub.(type) {
+		case *ecdsa.PublicKey:
+			return s.sigAlg == tlsSigECDSA && ecdsa.VerifyASN1(k, digest[:], s.signature)
+		case *rsa.PublicKey:
+			return s.sigAlg == tlsSigRSA && rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], s.signature) == nil
+		}
+		return false
+	}
+	return false
+}
+
+// sctSignedData returns the RFC 6962 digitally-signed struct of s for the
+// precertificate entry of cert: the TBSCertificate without the timestamp
+// list, bound to the public key of issuer.
+func sctSignedData(s sct, cert, issuer *x509.Certificate) ([]byte, error) {
+	tbs, err := precertTBS(cert.RawTBSCertificate)
+	if err != nil {
+		return nil, err
+	}
+	if len(tbs) >= 1<<24 {
+		return nil, errMalformedSCT
+	}
+	var b bytes.Buffer
+	b.Write([]byte{0, 0}) // v1, certificate_timestamp
+	binary.Write(&b, binary.BigEndian, s.timestamp)
+	b.Write([]byte{0, 1}) // precert_entry
+	issuerKeyHash := sha256.Sum256(issuer.RawSubjectPublicKeyInfo)
+	b.Write(issuerKeyHash[:])
+	b.Write([]byte{byte(len(tbs) >> 16), byte(len(tbs) >> 8), byte(len(tbs))})
+	b.Write(tbs)
+	binary.Write(&b, binary.BigEndian, uint16(len(s.extensions)))
+	b.Write(s.extensions)
+	return b.Bytes(), nil
+}
+
+// tbsCertificate decodes a TBSCertificate, keeping every field but the
+// extensions as-is.
+type tbsCertificate struct {
+	Version         int `asn1:"optional,explicit,default:0,tag:0"`
+	SerialNumber    *big.Int
+	Signature       asn1.RawValue
+	Issuer          asn1.RawValue
+	Validity        asn1.RawValue
+	Subject         asn1.RawValue
+	PublicKey       asn1.RawValue
+	IssuerUniqueID  asn1.BitString   `asn1:"optional,tag:1"`
+	SubjectUniqueID asn1.BitString   `asn1:"optional,tag:2"`
+	Extensions      []pkix.Extension `asn1:"optional,explicit,tag:3"`
+}
+
+// precertTBS re-encodes the DER TBSCertificate raw without the timestamp
+// list extension, as the log signed it.
+func precertTBS(raw []byte) ([]byte, error) {
+	var tbs tbsCertificate
+	if rest, err := asn1.Unmarshal(raw, &tbs); err != nil || len(rest) > 0 {
+		return nil, errMalformedSCT
+	}
+	var extensions []pkix.Extension
+	for _, ext := range tbs.Extensions {
+		if !ext.Id.Equal(oidSCTList) {
+			extensions = append(extensions, ext)
+		}
+	}
+	tbs.Extensions = extensions
+	return asn1.Marshal(tbs)
+}
@@ -0,0 +1,129 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// encodeSCTList encodes scts as the value of the timestamp list extension.
+func encodeSCTList(t *testing.T, scts ...sct) []byte {
+	t.Helper()
+	var list bytes.Buffer
+	for _, s := range scts {
+		var b bytes.Buffer
+		b.WriteByte(0)
+		b.Write(s.logID[:])
+		binary.Write(&b, binary.BigEndian, s.timestamp)
+		binary.Write(&b, binary.BigEndian, uint16(len(s.extensions)))
+		b.Write(s.extensions)
+		b.Write([]byte{s.hashAlg, s.sigAlg})
+		binary.Write(&b, binary.BigEndian, uint16(len(s.signature)))
+		b.Write(s.signature)
+		binary.Write(&list, binary.BigEndian, uint16(b.Len()))
+		list.Write(b.Bytes())
+	}
+	value, err := asn1.Marshal(append(binary.BigEndian.AppendUint16(nil, uint16(list.Len())), list.Bytes()...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestCheckSCTs(t *testing.T) {
+	root, rootKey := newFakeCA(t, "fake root", nil, nil)
+	logKey, otherLog := mustGenerateKey(t, KeyECDSAP256).(*ecdsa.PrivateKey), mustGenerateKey(t, KeyECDSAP256)
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "www.example.com"},
+		DNSNames:     []string{"www.example.com"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	issue := func(extensions ...pkix.Extension) *x509.Certificate {
+		template.ExtraExtensions = extensions
+		der, err := x509.CreateCertificate(rand.Reader, template, root, &leafKey.PublicKey, rootKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+	pre := issue()
+
+	spki, err := x509.MarshalPKIXPublicKey(logKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := sct{logID: sha256.Sum256(spki), timestamp: uint64(time.Now().UnixMilli()), hashAlg: tlsHashSHA256, sigAlg: tlsSigECDSA}
+	signed, err := sctSignedData(s, pre, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(signed)
+	if s.signature, err = ecdsa.SignASN1(rand.Reader, logKey, digest[:]); err != nil {
+		t.Fatal(err)
+	}
+	cert := issue(pkix.Extension{Id: oidSCTList, Value: encodeSCTList(t, s)})
+	if tbs, err := precertTBS(cert.RawTBSCertificate); err != nil || !bytes.Equal(tbs, pre.RawTBSCertificate) {
+		t.Fatalf("precertificate TBS differs from the one logged: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		cfg  Config
+		cert *x509.Certificate
+		ok   bool
+	}{
+		{"one embedded", Config{MinSCTs: 1}, cert, true},
+		{"two required", Config{MinSCTs: 2}, cert, false},
+		{"none embedded", Config{MinSCTs: 1}, pre, false},
+		{"trusted log", Config{MinSCTs: 1, CTLogs: []crypto.PublicKey{otherLog.Public(), logKey.Public()}}, cert, true},
+		{"unknown log", Config{MinSCTs: 1, CTLogs: []crypto.PublicKey{otherLog.Public()}}, cert, false},
+	}
+	for _, test := range tests {
+		err := checkSCTs(test.cfg, test.cert, root)
+		if test.ok && err != nil || !test.ok && !errors.Is(err, ErrInsufficientSCTs) {
+			t.Errorf("%s: %v", test.name, err)
+		}
+	}
+
+	s.signature[len(s.signature)-1] ^= 1
+	forged := issue(pkix.Extension{Id: oidSCTList, Value: encodeSCTList(t, s)})
+	if err := checkSCTs(Config{MinSCTs: 1, CTLogs: []crypto.PublicKey{logKey.Public()}}, forged, root); !errors.Is(err, ErrInsufficientSCTs) {
+		t.Errorf("forged signature: %v, want ErrInsufficientSCTs", err)
+	}
+}
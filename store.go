@@ -0,0 +1,228 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Store persists the PEM artifacts of an identity somewhere else than
+// local files, e.g. in Vault, etcd or a database, see GenerateToStore.
+// WriteKey receives the private key, or its KeyReference when held by a
+// KeyStore, WriteCert the certificate with the intermediates following it
+// as Config.OutputFormat sets, and WriteCA the root certificate. The Read
+// methods return what was written.
+type Store interface {
+	WriteCert(data []byte) error
+	WriteKey(data []byte) error
+	WriteCA(data []byte) error
+	ReadCert() ([]byte, error)
+	ReadKey() ([]byte, error)
+	ReadCA() ([]byte, error)
+}
+
+// FileStore is the Store of the key, certificate and CA files, each of its
+// Write methods replacing one file atomically. KeyMode and CertMode, when
+// set, override Config.KeyMode and Config.CertMode. Given to
+// GenerateToStore, it writes all the files at once as GenerateInDir does:
+// staged next to their finals with Config.ChainFile and the metadata, then
+// swapped all or none of them, honoring Config.RefuseOverwrite, and
+// followed by the renew-at file. Renew writes through it as well.
+type FileStore struct {
+	CertFile, KeyFile, CAFile string
+	KeyMode, CertMode         os.FileMode
+}
+
+// config returns cfg with the file modes of s, when set.
+func (s FileStore) config(cfg Config) Config {
+	if s.KeyMode != 0 {
+		cfg.KeyMode = s.KeyMode
+	}
+	if s.CertMode != 0 {
+		cfg.CertMode = s.CertMode
+	}
+	return cfg
+}
+
+// generate enrolls certificate and saves the artifacts to s. An empty
+// KeyFile requires Config.Key, whose signer can't be exported.
+func (s FileStore) generate(certificate *x509.CertificateRequest, ezbpki string, cfg Config) (result EnrollResult, err error) {
+	defer func() { result, err = cfg.finish(result, err) }()
+	cfg = s.config(cfg)
+	if s.KeyFile == "" && !cfg.externalKey() {
+		return result, ErrNoKeyOutput
+	}
+	if err := cfg.OutputFormat.check(cfg.ChainFile); err != nil {
+		return result, err
+	}
+	if cfg.RefuseOverwrite && s.KeyFile != "" {
+		if _, err := os.Stat(s.KeyFile); err == nil {
+			return result, ErrKeyExists
+		}
+	}
+	var priv crypto.Signer
+	priv, result, err = enroll(context.Background(), certificate, ezbpki, cfg)
+	if err != nil {
+		return result, err
+	}
+	if cfg.Key == nil {
+		defer WipeKey(priv)
+	}
+	// Enrolling never calls VerifyRenewal, only renewing does.
+	cfg.VerifyRenewal = nil
+	return s.save(context.Background(), priv, result, cfg)
+}
+
+// save writes the artifacts of result to the files of s, all or none of
+// them: they are staged next to their finals, see stageArtifacts, checked
+// by cfg.VerifyRenewal when set, then swapped in, see swapFiles. With
+// cfg.RefuseOverwrite an existing key is never replaced. Cancelling ctx
+// aborts save until the swap begins. On any failure the current files are
+// left untouched and the temporary ones removed.
+func (s FileStore) save(ctx context.Context, priv crypto.Signer, result EnrollResult, cfg Config) (_ EnrollResult, err error) {
+	cfg = s.config(cfg)
+	temps, finals, err := stageArtifacts(priv, result, s.CertFile, s.KeyFile, s.CAFile, cfg)
+	defer removeFiles(temps)
+	if err != nil {
+		return result, err
+	}
+	if cfg.VerifyRenewal != nil {
+		if err := cfg.VerifyRenewal(temps[1], temps[0], temps[2]); err != nil {
+			return result, err
+		}
+	}
+	if ctx.Err() != nil {
+		return result, ctxError(ctx)
+	}
+	if cfg.RefuseOverwrite && s.KeyFile != "" {
+		// Linking never replaces an existing key, unlike renaming.
+		if err := os.Link(temps[0], s.KeyFile); os.IsExist(err) {
+			return result, ErrKeyExists
+		} else if err != nil {
+			return result, err
+		}
+		defer func() {
+			if err != nil {
+				os.Remove(s.KeyFile)
+			}
+		}()
+		finals[0] = ""
+	}
+	if err := swapFiles(temps, finals); err != nil {
+		return result, err
+	}
+	if err := writeRenewAt(s.CertFile, result.Certificate, cfg); err != nil {
+		return result, err
+	}
+	result.CertFile, result.KeyFile, result.CAFile = s.CertFile, s.KeyFile, s.CAFile
+	return result, nil
+}
+
+// WriteCert replaces CertFile with data.
+func (s FileStore) WriteCert(data []byte) error {
+	return writeFileAtomic(s.CertFile, data, Config{CertMode: s.CertMode}.certMode())
+}
+
+// WriteKey replaces KeyFile with data.
+func (s FileStore) WriteKey(data []byte) error {
+	return writeFileAtomic(s.KeyFile, data, Config{KeyMode: s.KeyMode}.keyMode())
+}
+
+// WriteCA replaces CAFile with data.
+func (s FileStore) WriteCA(data []byte) error {
+	return writeFileAtomic(s.CAFile, data, Config{CertMode: s.CertMode}.certMode())
+}
+
+// ReadCert returns the content of CertFile.
+func (s FileStore) ReadCert() ([]byte, error) {
+	return os.ReadFile(s.CertFile)
+}
+
+// ReadKey returns the content of KeyFile.
+func (s FileStore) ReadKey() ([]byte, error) {
+	return os.ReadFile(s.KeyFile)
+}
+
+// ReadCA returns the content of CAFile.
+func (s FileStore) ReadCA() ([]byte, error) {
+	return os.ReadFile(s.CAFile)
+}
+
+// GenerateToStore enrolls like generate but hands the PEM encoded key,
+// certificate and root certificate to store, in that order, once all of
+// them are encoded. The key is not written when it comes from Config.Key,
+// which the caller already holds. Having no chain file, it can't use
+// FormatApache, unless store is a FileStore, which behaves as generate.
+func GenerateToStore(certificate *x509.CertificateRequest, ezbpki string, store Store, cfg Config) (result EnrollResult, err error) {
+	switch s := store.(type) {
+	case FileStore:
+		return s.generate(certificate, ezbpki, cfg)
+	case *FileStore:
+		return s.generate(certificate, ezbpki, cfg)
+	}
+	defer func() { result, err = cfg.finish(result, err) }()
+	if err := cfg.OutputFormat.check(""); err != nil {
+		return result, err
+	}
+	var priv crypto.Signer
+	priv, result, err = enroll(context.Background(), certificate, ezbpki, cfg)
+	if err != nil {
+		return result, err
+	}
+	var certPEM, keyPEM, caPEM bytes.Buffer
+	var keyW io.Writer
+	if cfg.Key == nil {
+		defer WipeKey(priv)
+		defer func() { clear(keyPEM.Bytes()) }()
+		keyW = &keyPEM
+	}
+	if err := writeArtifacts(&certPEM, keyW, &caPEM, priv, result, cfg.OutputFormat); err != nil {
+		return result, err
+	}
+	if keyW != nil {
+		if err := store.WriteKey(keyPEM.Bytes()); err != nil {
+			return result, fmt.Errorf("failed to store the key: %w", err)
+		}
+	}
+	if err := store.WriteCert(certPEM.Bytes()); err != nil {
+		return result, fmt.Errorf("failed to store the certificate: %w", err)
+	}
+	if err := store.WriteCA(caPEM.Bytes()); err != nil {
+		return result, fmt.Errorf("failed to store the CA: %w", err)
+	}
+	return result, nil
+}
+
+// LoadTLSCertificateFromStore is LoadTLSCertificate for the artifacts
+// written to store, leaving the root out of the chain.
+func LoadTLSCertificateFromStore(store Store) (tls.Certificate, error) {
+	certPEM, err := store.ReadCert()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := store.ReadKey()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return ToTLSCertificate(certPEM, keyPEM, nil)
+}
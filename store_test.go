@@ -0,0 +1,119 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// memStore is a Store in memory, failing writes once fail is set.
+type memStore struct {
+	cert, key, ca []byte
+	fail          error
+}
+
+func (s *memStore) WriteCert(data []byte) error { s.cert = append([]byte(nil), data...); return s.fail }
+func (s *memStore) WriteKey(data []byte) error  { s.key = append([]byte(nil), data...); return s.fail }
+func (s *memStore) WriteCA(data []byte) error   { s.ca = append([]byte(nil), data...); return s.fail }
+func (s *memStore) ReadCert() ([]byte, error)   { return s.cert, nil }
+func (s *memStore) ReadKey() ([]byte, error)    { return s.key, nil }
+func (s *memStore) ReadCA() ([]byte, error)     { return s.ca, nil }
+
+func TestGenerateToStore(t *testing.T) {
+	pki := newFakePKI(t)
+	store := &memStore{}
+	result, err := GenerateToStore(newCertificateRequest("node", 1, nil), pki.addr(), store, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := LoadTLSCertificateFromStore(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Leaf == nil || !cert.Leaf.Equal(result.Certificate) {
+		t.Error("stored certificate differs from the enrolled one")
+	}
+
+	key := mustGenerateKey(t, KeyECDSAP256)
+	store = &memStore{}
+	if _, err := GenerateToStore(newCertificateRequest("node", 1, nil), pki.addr(), store, Config{Key: key}); err != nil {
+		t.Fatal(err)
+	}
+	if store.key != nil || store.cert == nil || store.ca == nil {
+		t.Errorf("caller key stored: key %v, cert %v, CA %v", store.key != nil, store.cert != nil, store.ca != nil)
+	}
+
+	failure := errors.New("vault sealed")
+	if _, err := GenerateToStore(newCertificateRequest("node", 1, nil), pki.addr(), &memStore{fail: failure}, Config{}); !errors.Is(err, failure) {
+		t.Errorf("failing store: %v", err)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	pki := newFakePKI(t)
+	dir := t.TempDir()
+	store := FileStore{CertFile: filepath.Join(dir, "node.crt"), KeyFile: filepath.Join(dir, "node.key"), CAFile: filepath.Join(dir, "ca.crt")}
+	if _, err := GenerateToStore(newCertificateRequest("node", 1, nil), pki.addr(), store, Config{}); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(store.KeyFile); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("key file: %v, %v", fi, err)
+	}
+	if ok, err := KeyMatchesCert(store.KeyFile, store.CertFile); err != nil || !ok {
+		t.Errorf("stored key matches: %v, %v", ok, err)
+	}
+	if err := HealthCheck(store.CertFile, store.CAFile); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFileStoreGenerates(t *testing.T) {
+	pki := newFakePKI(t)
+	dir := t.TempDir()
+	certFile, keyFile, caFile, err := ArtifactPaths(dir, "node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := FileStore{CertFile: certFile, KeyFile: keyFile, CAFile: caFile}
+	cfg := Config{ChainFile: filepath.Join(dir, "chain.crt"), RenewBefore: time.Minute, RefuseOverwrite: true}
+	result, err := GenerateToStore(newCertificateRequest("node", 1, nil), pki.addr(), store, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.CertFile != certFile || result.KeyFile != keyFile || result.CAFile != caFile {
+		t.Errorf("result files: %s, %s, %s", result.CertFile, result.KeyFile, result.CAFile)
+	}
+	for _, name := range []string{cfg.ChainFile, RenewAtPath(certFile)} {
+		if _, err := os.Stat(name); err != nil {
+			t.Error(err)
+		}
+	}
+	key, err := os.ReadFile(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GenerateToStore(newCertificateRequest("node", 1, nil), pki.addr(), &store, cfg); !errors.Is(err, ErrKeyExists) {
+		t.Errorf("second enrollment: %v, want ErrKeyExists", err)
+	}
+	if again, err := os.ReadFile(keyFile); err != nil || !bytes.Equal(again, key) {
+		t.Errorf("key file replaced: %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto/x509/pkix"
+	"fmt"
+	"unicode/utf8"
+)
+
+// Upper bounds of RFC 5280 on the subject attributes, which most CAs
+// enforce.
+const (
+	maxOrganizationLength = 64
+	maxLocalityLength     = 128
+	maxProvinceLength     = 128
+)
+
+// Subject holds the multi-valued attributes of the CSR subject besides
+// the CommonName, see Config.Subject. CAs usually preserve Organization
+// and OrganizationalUnit, with every value; many rewrite or drop Country,
+// Province and Locality according to their profile, and some keep only the
+// first value of each attribute. The values of an attribute are encoded as
+// one DER set, which doesn't keep their order.
+type Subject struct {
+	Organization       []string
+	OrganizationalUnit []string
+	// Country holds two letter ISO 3166 codes.
+	Country  []string
+	Province []string
+	Locality []string
+}
+
+// check returns ErrInvalidSubject for an empty value or one longer than
+// the RFC 5280 bounds.
+func (s Subject) check() error {
+	for _, attr := range []struct {
+		name   string
+		values []string
+		max    int
+	}{
+		{"Organization", s.Organization, maxOrganizationLength},
+		{"OrganizationalUnit", s.OrganizationalUnit, maxOrganizationLength},
+		{"Country", s.Country, 2},
+		{"Province", s.Province, maxProvinceLength},
+		{"Locality", s.Locality, maxLocalityLength},
+	} {
+		for _, value := range attr.values {
+			if n := utf8.RuneCountInString(value); n == 0 || n > attr.max {
+				return fmt.Errorf("%w: %s %q must hold 1 to %d characters", ErrInvalidSubject, attr.name, value, attr.max)
+			}
+		}
+	}
+	for _, country := range s.Country {
+		if len(country) != 2 || !isUpperASCII(country[0]) || !isUpperASCII(country[1]) {
+			return fmt.Errorf("%w: Country %q is not a two letter code", ErrInvalidSubject, country)
+		}
+	}
+	return nil
+}
+
+func isUpperASCII(c byte) bool {
+	return c >= 'A' && c <= 'Z'
+}
+
+func (s Subject) empty() bool {
+	return len(s.Organization)+len(s.OrganizationalUnit)+len(s.Country)+len(s.Province)+len(s.Locality) == 0
+}
+
+// apply sets the attributes of s on name, replacing those it holds values
+// for.
+func (s Subject) apply(name *pkix.Name) {
+	for _, attr := range []struct {
+		dst *[]string
+		src []string
+	}{
+		{&name.Organization, s.Organization},
+		{&name.OrganizationalUnit, s.OrganizationalUnit},
+		{&name.Country, s.Country},
+		{&name.Province, s.Province},
+		{&name.Locality, s.Locality},
+	} {
+		if len(attr.src) > 0 {
+			*attr.dst = append([]string(nil), attr.src...)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto/x509"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCreateCSRSubject(t *testing.T) {
+	priv, err := generateKey(KeyECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject := Subject{
+		OrganizationalUnit: []string{"Platform", "SRE"},
+		Country:            []string{"FR"},
+		Locality:           []string{"Paris"},
+	}
+	der, err := createCSR(newCertificateRequest("node", 1, nil), priv, Config{Subject: subject})
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// DER sorts the values of a multi-valued attribute.
+	if !slices.Equal(csr.Subject.OrganizationalUnit, []string{"SRE", "Platform"}) || !slices.Equal(csr.Subject.Country, subject.Country) ||
+		!slices.Equal(csr.Subject.Locality, subject.Locality) {
+		t.Errorf("CSR subject = %v", csr.Subject)
+	}
+	if !slices.Equal(csr.Subject.Organization, []string{"ezBastion"}) {
+		t.Errorf("Organization = %v, want the ezBastion default", csr.Subject.Organization)
+	}
+
+	for _, bad := range []Subject{
+		{Country: []string{"FRA"}},
+		{Country: []string{"fr"}},
+		{Organization: []string{""}},
+		{OrganizationalUnit: []string{strings.Repeat("x", 65)}},
+	} {
+		if _, err := createCSR(newCertificateRequest("node", 1, nil), priv, Config{Subject: bad}); !errors.Is(err, ErrInvalidSubject) {
+			t.Errorf("subject %+v: %v, want ErrInvalidSubject", bad, err)
+		}
+	}
+}
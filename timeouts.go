@@ -0,0 +1,118 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Enrollment phases, as reported by PhaseTimeoutError.
+const (
+	PhaseDial        = "dial"
+	PhaseSend        = "send"
+	PhaseReceiveCert = "receive certificate"
+	PhaseReceiveRoot = "receive root"
+)
+
+// PhaseTimeouts bounds each phase of an exchange with the PKI. A zero
+// duration leaves the phase unbounded. The dial phase includes the version
+// and pre-shared key handshakes.
+type PhaseTimeouts struct {
+	Dial        time.Duration
+	Send        time.Duration
+	ReceiveCert time.Duration
+	ReceiveRoot time.Duration
+}
+
+// SplitTimeout spreads a total budget over the phases: most of it goes to
+// receiving the certificate, which includes the CA signing time.
+func SplitTimeout(total time.Duration) PhaseTimeouts {
+	return PhaseTimeouts{
+		Dial:        total / 10,
+		Send:        total / 10,
+		ReceiveCert: total * 6 / 10,
+		ReceiveRoot: total / 5,
+	}
+}
+
+// PhaseTimeoutError reports the phase that ran out of time.
+type PhaseTimeoutError struct {
+	Phase   string
+	Timeout time.Duration
+	Err     error
+}
+
+func (e *PhaseTimeoutError) Error() string {
+	return fmt.Sprintf("ezb_lib/certmanager: %s phase timed out after %s: %v", e.Phase, e.Timeout, e.Err)
+}
+
+func (e *PhaseTimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes a phase timeout match context.DeadlineExceeded, as a deadline of
+// the context does, so callers retry both alike.
+func (e *PhaseTimeoutError) Is(target error) bool {
+	return target == context.DeadlineExceeded
+}
+
+// ctxError returns the error ending ctx: context.Canceled or
+// context.DeadlineExceeded, wrapping the cause given to a
+// context.WithCancelCause or WithDeadlineCause if any, so that errors.Is
+// tells an explicit cancellation from a deadline.
+func ctxError(ctx context.Context) error {
+	err := ctx.Err()
+	if cause := context.Cause(ctx); cause != nil && cause != err {
+		return fmt.Errorf("%w: %w", err, cause)
+	}
+	return err
+}
+
+func (t PhaseTimeouts) of(phase string) time.Duration {
+	switch phase {
+	case PhaseDial:
+		return t.Dial
+	case PhaseSend:
+		return t.Send
+	case PhaseReceiveCert:
+		return t.ReceiveCert
+	case PhaseReceiveRoot:
+		return t.ReceiveRoot
+	}
+	return 0
+}
+
+// begin sets the deadline of phase on conn, counted from start.
+func (t PhaseTimeouts) begin(conn net.Conn, phase string, start time.Time) error {
+	var deadline time.Time
+	if d := t.of(phase); d > 0 {
+		deadline = start.Add(d)
+	}
+	return conn.SetDeadline(deadline)
+}
+
+// check turns a timeout during phase into a PhaseTimeoutError.
+func (t PhaseTimeouts) check(phase string, err error) error {
+	var netErr net.Error
+	if err != nil && errors.As(err, &netErr) && netErr.Timeout() {
+		return &PhaseTimeoutError{Phase: phase, Timeout: t.of(phase), Err: err}
+	}
+	return err
+}
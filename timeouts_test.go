@@ -0,0 +1,87 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestEnrollContextErrors(t *testing.T) {
+	errShutdown := errors.New("shutdown")
+	tests := []struct {
+		name     string
+		ctx      func() (context.Context, context.CancelFunc)
+		timeouts PhaseTimeouts
+		want     error
+	}{
+		{"deadline", func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), 50*time.Millisecond)
+		}, PhaseTimeouts{}, context.DeadlineExceeded},
+		{"phase timeout", func() (context.Context, context.CancelFunc) {
+			return context.WithCancel(context.Background())
+		}, PhaseTimeouts{ReceiveCert: 50 * time.Millisecond}, context.DeadlineExceeded},
+		{"cancel", func() (context.Context, context.CancelFunc) {
+			ctx, cancel := context.WithCancelCause(context.Background())
+			time.AfterFunc(50*time.Millisecond, func() { cancel(errShutdown) })
+			return ctx, func() { cancel(nil) }
+		}, PhaseTimeouts{}, context.Canceled},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pki := newFakePKI(t)
+			pki.stall = PhaseReceiveCert
+			ctx, cancel := test.ctx()
+			defer cancel()
+			_, _, err := enroll(ctx, newCertificateRequest("node", 1, nil), pki.addr(), Config{Timeouts: test.timeouts})
+			if !errors.Is(err, test.want) {
+				t.Fatalf("enroll = %v, want %v", err, test.want)
+			}
+			other := context.Canceled
+			if test.want == context.Canceled {
+				other = context.DeadlineExceeded
+			}
+			if errors.Is(err, other) {
+				t.Errorf("enroll = %v, also matches %v", err, other)
+			}
+			if test.name == "cancel" && !errors.Is(err, errShutdown) {
+				t.Errorf("enroll = %v, lost the cancellation cause", err)
+			}
+		})
+	}
+}
+
+func TestSplitTimeout(t *testing.T) {
+	total := 10 * time.Second
+	split := SplitTimeout(total)
+	if split.Dial != time.Second || split.Send != time.Second || split.ReceiveCert != 6*time.Second || split.ReceiveRoot != 2*time.Second {
+		t.Errorf("SplitTimeout(%v) = %+v", total, split)
+	}
+	if sum := split.Dial + split.Send + split.ReceiveCert + split.ReceiveRoot; sum != total {
+		t.Errorf("phases add up to %v, want %v", sum, total)
+	}
+
+	// A stalled CA runs out of the receive phase share.
+	pki := newFakePKI(t)
+	pki.stall = PhaseReceiveCert
+	_, _, err := enroll(context.Background(), newCertificateRequest("node", 1, nil), pki.addr(), Config{Timeouts: SplitTimeout(500 * time.Millisecond)})
+	var timeout *PhaseTimeoutError
+	if !errors.As(err, &timeout) || timeout.Phase != PhaseReceiveCert || timeout.Timeout != 300*time.Millisecond {
+		t.Errorf("stalled enrollment: %v, want a %s timeout after 300ms", err, PhaseReceiveCert)
+	}
+}
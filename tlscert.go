@@ -0,0 +1,130 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+)
+
+// ToTLSCertificate assembles the PEM certificate and key written by an
+// enrollment into a tls.Certificate ready for a tls.Config. With the
+// default Config.OutputFormat, certPEM already carries the intermediates
+// after the issued certificate, so the chain sent to peers is complete
+// without the root, which they must hold anyway to verify it. caPEM is usually nil;
+// its certificates, e.g. the root for peers that insist on receiving it,
+// are appended to the chain.
+func ToTLSCertificate(certPEM, keyPEM, caPEM []byte) (tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	for {
+		var block *pem.Block
+		block, caPEM = pem.Decode(caPEM)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			cert.Certificate = append(cert.Certificate, block.Bytes)
+		}
+	}
+	return cert, nil
+}
+
+// LoadTLSCertificate is ToTLSCertificate for the files written by generate.
+// caFile is usually empty, leaving the root out of the chain.
+func LoadTLSCertificate(certFile, keyFile, caFile string) (tls.Certificate, error) {
+	var contents [3][]byte
+	for i, name := range []string{certFile, keyFile, caFile} {
+		if name == "" {
+			continue
+		}
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		contents[i] = data
+	}
+	return ToTLSCertificate(contents[0], contents[1], contents[2])
+}
+
+// ServerTLSConfig returns the configuration of a server presenting the
+// identity enrolled in certFile and keyFile, see LoadTLSCertificate, to
+// clients authenticated against the roots of caFile, which are not sent
+// themselves. The client certificate is required when requireClientCert is
+// set, and verified when presented otherwise. Like the connection to the
+// PKI, it accepts TLS 1.2 at least with secure cipher suites only.
+func ServerTLSConfig(certFile, keyFile, caFile string, requireClientCert bool) (*tls.Config, error) {
+	cert, err := LoadTLSCertificate(certFile, keyFile, "")
+	if err != nil {
+		return nil, err
+	}
+	clientCAs, err := loadCertPool(caFile)
+	if err != nil {
+		return nil, err
+	}
+	clientAuth := tls.VerifyClientCertIfGiven
+	if requireClientCert {
+		clientAuth = tls.RequireAndVerifyClientCert
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   clientAuth,
+		MinVersion:   tls.VersionTLS12,
+		CipherSuites: secureCipherSuites,
+	}, nil
+}
+
+// ClientTLSConfig returns the configuration of a client presenting the
+// identity enrolled in certFile and keyFile, see LoadTLSCertificate, to
+// serverName, whose certificate must chain to the roots of caFile, which
+// are not sent themselves. Like ServerTLSConfig, it accepts TLS 1.2 at
+// least with secure cipher suites.
+func ClientTLSConfig(certFile, keyFile, caFile, serverName string) (*tls.Config, error) {
+	cert, err := LoadTLSCertificate(certFile, keyFile, "")
+	if err != nil {
+		return nil, err
+	}
+	rootCAs, err := loadCertPool(caFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      rootCAs,
+		ServerName:   serverName,
+		MinVersion:   tls.VersionTLS12,
+		CipherSuites: secureCipherSuites,
+	}, nil
+}
+
+// loadCertPool returns the pool of the PEM certificates of caFile.
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", caFile, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("ezb_lib/certmanager: no certificate found in %s", caFile)
+	}
+	return pool, nil
+}
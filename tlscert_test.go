@@ -0,0 +1,130 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestServerTLSConfig(t *testing.T) {
+	pki := newFakePKI(t)
+	dir := t.TempDir()
+	server, err := GenerateInDir(newCertificateRequest("server", 1, nil), pki.addr(), dir, "server", Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := GenerateInDir(newCertificateRequest("client", 1, nil), pki.addr(), dir, "client", Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, err := LoadTLSCertificate(client.CertFile, client.KeyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handshake := func(config *tls.Config, certs []tls.Certificate) error {
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		go func() {
+			defer c2.Close()
+			tls.Client(c2, &tls.Config{Certificates: certs, InsecureSkipVerify: true}).Handshake()
+		}()
+		return tls.Server(c1, config).Handshake()
+	}
+	for _, require := range []bool{false, true} {
+		config, err := ServerTLSConfig(server.CertFile, server.KeyFile, server.CAFile, require)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.MinVersion != tls.VersionTLS12 {
+			t.Errorf("min version %x", config.MinVersion)
+		}
+		if err := handshake(config, []tls.Certificate{clientCert}); err != nil {
+			t.Errorf("require %v: enrolled client refused: %v", require, err)
+		}
+		if err := handshake(config, nil); (err == nil) == require {
+			t.Errorf("require %v: anonymous client: %v", require, err)
+		}
+	}
+	if _, err := ServerTLSConfig(server.CertFile, server.KeyFile, filepath.Join(dir, "missing.crt"), true); err == nil {
+		t.Error("missing CA file accepted")
+	}
+}
+
+func TestClientTLSConfig(t *testing.T) {
+	pki := newFakePKI(t)
+	dir := t.TempDir()
+	server, err := GenerateInDir(newCertificateRequest("server", 1, []string{"server.example"}), pki.addr(), dir, "server", Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := GenerateInDir(newCertificateRequest("client", 1, nil), pki.addr(), dir, "client", Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig, err := ServerTLSConfig(server.CertFile, server.KeyFile, server.CAFile, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		serverName string
+		ok         bool
+	}{{"server.example", true}, {"other.example", false}} {
+		config, err := ClientTLSConfig(client.CertFile, client.KeyFile, client.CAFile, tc.serverName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c1, c2 := net.Pipe()
+		go func() {
+			defer c2.Close()
+			tls.Server(c2, serverConfig).Handshake()
+		}()
+		err = tls.Client(c1, config).Handshake()
+		c1.Close()
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: handshake %v", tc.serverName, err)
+		}
+	}
+}
+
+func TestTLSCertificateChain(t *testing.T) {
+	pki := newFakePKI(t)
+	pki.withIntermediate()
+	pki.negotiate, pki.version = true, ProtocolV1
+	dir := t.TempDir()
+	result, err := GenerateInDir(newCertificateRequest("server", 1, nil), pki.addr(), dir, "server", Config{ProtocolVersion: ProtocolV1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := ServerTLSConfig(result.CertFile, result.KeyFile, result.CAFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := config.Certificates[0].Certificate
+	if len(chain) != 2 || !bytes.Equal(chain[1], pki.inter.Raw) {
+		t.Errorf("server chain of %d certificates, want the leaf and the intermediate", len(chain))
+	}
+	withRoot, err := LoadTLSCertificate(result.CertFile, result.KeyFile, result.CAFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chain := withRoot.Certificate; len(chain) != 3 || !bytes.Equal(chain[2], pki.root.Raw) {
+		t.Errorf("chain of %d certificates with the CA file, want the root last", len(chain))
+	}
+}
@@ -0,0 +1,97 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import "context"
+
+// PhaseVerify names the validation of the issued certificate in traces.
+const PhaseVerify = "verify"
+
+// Tracer starts the spans traced around enrollments, see Config.Tracer.
+// It is the subset of an OpenTelemetry trace.Tracer the package needs, so
+// that callers not using OpenTelemetry don't import it: an adapter over
+// otel.Tracer, or the global provider, takes a few lines.
+type Tracer interface {
+	// Start starts a span named name as a child of the span in ctx, if
+	// any, and returns a context holding it.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	SetAttribute(key, value string)
+	// RecordError marks the span as failed with err.
+	RecordError(err error)
+	End()
+}
+
+// Span attributes set by the package.
+const (
+	AttrSubject  = "ezb.subject"
+	AttrEndpoint = "ezb.endpoint"
+	AttrOutcome  = "ezb.outcome"
+)
+
+// startSpan starts a span named name with cfg.Tracer, a no-op one when
+// unset.
+func (cfg Config) startSpan(ctx context.Context, name string) (context.Context, Span) {
+	if cfg.Tracer == nil {
+		return ctx, noopSpan{}
+	}
+	return cfg.Tracer.Start(ctx, "certmanager "+name)
+}
+
+// endSpan records the outcome of span, err or success, and ends it.
+func endSpan(span Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetAttribute(AttrOutcome, "error")
+	} else {
+		span.SetAttribute(AttrOutcome, "success")
+	}
+	span.End()
+}
+
+// phaseSpans traces the consecutive phases of an exchange, each phase
+// span ending when the next one begins.
+type phaseSpans struct {
+	ctx  context.Context
+	cfg  Config
+	span Span
+}
+
+// begin ends the current phase span, successfully, and starts one for
+// phase.
+func (p *phaseSpans) begin(phase string) {
+	if p.span != nil {
+		endSpan(p.span, nil)
+	}
+	_, p.span = p.cfg.startSpan(p.ctx, phase)
+}
+
+// end ends the current phase span with err.
+func (p *phaseSpans) end(err error) {
+	if p.span != nil {
+		endSpan(p.span, err)
+		p.span = nil
+	}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key, value string) {}
+func (noopSpan) RecordError(err error)          {}
+func (noopSpan) End()                           {}
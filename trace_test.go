@@ -0,0 +1,89 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// recordingTracer keeps the spans it started.
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+type recordedSpan struct {
+	name   string
+	parent string
+	attrs  map[string]string
+	err    error
+	ended  bool
+}
+
+type spanKey struct{}
+
+func (tr *recordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	span := &recordedSpan{name: name, attrs: map[string]string{}}
+	if parent, ok := ctx.Value(spanKey{}).(*recordedSpan); ok {
+		span.parent = parent.name
+	}
+	tr.spans = append(tr.spans, span)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func (s *recordedSpan) SetAttribute(key, value string) { s.attrs[key] = value }
+func (s *recordedSpan) RecordError(err error)          { s.err = err }
+func (s *recordedSpan) End()                           { s.ended = true }
+
+func TestTracer(t *testing.T) {
+	pki := newFakePKI(t)
+	tracer := &recordingTracer{}
+	if _, _, err := enroll(context.Background(), newCertificateRequest("node", 1, nil), pki.addr(), Config{Tracer: tracer}); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, span := range tracer.spans {
+		names = append(names, span.name)
+		if !span.ended || span.attrs[AttrOutcome] != "success" {
+			t.Errorf("span %q: ended %v, outcome %q", span.name, span.ended, span.attrs[AttrOutcome])
+		}
+		if span.name != "certmanager enroll" && span.parent != "certmanager enroll" {
+			t.Errorf("span %q is a child of %q", span.name, span.parent)
+		}
+	}
+	want := []string{"certmanager enroll", "certmanager dial", "certmanager send", "certmanager receive certificate", "certmanager receive root", "certmanager verify"}
+	if !slices.Equal(names, want) {
+		t.Errorf("spans = %q, want %q", names, want)
+	}
+	root := tracer.spans[0]
+	if root.attrs[AttrSubject] != "node" || root.attrs[AttrEndpoint] != pki.addr() {
+		t.Errorf("enroll span attributes = %v", root.attrs)
+	}
+
+	pki.wrongKey = true
+	tracer.spans = nil
+	if _, _, err := enroll(context.Background(), newCertificateRequest("node", 1, nil), pki.addr(), Config{Tracer: tracer}); err == nil {
+		t.Fatal("enrolled with a certificate for another key")
+	}
+	if span := tracer.spans[0]; span.err == nil || span.attrs[AttrOutcome] != "error" {
+		t.Errorf("failed enroll span: error %v, outcome %q", span.err, span.attrs[AttrOutcome])
+	}
+}
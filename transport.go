@@ -0,0 +1,71 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+)
+
+// secureCipherSuites are the TLS 1.2 suites offered when Config.TLS sets
+// none: ECDHE key exchange with AEAD ciphers only. TLS 1.3 suites are
+// always secure and not configurable.
+var secureCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// tlsConfig returns a copy of cfg.TLS hardened for the connection to
+// ezbpki: TLS 1.2 at least, secure cipher suites unless chosen by the
+// caller and the host of ezbpki as ServerName unless set. A MinVersion
+// below TLS 1.2 gives ErrInsecureTLS.
+func (cfg Config) tlsConfig(ezbpki string) (*tls.Config, error) {
+	config := cfg.TLS.Clone()
+	if config.MinVersion == 0 {
+		config.MinVersion = tls.VersionTLS12
+	}
+	if config.MinVersion < tls.VersionTLS12 {
+		return nil, fmt.Errorf("%w: minimum version %s", ErrInsecureTLS, tls.VersionName(config.MinVersion))
+	}
+	if config.CipherSuites == nil {
+		config.CipherSuites = secureCipherSuites
+	}
+	if config.ServerName == "" {
+		if host, _, err := net.SplitHostPort(ezbpki); err == nil {
+			config.ServerName = host
+		}
+	}
+	return config, nil
+}
+
+// startTLS runs the TLS client handshake over conn, within the deadline
+// already set on it, and returns the TLS connection.
+func startTLS(conn net.Conn, ezbpki string, cfg Config) (net.Conn, error) {
+	config, err := cfg.tlsConfig(ezbpki)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
@@ -0,0 +1,74 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTLSConfig(t *testing.T) {
+	config, err := Config{TLS: &tls.Config{}}.tlsConfig("pki.example:8000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MinVersion != tls.VersionTLS12 || config.ServerName != "pki.example" || len(config.CipherSuites) == 0 {
+		t.Errorf("hardened config: min version %x, server name %q, %d cipher suites", config.MinVersion, config.ServerName, len(config.CipherSuites))
+	}
+	if _, err := (Config{TLS: &tls.Config{MinVersion: tls.VersionTLS11}}).tlsConfig("pki.example:8000"); !errors.Is(err, ErrInsecureTLS) {
+		t.Errorf("TLS 1.1 minimum: %v, want ErrInsecureTLS", err)
+	}
+}
+
+func TestTLSTransport(t *testing.T) {
+	pki := newFakePKI(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "fake pki"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, pki.root, &key.PublicKey, pki.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pki.tls = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(pki.root)
+	if _, err := EnrollSigner(newCertificateRequest("node", 1, nil), pki.addr(), Config{TLS: &tls.Config{RootCAs: roots}}); err != nil {
+		t.Fatalf("enrollment over TLS: %v", err)
+	}
+	if _, err := EnrollSigner(newCertificateRequest("node", 1, nil), pki.addr(), Config{TLS: &tls.Config{}}); err == nil {
+		t.Error("enrolled with a PKI whose TLS certificate isn't trusted")
+	}
+}
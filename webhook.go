@@ -0,0 +1,110 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultWebhookTimeout  = 10 * time.Second
+	defaultWebhookAttempts = 3
+)
+
+// IssuanceEvent is the JSON document posted to Config.WebhookURL after
+// each enrollment.
+type IssuanceEvent struct {
+	Time                time.Time `json:"time"`
+	Outcome             string    `json:"outcome"`
+	Error               string    `json:"error,omitempty"`
+	Subject             string    `json:"subject,omitempty"`
+	Serial              string    `json:"serial,omitempty"`
+	NotAfter            time.Time `json:"not_after,omitzero"`
+	SHA256Fingerprint   string    `json:"sha256_fingerprint,omitempty"`
+	CASHA256Fingerprint string    `json:"ca_sha256_fingerprint,omitempty"`
+}
+
+// newIssuanceEvent summarizes the outcome of an enrollment.
+func newIssuanceEvent(result EnrollResult, err error) IssuanceEvent {
+	event := IssuanceEvent{Time: time.Now().UTC(), Outcome: "success"}
+	if err != nil {
+		event.Outcome = "failure"
+		event.Error = err.Error()
+	}
+	if result.Certificate != nil {
+		event.Subject = result.Certificate.Subject.String()
+		event.Serial = result.Info.Serial
+		event.NotAfter = result.Certificate.NotAfter
+		event.SHA256Fingerprint = result.Info.SHA256Fingerprint
+	}
+	if result.CA != nil {
+		event.CASHA256Fingerprint = fingerprint(result.CA)
+	}
+	return event
+}
+
+// notifyWebhook posts the outcome to cfg.WebhookURL in the background, so
+// a slow or failing endpoint never delays nor changes the enrollment
+// result. A process exiting right after enrolling may not deliver it.
+func (cfg Config) notifyWebhook(result EnrollResult, err error) {
+	if cfg.WebhookURL == "" {
+		return
+	}
+	body, jerr := json.Marshal(newIssuanceEvent(result, err))
+	if jerr != nil {
+		fmt.Println("Failed to encode webhook event:", jerr)
+		return
+	}
+	go cfg.postWebhook(body)
+}
+
+// postWebhook tries to deliver body, backing off between attempts, and
+// logs the error of each attempt when all of them failed.
+func (cfg Config) postWebhook(body []byte) {
+	timeout := cfg.WebhookTimeout
+	if timeout <= 0 {
+		timeout = defaultWebhookTimeout
+	}
+	attempts := cfg.WebhookAttempts
+	if attempts <= 0 {
+		attempts = defaultWebhookAttempts
+	}
+	client := &http.Client{Timeout: timeout}
+	delay := time.Second
+	var errs []error
+	for attempt := 1; ; attempt++ {
+		resp, err := client.Post(cfg.WebhookURL, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return
+			}
+			err = fmt.Errorf("status %s", resp.Status)
+		}
+		errs = append(errs, fmt.Errorf("attempt %d: %w", attempt, err))
+		if attempt == attempts {
+			fmt.Println("Failed to deliver webhook event:", errors.Join(errs...))
+			return
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
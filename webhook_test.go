@@ -0,0 +1,80 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhook(t *testing.T) {
+	pki := newFakePKI(t)
+	events := make(chan IssuanceEvent, 1)
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The first delivery fails, the retry succeeds.
+		if calls.Add(1) == 1 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		var event IssuanceEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("webhook body: %v, content type %q", err, r.Header.Get("Content-Type"))
+		}
+		events <- event
+	}))
+	defer srv.Close()
+
+	result, err := EnrollSigner(newCertificateRequest("node", 1, nil), pki.addr(), Config{WebhookURL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-events:
+		if event.Outcome != "success" || event.Error != "" || event.Subject != result.Certificate.Subject.String() ||
+			event.Serial != result.Info.Serial || !event.NotAfter.Equal(result.Certificate.NotAfter) ||
+			event.SHA256Fingerprint != result.Info.SHA256Fingerprint || event.CASHA256Fingerprint != fingerprint(result.CA) {
+			t.Errorf("event %+v does not describe %+v", event, result.Info)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("no webhook event delivered")
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("%d webhook calls, want 2", n)
+	}
+}
+
+func TestWebhookFailure(t *testing.T) {
+	pki := newFakePKI(t)
+	failed := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusInternalServerError)
+		failed <- struct{}{}
+	}))
+	defer srv.Close()
+	if _, err := EnrollSigner(newCertificateRequest("node", 1, nil), pki.addr(), Config{WebhookURL: srv.URL, WebhookAttempts: 1}); err != nil {
+		t.Fatalf("failing webhook failed the enrollment: %v", err)
+	}
+	select {
+	case <-failed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("webhook not called")
+	}
+}